@@ -0,0 +1,223 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// client access lists, set up by main before the web server starts.
+// A client matching denyNets is always rejected. If allowNets is not
+// empty, a client must match it to be accepted.
+var allowNets, denyNets []*net.IPNet
+
+// parseNet parses an IP address or CIDR network.
+func parseNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// readHostsFile reads a VLC style .hosts file: one IP address or CIDR
+// network per line, with # starting a comment. Each entry is allowed.
+func readHostsFile(name string) ([]*net.IPNet, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(bytes.NewBuffer(b))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		n, err := parseNet(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// clientIP returns the IP address of the client making r, or nil if
+// it does not have one (e.g. it connected over a Unix socket).
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func matchNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAllowed reports whether ip passes the access lists. Clients
+// without an IP address are local and always allowed.
+func clientAllowed(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	if matchNets(denyNets, ip) {
+		return false
+	}
+	return len(allowNets) == 0 || matchNets(allowNets, ip)
+}
+
+// After maxAuthFailures consecutive failed logins a client is locked
+// out for lockoutBase, doubling with each further failure up to
+// lockoutMax.
+const (
+	maxAuthFailures = 5
+	lockoutBase     = 30 * time.Second
+	lockoutMax      = time.Hour
+	// failure records untouched for this long are discarded
+	failureExpiry = 24 * time.Hour
+)
+
+type authFailure struct {
+	count int
+	until time.Time // locked out until this time
+	last  time.Time // time of last failure
+}
+
+// authFailures tracks failed logins per client IP.
+var authFailures = struct {
+	sync.Mutex
+	m map[string]*authFailure
+}{m: map[string]*authFailure{}}
+
+// failureKey returns the key of ip in authFailures. Clients without
+// an IP address share a single key, so that a proxy on a Unix socket
+// cannot guess passwords without limit.
+func failureKey(ip net.IP) string {
+	if ip == nil {
+		return "unix"
+	}
+	return ip.String()
+}
+
+// lockedOut returns how much longer ip is locked out for, or 0.
+func lockedOut(ip net.IP) time.Duration {
+	authFailures.Lock()
+	defer authFailures.Unlock()
+	if f, ok := authFailures.m[failureKey(ip)]; ok {
+		if d := f.until.Sub(time.Now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// recordAuthFailure notes a failed login from ip, locking it out if
+// it has failed too many times.
+func recordAuthFailure(ip net.IP) {
+	key := failureKey(ip)
+	now := time.Now()
+	authFailures.Lock()
+	defer authFailures.Unlock()
+	if len(authFailures.m) > 1000 {
+		for k, f := range authFailures.m {
+			if now.Sub(f.last) > failureExpiry {
+				delete(authFailures.m, k)
+			}
+		}
+	}
+	f, ok := authFailures.m[key]
+	if !ok || now.Sub(f.last) > failureExpiry {
+		f = &authFailure{}
+		authFailures.m[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= maxAuthFailures {
+		d := lockoutBase
+		for i := maxAuthFailures; i < f.count && d < lockoutMax; i++ {
+			d *= 2
+		}
+		if d > lockoutMax {
+			d = lockoutMax
+		}
+		f.until = now.Add(d)
+		logWarn("client locked out", "client", key,
+			"failures", f.count, "duration", d)
+	}
+}
+
+// clearAuthFailures forgets failed logins from ip after a successful
+// login.
+func clearAuthFailures(ip net.IP) {
+	authFailures.Lock()
+	delete(authFailures.m, failureKey(ip))
+	authFailures.Unlock()
+}
+
+// admitted checks the client making r against the access lists and
+// lockouts. If the client is rejected it writes a response, logs the
+// rejection and returns false.
+func admitted(w http.ResponseWriter, r *http.Request) bool {
+	ip := clientIP(r)
+	if !clientAllowed(ip) {
+		logWarn("rejected client: not allowed", "client", ip)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if d := lockedOut(ip); d > 0 {
+		logWarn("rejected client: locked out", "client", failureKey(ip))
+		secs := int(d/time.Second) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
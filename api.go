@@ -0,0 +1,654 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The REST API. It is served under apiPrefix and sends the same
+// commands to the select loop as the VLC handlers do. Volumes are
+// percentages of the backend's maximum volume (VLC's 0 -> 320) and
+// positions are in seconds. See apiSpecTxt for the OpenAPI
+// description.
+
+const apiPrefix = "/api/v1/"
+
+// apiTrack is a playlist entry.
+type apiTrack struct {
+	ID      int    `json:"id"`
+	URI     string `json:"uri"`
+	Name    string `json:"name"`
+	Current bool   `json:"current"`
+}
+
+type apiPlaylist struct {
+	Version int        `json:"version"` // changes whenever the playlist does
+	Tracks  []apiTrack `json:"tracks"`  // in playing order
+}
+
+type apiPlayer struct {
+	State      string    `json:"state"` // playing, paused or stopped
+	Track      *apiTrack `json:"track"` // null if the playlist is empty
+	Title      string    `json:"title"`
+	Artist     string    `json:"artist"`
+	NowPlaying string    `json:"now_playing"`
+	Station    string    `json:"station"`
+	ArtworkURL string    `json:"artwork_url"`
+	Position   int       `json:"position"`
+	Duration   int       `json:"duration"`
+	Volume     int       `json:"volume"`
+	Loop       bool      `json:"loop"`
+	Repeat     bool      `json:"repeat"`
+	Shuffle    bool      `json:"shuffle"`
+}
+
+// apiPlayerUpdate is the body of PATCH /player. Absent fields are
+// left unchanged.
+type apiPlayerUpdate struct {
+	State    *string `json:"state"`
+	Position *int    `json:"position"`
+	Volume   *int    `json:"volume"`
+	Loop     *bool   `json:"loop"`
+	Repeat   *bool   `json:"repeat"`
+	Shuffle  *bool   `json:"shuffle"`
+}
+
+// apiState is the reply to cmdGetAPIState.
+type apiState struct {
+	player   apiPlayer
+	playlist apiPlaylist
+}
+
+type cmdGetAPIState struct {
+	replyChan chan<- apiState
+	player    bool // whether to query the backend for the player state
+}
+type cmdRemove struct {
+	id int
+}
+
+// funcGetAPIState returns the playlist state and, if player is set,
+// the player state.
+func funcGetAPIState(in io.Writer, outChan <-chan string, player bool) apiState {
+	var st apiState
+	st.playlist.Version = playlistVersion
+	st.playlist.Tracks = []apiTrack{}
+	for shufpos := range playlist {
+		id := playlist[shufToPos[shufpos]]
+		st.playlist.Tracks = append(st.playlist.Tracks, apiTrack{
+			ID:      id,
+			URI:     idTrackMap[id],
+			Name:    filepath.Base(idTrackMap[id]),
+			Current: id == playlist[playpos],
+		})
+	}
+	if !player {
+		return st
+	}
+	s := currentState(in, outChan)
+	st.player = apiPlayer{
+		State:      s.State,
+		Title:      s.Title,
+		Artist:     s.Artist,
+		NowPlaying: s.NowPlaying,
+		Station:    s.Station,
+		ArtworkURL: s.ArtworkURL,
+		Position:   s.Time,
+		Duration:   s.Length,
+		Volume:     (s.Volume*100 + 160) / 320,
+		Loop:       s.Loop,
+		Repeat:     s.Repeat,
+		Shuffle:    s.Random,
+	}
+	for i := range st.playlist.Tracks {
+		if st.playlist.Tracks[i].Current {
+			st.player.Track = &st.playlist.Tracks[i]
+		}
+	}
+	return st
+}
+
+// funcRemove removes track id from the playlist, stopping playback
+// first if it is the current track.
+func funcRemove(in io.Writer, outChan <-chan string, id int) {
+	pos, ok := idPosMap[id]
+	if !ok {
+		return
+	}
+	if pos == playpos && !stopped {
+		funcStop(in, outChan)
+	}
+	shufpos := posToShuf[pos]
+	playlist = append(playlist[:pos], playlist[pos+1:]...)
+	delete(idTrackMap, id)
+	delete(idPosMap, id)
+	delete(resumeKeys, id)
+	delete(resumeLengths, id)
+	for p := pos; p < len(playlist); p++ {
+		idPosMap[playlist[p]] = p
+	}
+	// renumber the shuffle state without pos
+	newPosToShuf := make([]int, 0, len(playlist))
+	for p, sp := range posToShuf {
+		if p == pos {
+			continue
+		}
+		if sp > shufpos {
+			sp--
+		}
+		newPosToShuf = append(newPosToShuf, sp)
+	}
+	posToShuf = newPosToShuf
+	shufToPos = make([]int, len(playlist))
+	for p, sp := range posToShuf {
+		shufToPos[sp] = p
+	}
+	if playpos > pos {
+		playpos--
+	}
+	if playpos >= len(playlist) {
+		playpos = 0
+	}
+	playlistVersion++
+}
+
+// getAPIState fetches the state from the select loop.
+func getAPIState(commandChan chan<- interface{}, player bool) apiState {
+	replyChan := make(chan apiState, 1)
+	commandChan <- cmdGetAPIState{replyChan: replyChan, player: player}
+	return <-replyChan
+}
+
+func apiWrite(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		logError("cannot encode API response", "err", err)
+		code, b = http.StatusInternalServerError, []byte(`{"error":"internal error"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(b, '\n'))
+}
+
+func apiError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	apiWrite(w, code, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+// apiRead decodes the JSON request body into v, replying with an
+// error and returning false if it is invalid.
+func apiRead(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil && err != io.EOF {
+		apiError(w, http.StatusBadRequest, "invalid request body: %v", err)
+		return false
+	}
+	return true
+}
+
+// apiJSONRequest checks that a request with a body says the body is
+// JSON, replying with an error and returning false if not. As
+// browsers cannot send that cross-site without the server's
+// permission, this stops other sites using a browser's cached
+// credentials to change the player. A POST without a body can be
+// sent cross-site too, so it is checked with sameSite instead, while
+// bodiless DELETEs and the like are always preflighted by browsers.
+func apiJSONRequest(w http.ResponseWriter, r *http.Request) bool {
+	switch {
+	case r.Method != "POST" && r.Method != "PUT" && r.Method != "PATCH":
+		return true
+	case r.ContentLength == 0:
+		return r.Method != "POST" || sameSite(w, r)
+	}
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || t != "application/json" {
+		apiError(w, http.StatusUnsupportedMediaType,
+			"Content-Type must be application/json")
+		return false
+	}
+	return true
+}
+
+// apiMethod checks the request method is one of methods, replying
+// with an error and returning false if not.
+func apiMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	apiError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	return false
+}
+
+// startAPI registers the REST API handlers.
+func startAPI(commandChan chan<- interface{}) {
+	http.HandleFunc(
+		apiPrefix,
+		func(w http.ResponseWriter, r *http.Request) {
+			role := roleFull
+			if r.Method == "GET" {
+				role = roleReadOnly
+			}
+			if authorized(w, r, role) == nil {
+				return
+			}
+			parts := strings.Split(
+				strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+			countRequest("api", "")
+			if !apiJSONRequest(w, r) {
+				return
+			}
+			switch {
+			case len(parts) == 1 && parts[0] == "openapi.json":
+				if apiMethod(w, r, "GET") {
+					w.Header().Set("Content-Type", "application/json")
+					io.WriteString(w, apiSpecTxt)
+				}
+			case len(parts) == 1 && parts[0] == "player":
+				apiPlayerHandler(commandChan, w, r)
+			case len(parts) == 2 && parts[0] == "player":
+				apiPlayerAction(commandChan, w, r, parts[1])
+			case len(parts) == 1 && parts[0] == "playlist":
+				apiPlaylistHandler(commandChan, w, r)
+			case len(parts) == 2 && parts[0] == "playlist":
+				id, err := strconv.Atoi(parts[1])
+				if err != nil {
+					apiError(w, http.StatusNotFound, "no such track")
+					return
+				}
+				apiTrackHandler(commandChan, w, r, id)
+			default:
+				apiError(w, http.StatusNotFound, "not found")
+			}
+		})
+}
+
+// apiPlayerHandler handles GET and PATCH /player.
+func apiPlayerHandler(commandChan chan<- interface{}, w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "GET", "PATCH") {
+		return
+	}
+	if r.Method == "PATCH" {
+		var u apiPlayerUpdate
+		if !apiRead(w, r, &u) {
+			return
+		}
+		if u.State != nil {
+			switch *u.State {
+			case "playing", "paused", "stopped":
+			default:
+				apiError(w, http.StatusBadRequest,
+					"state must be playing, paused or stopped")
+				return
+			}
+		}
+		if u.Volume != nil && (*u.Volume < 0 || *u.Volume > 100) {
+			apiError(w, http.StatusBadRequest, "volume must be 0 to 100")
+			return
+		}
+		if u.Position != nil && *u.Position < 0 {
+			apiError(w, http.StatusBadRequest, "position must not be negative")
+			return
+		}
+		// shuffle, loop and repeat are toggles, so compare against
+		// the current state
+		p := getAPIState(commandChan, true).player
+		if u.State != nil && *u.State != p.State {
+			switch {
+			case *u.State == "stopped":
+				commandChan <- cmdStop{}
+			case p.State == "stopped":
+				commandChan <- cmdPlay{id: -1}
+				if *u.State == "paused" {
+					commandChan <- cmdPause{}
+				}
+			default:
+				commandChan <- cmdPause{}
+			}
+		}
+		if u.Position != nil {
+			commandChan <- cmdSeek{val: *u.Position, mode: seekAbs}
+		}
+		if u.Volume != nil {
+			commandChan <- cmdVolume{val: *u.Volume * 320 / 100, mode: volAbs}
+		}
+		if u.Shuffle != nil && *u.Shuffle != p.Shuffle {
+			commandChan <- cmdShuffle{}
+		}
+		if u.Loop != nil && *u.Loop != p.Loop {
+			commandChan <- cmdLoop{}
+			p.Repeat = false // cleared by cmdLoop
+		}
+		if u.Repeat != nil && *u.Repeat != p.Repeat {
+			commandChan <- cmdRepeat{}
+		}
+	}
+	apiWrite(w, http.StatusOK, getAPIState(commandChan, true).player)
+}
+
+// apiPlayerAction handles POST /player/{play,next,previous}.
+func apiPlayerAction(commandChan chan<- interface{}, w http.ResponseWriter, r *http.Request, action string) {
+	switch action {
+	case "play", "next", "previous":
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !apiMethod(w, r, "POST") {
+		return
+	}
+	switch action {
+	case "play":
+		// an optional body {"id": id} chooses the track
+		body := struct {
+			ID *int `json:"id"`
+		}{}
+		if !apiRead(w, r, &body) {
+			return
+		}
+		id := -1
+		if body.ID != nil {
+			if !apiHasTrack(commandChan, *body.ID) {
+				apiError(w, http.StatusNotFound, "no such track")
+				return
+			}
+			id = *body.ID
+		}
+		commandChan <- cmdPlay{id: id}
+	case "next":
+		commandChan <- cmdNext{}
+	case "previous":
+		commandChan <- cmdPrev{}
+	}
+	apiWrite(w, http.StatusOK, getAPIState(commandChan, true).player)
+}
+
+// apiPlaylistHandler handles GET and POST /playlist.
+func apiPlaylistHandler(commandChan chan<- interface{}, w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "GET", "POST") {
+		return
+	}
+	if r.Method == "GET" {
+		apiWrite(w, http.StatusOK, getAPIState(commandChan, false).playlist)
+		return
+	}
+	body := struct {
+		URI  string `json:"uri"`
+		Play bool   `json:"play"`
+	}{}
+	if !apiRead(w, r, &body) {
+		return
+	}
+	if body.URI == "" {
+		apiError(w, http.StatusBadRequest, "uri is required")
+		return
+	}
+	replyChan := make(chan int, 1)
+	commandChan <- cmdSetPlaylist{
+		uri: body.URI, enqueue: !body.Play, replyChan: replyChan}
+	id := <-replyChan
+	if id < 0 {
+		apiError(w, http.StatusBadRequest, "invalid uri")
+		return
+	}
+	t, _ := apiFindTrack(commandChan, id)
+	w.Header().Set("Location", apiPrefix+"playlist/"+strconv.Itoa(id))
+	apiWrite(w, http.StatusCreated, t)
+}
+
+// apiTrackHandler handles GET, PATCH and DELETE /playlist/{id}.
+// PATCH takes {"position": n}, moving the track to position n
+// (counting from 0) in the playing order.
+func apiTrackHandler(commandChan chan<- interface{}, w http.ResponseWriter, r *http.Request, id int) {
+	if !apiMethod(w, r, "GET", "PATCH", "DELETE") {
+		return
+	}
+	pl := getAPIState(commandChan, false).playlist
+	pos := -1
+	for i, t := range pl.Tracks {
+		if t.ID == id {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		apiError(w, http.StatusNotFound, "no such track")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		apiWrite(w, http.StatusOK, pl.Tracks[pos])
+	case "PATCH":
+		body := struct {
+			Position *int `json:"position"`
+		}{}
+		if !apiRead(w, r, &body) {
+			return
+		}
+		if body.Position != nil {
+			to := *body.Position
+			if to < 0 || to >= len(pl.Tracks) {
+				apiError(w, http.StatusBadRequest,
+					"position must be 0 to %d", len(pl.Tracks)-1)
+				return
+			}
+			commandChan <- cmdMove{id: id, target: pl.Tracks[to].ID}
+		}
+		t, ok := apiFindTrack(commandChan, id)
+		if !ok {
+			apiError(w, http.StatusNotFound, "no such track")
+			return
+		}
+		apiWrite(w, http.StatusOK, t)
+	case "DELETE":
+		commandChan <- cmdRemove{id: id}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func apiFindTrack(commandChan chan<- interface{}, id int) (apiTrack, bool) {
+	for _, t := range getAPIState(commandChan, false).playlist.Tracks {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return apiTrack{}, false
+}
+
+func apiHasTrack(commandChan chan<- interface{}, id int) bool {
+	_, ok := apiFindTrack(commandChan, id)
+	return ok
+}
+
+// apiSpecTxt is the OpenAPI description of the API, served at
+// /api/v1/openapi.json.
+const apiSpecTxt = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "MPlayer-RC",
+    "description": "Control of an MPlayer/MPV backend. Volumes are percentages of the backend's maximum volume and positions are in seconds.",
+    "version": "1"
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"basic": []}],
+  "paths": {
+    "/player": {
+      "get": {
+        "summary": "Get the player state",
+        "responses": {"200": {"$ref": "#/components/responses/Player"}}
+      },
+      "patch": {
+        "summary": "Change the player state",
+        "description": "Only the fields given are changed. loop and repeat are exclusive, so setting one clears the other.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PlayerUpdate"}}}},
+        "responses": {
+          "200": {"$ref": "#/components/responses/Player"},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/player/play": {
+      "post": {
+        "summary": "Play the current track, or the track given by id",
+        "requestBody": {"content": {"application/json": {"schema": {"type": "object", "properties": {"id": {"type": "integer"}}, "additionalProperties": false}}}},
+        "responses": {
+          "200": {"$ref": "#/components/responses/Player"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/player/next": {
+      "post": {
+        "summary": "Play the next track",
+        "responses": {"200": {"$ref": "#/components/responses/Player"}}
+      }
+    },
+    "/player/previous": {
+      "post": {
+        "summary": "Play the previous track",
+        "responses": {"200": {"$ref": "#/components/responses/Player"}}
+      }
+    },
+    "/playlist": {
+      "get": {
+        "summary": "Get the playlist",
+        "responses": {"200": {"description": "The playlist", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Playlist"}}}}}
+      },
+      "post": {
+        "summary": "Add a track to the end of the playlist",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {
+          "type": "object",
+          "required": ["uri"],
+          "properties": {
+            "uri": {"type": "string", "description": "A path, file: URI or URL"},
+            "play": {"type": "boolean", "description": "Play the track at once"}
+          },
+          "additionalProperties": false
+        }}}},
+        "responses": {
+          "201": {"$ref": "#/components/responses/Track"},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/playlist/{id}": {
+      "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "integer"}}],
+      "get": {
+        "summary": "Get a track",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Track"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "patch": {
+        "summary": "Move a track",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {
+          "type": "object",
+          "properties": {"position": {"type": "integer", "minimum": 0, "description": "The new position in the playing order, counting from 0"}},
+          "additionalProperties": false
+        }}}},
+        "responses": {
+          "200": {"$ref": "#/components/responses/Track"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Remove a track, stopping playback if it is the current track",
+        "responses": {
+          "204": {"description": "Removed"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {"basic": {"type": "http", "scheme": "basic"}},
+    "responses": {
+      "Player": {"description": "The player state", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Player"}}}},
+      "Track": {"description": "A track", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Track"}}}},
+      "Error": {"description": "An error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Track": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "uri": {"type": "string"},
+          "name": {"type": "string"},
+          "current": {"type": "boolean"}
+        }
+      },
+      "Playlist": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "integer", "description": "Changes whenever the playlist does"},
+          "tracks": {"type": "array", "items": {"$ref": "#/components/schemas/Track"}, "description": "In playing order"}
+        }
+      },
+      "Player": {
+        "type": "object",
+        "properties": {
+          "state": {"type": "string", "enum": ["playing", "paused", "stopped"]},
+          "track": {"allOf": [{"$ref": "#/components/schemas/Track"}], "nullable": true},
+          "title": {"type": "string"},
+          "artist": {"type": "string"},
+          "now_playing": {"type": "string"},
+          "station": {"type": "string"},
+          "artwork_url": {"type": "string"},
+          "position": {"type": "integer"},
+          "duration": {"type": "integer"},
+          "volume": {"type": "integer", "minimum": 0, "maximum": 100},
+          "loop": {"type": "boolean"},
+          "repeat": {"type": "boolean"},
+          "shuffle": {"type": "boolean"}
+        }
+      },
+      "PlayerUpdate": {
+        "type": "object",
+        "properties": {
+          "state": {"type": "string", "enum": ["playing", "paused", "stopped"]},
+          "position": {"type": "integer", "minimum": 0},
+          "volume": {"type": "integer", "minimum": 0, "maximum": 100},
+          "loop": {"type": "boolean"},
+          "repeat": {"type": "boolean"},
+          "shuffle": {"type": "boolean"}
+        },
+        "additionalProperties": false
+      },
+      "Error": {
+        "type": "object",
+        "properties": {"error": {"type": "string"}}
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,401 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Cover art
+//
+// ID3v2: http://id3.org/id3v2.3.0
+//        http://id3.org/id3v2.4.0-structure
+//
+//  FLAC: https://xiph.org/flac/format.html#metadata_block_picture
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errNoArt = errors.New("no cover art found")
+
+// artFiles are the image files looked for alongside a track when it
+// has no embedded cover art, in order of preference.
+var artFiles = []string{
+	"cover.jpg", "cover.png", "folder.jpg", "folder.png",
+	"front.jpg", "front.png",
+}
+
+// artData is a cover art image.
+type artData struct {
+	data        []byte
+	contentType string
+	etag        string
+	modTime     time.Time
+}
+
+// artCache records, per track id, whether cover art was found for the
+// track. It is used by status requests to decide whether to advertise
+// an artwork_url and, like the playlist state, is only accessed from
+// the select loop.
+var artCache = map[int]bool{}
+
+// hasArt reports whether track id has cover art, caching the result.
+func hasArt(id int) bool {
+	if found, ok := artCache[id]; ok {
+		return found
+	}
+	track, ok := idTrackMap[id]
+	if !ok {
+		return false
+	}
+	_, err := findArt(track)
+	artCache[id] = err == nil
+	return err == nil
+}
+
+// trackPath converts a track (file or URL) into a local file path. It
+// returns "" if the track is not a local file.
+func trackPath(track string) string {
+	if strings.HasPrefix(track, "file://") {
+		if u, err := url.Parse(track); err == nil {
+			return u.Path
+		}
+		return ""
+	}
+	if strings.Contains(track, "://") {
+		return ""
+	}
+	return track
+}
+
+// findArt returns the cover art for track. Art embedded in the track's
+// tags is preferred, then any of artFiles in the track's directory.
+func findArt(track string) (*artData, error) {
+	p := trackPath(track)
+	if p == "" {
+		return nil, errNoArt
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, errNoArt
+	}
+	if data, mime := embeddedArt(f); data != nil {
+		return newArtData(data, mime, fi.ModTime()), nil
+	}
+	for _, name := range artFiles {
+		img := filepath.Join(filepath.Dir(p), name)
+		ifi, err := os.Stat(img)
+		if err != nil || ifi.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(img)
+		if err != nil {
+			continue
+		}
+		return newArtData(data, "", ifi.ModTime()), nil
+	}
+	return nil, errNoArt
+}
+
+func newArtData(data []byte, mime string, modTime time.Time) *artData {
+	if !strings.HasPrefix(mime, "image/") {
+		mime = detectImageType(data)
+	}
+	sum := sha1.Sum(data)
+	return &artData{
+		data:        data,
+		contentType: mime,
+		etag:        `"` + hex.EncodeToString(sum[:8]) + `"`,
+		modTime:     modTime,
+	}
+}
+
+// detectImageType sniffs the image type from its leading bytes.
+func detectImageType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "image/jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return "image/gif"
+	case bytes.HasPrefix(data, []byte("BM")):
+		return "image/bmp"
+	}
+	return "application/octet-stream"
+}
+
+// embeddedArt returns the image data and MIME type of the cover art
+// embedded in r, or nil if there is none. ID3v2 (MP3 etc) and FLAC
+// tags are supported.
+func embeddedArt(r io.ReadSeeker) ([]byte, string) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, ""
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, ""
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte("ID3")):
+		return id3Art(r)
+	case bytes.Equal(magic, []byte("fLaC")):
+		return flacArt(r)
+	}
+	return nil, ""
+}
+
+// syncsafe decodes a big endian integer made up of 7 bit bytes.
+func syncsafe(b []byte) int {
+	var n int
+	for _, c := range b {
+		n = n<<7 | int(c&0x7f)
+	}
+	return n
+}
+
+// unsync reverses the ID3v2 unsynchronisation scheme.
+func unsync(b []byte) []byte {
+	return bytes.Replace(b, []byte{0xff, 0x00}, []byte{0xff}, -1)
+}
+
+// maxTagSize limits how much of a file is read when looking for art.
+const maxTagSize = 16 << 20
+
+func id3Art(r io.Reader) ([]byte, string) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ""
+	}
+	ver, flags, size := header[3], header[5], syncsafe(header[6:10])
+	if ver < 2 || ver > 4 || size > maxTagSize {
+		return nil, ""
+	}
+	tag := make([]byte, size)
+	if _, err := io.ReadFull(r, tag); err != nil {
+		return nil, ""
+	}
+	if flags&0x80 != 0 && ver < 4 {
+		tag = unsync(tag)
+	}
+	if flags&0x40 != 0 && ver > 2 {
+		// skip extended header
+		if len(tag) < 4 {
+			return nil, ""
+		}
+		n := syncsafe(tag[0:4])
+		if ver == 3 {
+			n = int(binary.BigEndian.Uint32(tag[0:4])) + 4
+		}
+		if n > len(tag) {
+			return nil, ""
+		}
+		tag = tag[n:]
+	}
+	idLen, hdrLen := 4, 10
+	if ver == 2 {
+		idLen, hdrLen = 3, 6
+	}
+	var first []byte
+	var firstMime string
+	for len(tag) >= hdrLen && tag[0] != 0 {
+		id := string(tag[:idLen])
+		var n int
+		switch ver {
+		case 2:
+			n = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			n = int(binary.BigEndian.Uint32(tag[4:8]))
+		case 4:
+			n = syncsafe(tag[4:8])
+		}
+		if n < 0 || n > len(tag)-hdrLen {
+			break
+		}
+		frame := tag[hdrLen : hdrLen+n]
+		if ver == 4 && tag[9]&0x02 != 0 {
+			frame = unsync(frame)
+		}
+		if ver == 4 && tag[9]&0x01 != 0 && len(frame) >= 4 {
+			// skip data length indicator
+			frame = frame[4:]
+		}
+		tag = tag[hdrLen+n:]
+		if id != "APIC" && id != "PIC" {
+			continue
+		}
+		data, mime, picType := parseAPIC(frame, ver == 2)
+		if data == nil {
+			continue
+		}
+		if picType == 3 { // front cover
+			return data, mime
+		}
+		if first == nil {
+			first, firstMime = data, mime
+		}
+	}
+	return first, firstMime
+}
+
+// parseAPIC parses an APIC frame (or a PIC frame if v22 is true),
+// returning the image data, MIME type and picture type.
+func parseAPIC(frame []byte, v22 bool) ([]byte, string, byte) {
+	if len(frame) < 2 {
+		return nil, "", 0
+	}
+	enc := frame[0]
+	frame = frame[1:]
+	var mime string
+	if v22 {
+		if len(frame) < 3 {
+			return nil, "", 0
+		}
+		switch strings.ToUpper(string(frame[:3])) {
+		case "JPG":
+			mime = "image/jpeg"
+		case "PNG":
+			mime = "image/png"
+		}
+		frame = frame[3:]
+	} else {
+		i := bytes.IndexByte(frame, 0)
+		if i < 0 {
+			return nil, "", 0
+		}
+		mime = strings.ToLower(string(frame[:i]))
+		if mime != "" && !strings.Contains(mime, "/") {
+			mime = "image/" + mime
+		}
+		frame = frame[i+1:]
+	}
+	if len(frame) < 1 {
+		return nil, "", 0
+	}
+	picType := frame[0]
+	frame = frame[1:]
+	// skip the description, whose terminator depends on the encoding
+	switch enc {
+	case 1, 2: // UTF-16
+		for i := 0; i+1 < len(frame); i += 2 {
+			if frame[i] == 0 && frame[i+1] == 0 {
+				return frame[i+2:], mime, picType
+			}
+		}
+	default: // ISO-8859-1, UTF-8
+		if i := bytes.IndexByte(frame, 0); i >= 0 {
+			return frame[i+1:], mime, picType
+		}
+	}
+	return nil, "", 0
+}
+
+func flacArt(r io.Reader) ([]byte, string) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, ""
+	}
+	var first []byte
+	var firstMime string
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		last, blockType := header[0]&0x80 != 0, header[0]&0x7f
+		n := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		block := make([]byte, n)
+		if _, err := io.ReadFull(r, block); err != nil {
+			break
+		}
+		if blockType == 6 { // PICTURE
+			data, mime, picType := parseFLACPicture(block)
+			if data != nil {
+				if picType == 3 { // front cover
+					return data, mime
+				}
+				if first == nil {
+					first, firstMime = data, mime
+				}
+			}
+		}
+		if last {
+			break
+		}
+	}
+	return first, firstMime
+}
+
+// parseFLACPicture parses a FLAC PICTURE metadata block, returning the
+// image data, MIME type and picture type.
+func parseFLACPicture(b []byte) ([]byte, string, byte) {
+	// next returns the next length-prefixed field of b
+	next := func() ([]byte, bool) {
+		if len(b) < 4 {
+			return nil, false
+		}
+		n := binary.BigEndian.Uint32(b[0:4])
+		if uint64(n) > uint64(len(b)-4) {
+			return nil, false
+		}
+		field := b[4 : 4+n]
+		b = b[4+n:]
+		return field, true
+	}
+	if len(b) < 4 {
+		return nil, "", 0
+	}
+	picType := binary.BigEndian.Uint32(b[0:4])
+	b = b[4:]
+	mime, ok := next()
+	if !ok {
+		return nil, "", 0
+	}
+	if _, ok := next(); !ok { // description
+		return nil, "", 0
+	}
+	if len(b) < 16 { // width, height, depth, colors
+		return nil, "", 0
+	}
+	b = b[16:]
+	data, ok := next()
+	if !ok {
+		return nil, "", 0
+	}
+	return data, strings.ToLower(string(mime)), byte(picType)
+}
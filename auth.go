@@ -0,0 +1,230 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// user roles
+const (
+	roleReadOnly = 0 // status, playlist and cover art only
+	roleFull     = 1 // full control
+)
+
+// user is an account allowed to use the VLC remote interface. The
+// VLC remote itself only ever sends the empty username.
+type user struct {
+	name     string
+	password string // plaintext password, if hash is ""
+	hash     string // bcrypt or argon2 password hash
+	role     int
+}
+
+// users maps usernames to accounts. It is set up by main before the
+// web server starts and not modified afterwards.
+var users = map[string]*user{}
+
+// parseUser parses a user=name:password[:role] config line (without
+// the "user=" prefix). The password must be a bcrypt ($2a$...) or
+// argon2 ($argon2id$...) hash. role is "full" (the default) or
+// "read-only".
+func parseUser(s string) (*user, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return nil, errors.New("missing password hash")
+	}
+	u := &user{name: s[:i], role: roleFull}
+	hash := s[i+1:]
+	if j := strings.LastIndex(hash, ":"); j >= 0 {
+		switch strings.ToLower(hash[j+1:]) {
+		case "full":
+			hash = hash[:j]
+		case "read-only", "readonly", "ro":
+			u.role = roleReadOnly
+			hash = hash[:j]
+		}
+	}
+	if !isPasswordHash(hash) {
+		return nil, fmt.Errorf("user %q: password must be a bcrypt or argon2 hash", u.name)
+	}
+	u.hash = hash
+	return u, nil
+}
+
+func isPasswordHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") ||
+		strings.HasPrefix(s, "$2y$") || strings.HasPrefix(s, "$argon2")
+}
+
+// hashPassword returns a bcrypt hash of password suitable for use in
+// the config file.
+func hashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(b), err
+}
+
+// verifiedCache remembers credentials which have already passed a
+// (deliberately slow) hash comparison, keyed by a SHA-256 of the
+// username and password, so that remotes polling status every second
+// are not slowed down.
+var verifiedCache = struct {
+	sync.Mutex
+	m map[[sha256.Size]byte]bool
+}{m: map[[sha256.Size]byte]bool{}}
+
+// checkPassword reports whether password is correct for u.
+func (u *user) checkPassword(password string) bool {
+	if u.hash == "" {
+		a := sha256.Sum256([]byte(u.password))
+		b := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+	}
+	if u == dummyUser {
+		// never cached, as it shares the VLC password's empty name
+		return verifyHash(u.hash, password)
+	}
+	key := sha256.Sum256([]byte(u.name + "\x00" + password))
+	verifiedCache.Lock()
+	ok := verifiedCache.m[key]
+	verifiedCache.Unlock()
+	if ok {
+		return true
+	}
+	if !verifyHash(u.hash, password) {
+		return false
+	}
+	verifiedCache.Lock()
+	verifiedCache.m[key] = true
+	verifiedCache.Unlock()
+	return true
+}
+
+// verifyHash compares password against a bcrypt or argon2 hash.
+func verifyHash(hash, password string) bool {
+	if !strings.HasPrefix(hash, "$argon2") {
+		return bcrypt.CompareHashAndPassword(
+			[]byte(hash), []byte(password)) == nil
+	}
+	// $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+	f := strings.Split(hash, "$")
+	if len(f) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(f[2], "v=%d", &version); err != nil ||
+		version != argon2.Version {
+		return false
+	}
+	var mem, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(f[3], "m=%d,t=%d,p=%d", &mem, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(f[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(f[5])
+	if err != nil {
+		return false
+	}
+	var got []byte
+	switch f[1] {
+	case "argon2id":
+		got = argon2.IDKey([]byte(password), salt, time, mem, threads, uint32(len(want)))
+	case "argon2i":
+		got = argon2.Key([]byte(password), salt, time, mem, threads, uint32(len(want)))
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// dummyUser is checked against when an unknown username is given so
+// that the response time does not reveal which usernames exist.
+var dummyUser = &user{
+	hash: "$2a$10$SIvN7JNORLKL9teLXEYCI.R0E/0nbcHitENL9bvxsIrKmDltE0FNm",
+}
+
+// sameSite checks that r was not sent by a page of another site, as a
+// browser sends the credentials it has cached for the web remote with
+// any request, including a cross-site <img src=...>. If it was, it
+// writes an error response and returns false. Requests without
+// Sec-Fetch-Site or Origin headers (i.e. not from a browser, or from
+// an old one) are let through.
+func sameSite(w http.ResponseWriter, r *http.Request) bool {
+	cross := false
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		cross = site != "same-origin" && site != "none"
+	} else if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		cross = err != nil || u.Host != r.Host
+	}
+	if cross {
+		logWarn("cross-site request refused", "client", r.RemoteAddr,
+			"origin", r.Header.Get("Origin"))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorized checks the client against the access lists and lockouts
+// (see admitted), then checks the request's Basic credentials and
+// returns the authenticated user, provided they have at least role.
+// Otherwise it writes an error response and returns nil.
+func authorized(w http.ResponseWriter, r *http.Request, role int) *user {
+	if !admitted(w, r) {
+		return nil
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		u, known := users[name]
+		if !known {
+			dummyUser.checkPassword(password)
+		} else if u.checkPassword(password) {
+			clearAuthFailures(clientIP(r))
+			if u.role < role {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return nil
+			}
+			return u
+		}
+		logWarn("failed login", "user", name, "client", r.RemoteAddr)
+		recordAuthFailure(clientIP(r))
+		countAuthFailure()
+	}
+	w.Header().Add("WWW-Authenticate", "Basic realm=\"authenticate\"")
+	w.WriteHeader(401)
+	return nil
+}
@@ -45,6 +45,8 @@ type backendData struct {
 	matchStartupOK     string
 	matchCmdPrev       string
 	matchCmdNext       string
+	matchICYTitle      string
+	matchICYName       string
 
 	cmdFullscreen  string
 	cmdGetProp     string
@@ -69,6 +71,7 @@ type backendData struct {
 	propLength     string
 	propTimePos    string
 	propVolume     string
+	propMediaTitle string
 }
 
 // MPlayer backend
@@ -86,6 +89,8 @@ var backendMPlayer = backendData{
 	matchStartupOK:     "MPlayer",
 	matchCmdPrev:       "ANS_stream_start=",
 	matchCmdNext:       "ANS_stream_end=",
+	matchICYTitle:      "ICY Info: ",
+	matchICYName:       "Name   : ",
 
 	cmdFullscreen:  "pausing_keep_force vo_fullscreen",
 	cmdGetProp:     "pausing_keep_force get_property %s #%s",
@@ -110,6 +115,7 @@ var backendMPlayer = backendData{
 	propLength:     "length",
 	propTimePos:    "time_pos",
 	propVolume:     "volume",
+	propMediaTitle: "",
 }
 
 // MPV backend
@@ -127,6 +133,8 @@ var backendMPV = backendData{
 	matchStartupOK:     "[input",
 	matchCmdPrev:       "Backend: cmdPrev",
 	matchCmdNext:       "Backend: cmdNext",
+	matchICYTitle:      " icy-title: ",
+	matchICYName:       " icy-name: ",
 
 	cmdFullscreen:  "cycle fullscreen",
 	cmdGetProp:     mpvCmdGetProp,
@@ -151,6 +159,7 @@ var backendMPV = backendData{
 	propLength:     mpvPropLength,
 	propTimePos:    "time-pos",
 	propVolume:     "volume",
+	propMediaTitle: "media-title",
 }
 
 // MPV backend helpers
@@ -0,0 +1,414 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mplayer-rc ctl controls a running instance through the REST API,
+// finding it using the same config file.
+
+const ctlUsage = `Usage: mplayer-rc ctl [-host addr] [-user name] [-password pass] command [args]
+
+Commands:
+  status [--json]        show the player state
+  playlist [--json]      show the playlist
+  play [id|file/URL]     play the current track, track id, or file/URL
+  pause                  pause
+  toggle                 toggle between playing and paused
+  stop                   stop
+  next                   play the next track
+  prev                   play the previous track
+  seek [+|-]secs|pct%    seek to or by secs, or to pct% of the track
+  volume [+|-]pct[%]     set or change the volume (0 to 100)
+  shuffle|loop|repeat on|off
+  enqueue file/URL...    add files/URLs to the end of the playlist
+  remove id              remove a track from the playlist
+
+The address (host:port or Unix socket path) and password default to
+those in ~/.mplayer-rc. The password may also be given in the
+MPLAYER_RC_PASSWORD environment variable.
+`
+
+// ctlClient makes requests to a running mplayer-rc.
+type ctlClient struct {
+	base           string // e.g. "http://127.0.0.1:8080/api/v1"
+	client         *http.Client
+	user, password string
+}
+
+// ctlError is the error body of a failed request.
+type ctlError struct {
+	Error string `json:"error"`
+}
+
+// do makes a request with body (if non-nil) encoded as JSON, and
+// decodes the response into out (if non-nil).
+func (c *ctlClient) do(method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.user, c.password)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var e ctlError
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return errors.New(resp.Status)
+	}
+	if out != nil {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
+
+// newCtlClient creates a client for the instance at spec (a listen
+// address as accepted by -listen), or the first address in the
+// config file if spec is empty.
+func newCtlClient(spec, user, password string) (*ctlClient, error) {
+	if spec == "" && len(confListen) > 0 {
+		spec = confListen[0]
+	}
+	a := parseListen(spec, confPort)
+	transport := &http.Transport{}
+	scheme := "http"
+	host := a.addr
+	if a.isUnix() {
+		// Unix sockets are always plain HTTP
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", a.addr)
+		}
+		host = "mplayer-rc"
+	} else {
+		h, port, err := net.SplitHostPort(a.addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(h); h == "" || ip != nil && ip.IsUnspecified() {
+			h = "127.0.0.1"
+		}
+		if (confTLS || confTLSCert != "") && confTLSPort == "" {
+			scheme = "https"
+			certFile := confTLSCert
+			if certFile == "" {
+				certFile = filepath.Join(configDir(), "cert.pem")
+			}
+			config, err := ctlTLSConfig(certFile)
+			if err != nil {
+				return nil, err
+			}
+			transport.TLSClientConfig = config
+		}
+		host = net.JoinHostPort(h, port)
+	}
+	return &ctlClient{
+		base:     scheme + "://" + host + strings.TrimSuffix(apiPrefix, "/"),
+		client:   &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		user:     user,
+		password: password,
+	}, nil
+}
+
+// ctlTLSConfig trusts the system roots and the certificate in
+// certFile, which may be self-signed.
+func ctlTLSConfig(certFile string) (*tls.Config, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if b, err := ioutil.ReadFile(certFile); err == nil {
+		pool.AppendCertsFromPEM(b)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// runCtl runs mplayer-rc ctl with args, returning the exit status.
+func runCtl(args []string) int {
+	usage := func() int {
+		fmt.Fprint(os.Stderr, ctlUsage)
+		return 2
+	}
+	host, user := "", ""
+	password := os.Getenv("MPLAYER_RC_PASSWORD")
+	if password == "" {
+		password = confPassword
+	}
+	for len(args) > 1 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-host":
+			host = args[1]
+		case "-user":
+			user = args[1]
+		case "-password":
+			password = args[1]
+		default:
+			return usage()
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	if args[0] == "help" || args[0] == "-help" || args[0] == "--help" {
+		fmt.Print(ctlUsage)
+		return 0
+	}
+	c, err := newCtlClient(host, user, password)
+	if err == nil {
+		err = ctlCommand(c, args[0], args[1:])
+	}
+	if err == errCtlUsage {
+		return usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mplayer-rc ctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+var errCtlUsage = errors.New("usage")
+
+// ctlCommand runs command with args against c.
+func ctlCommand(c *ctlClient, command string, args []string) error {
+	arg := ""
+	if len(args) > 0 {
+		arg = args[0]
+	}
+	var p apiPlayer
+	switch command {
+	case "status", "playlist":
+		asJSON := arg == "--json" || arg == "-json"
+		if len(args) > 1 || arg != "" && !asJSON {
+			return errCtlUsage
+		}
+		var v interface{} = &p
+		var pl apiPlaylist
+		path := "/player"
+		if command == "playlist" {
+			v, path = &pl, "/playlist"
+		}
+		if err := c.do("GET", path, nil, v); err != nil {
+			return err
+		}
+		if asJSON {
+			b, _ := json.MarshalIndent(v, "", "  ")
+			fmt.Println(string(b))
+		} else if command == "status" {
+			printCtlStatus(&p)
+		} else {
+			for _, t := range pl.Tracks {
+				mark := " "
+				if t.Current {
+					mark = "*"
+				}
+				fmt.Printf("%s %4d  %s\n", mark, t.ID, t.URI)
+			}
+		}
+		return nil
+	case "play":
+		if len(args) > 1 {
+			return errCtlUsage
+		}
+		if arg == "" {
+			return c.do("POST", "/player/play", nil, nil)
+		}
+		if id, err := strconv.Atoi(arg); err == nil {
+			return c.do("POST", "/player/play", map[string]int{"id": id}, nil)
+		}
+		return c.do("POST", "/playlist", map[string]interface{}{
+			"uri": ctlURI(arg), "play": true}, nil)
+	case "pause", "stop":
+		if len(args) > 0 {
+			return errCtlUsage
+		}
+		state := map[string]string{"pause": "paused", "stop": "stopped"}[command]
+		return c.do("PATCH", "/player", map[string]string{"state": state}, nil)
+	case "toggle":
+		if len(args) > 0 {
+			return errCtlUsage
+		}
+		if err := c.do("GET", "/player", nil, &p); err != nil {
+			return err
+		}
+		state := "paused"
+		if p.State != "playing" {
+			state = "playing"
+		}
+		return c.do("PATCH", "/player", map[string]string{"state": state}, nil)
+	case "next", "prev", "previous":
+		if len(args) > 0 {
+			return errCtlUsage
+		}
+		if command == "prev" {
+			command = "previous"
+		}
+		return c.do("POST", "/player/"+command, nil, nil)
+	case "seek", "volume":
+		if len(args) != 1 {
+			return errCtlUsage
+		}
+		percent := strings.HasSuffix(arg, "%")
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(arg, "+"), "%"))
+		if err != nil {
+			return errCtlUsage
+		}
+		relative := strings.HasPrefix(arg, "+") || strings.HasPrefix(arg, "-")
+		if relative || command == "seek" && percent {
+			if err := c.do("GET", "/player", nil, &p); err != nil {
+				return err
+			}
+		}
+		field := "volume"
+		if command == "seek" {
+			field = "position"
+			if percent {
+				n = p.Duration * n / 100
+			}
+			if relative {
+				n += p.Position
+			}
+			if n < 0 {
+				n = 0
+			}
+		} else {
+			if relative {
+				n += p.Volume
+			}
+			if n < 0 {
+				n = 0
+			}
+			if n > 100 {
+				n = 100
+			}
+		}
+		return c.do("PATCH", "/player", map[string]int{field: n}, nil)
+	case "shuffle", "loop", "repeat":
+		if len(args) != 1 || arg != "on" && arg != "off" {
+			return errCtlUsage
+		}
+		return c.do("PATCH", "/player", map[string]bool{command: arg == "on"}, nil)
+	case "enqueue":
+		if len(args) == 0 {
+			return errCtlUsage
+		}
+		for _, a := range args {
+			if err := c.do("POST", "/playlist",
+				map[string]string{"uri": ctlURI(a)}, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "remove":
+		id, err := strconv.Atoi(arg)
+		if len(args) != 1 || err != nil {
+			return errCtlUsage
+		}
+		return c.do("DELETE", "/playlist/"+strconv.Itoa(id), nil, nil)
+	}
+	return errCtlUsage
+}
+
+// ctlURI makes a local path absolute, since the running instance may
+// have a different working directory. URLs are left as they are.
+func ctlURI(s string) string {
+	if isURI(s) {
+		return s
+	}
+	if abs, err := filepath.Abs(s); err == nil {
+		return abs
+	}
+	return s
+}
+
+func printCtlStatus(p *apiPlayer) {
+	minsec := func(t int) string {
+		return fmt.Sprintf("%d:%02d", t/60, t%60)
+	}
+	onoff := func(b bool) string {
+		if b {
+			return "on"
+		}
+		return "off"
+	}
+	fmt.Printf("state:    %s\n", p.State)
+	if p.Track != nil {
+		fmt.Printf("track:    %s (%d)\n", p.Track.URI, p.Track.ID)
+	}
+	if p.Station != "" {
+		fmt.Printf("station:  %s\n", p.Station)
+	}
+	if p.NowPlaying != "" {
+		fmt.Printf("playing:  %s\n", p.NowPlaying)
+	}
+	title := p.Title
+	if p.Artist != "" {
+		title = p.Artist + " - " + title
+	}
+	if title != "" {
+		fmt.Printf("title:    %s\n", title)
+	}
+	if p.State != "stopped" {
+		fmt.Printf("position: %s / %s\n", minsec(p.Position), minsec(p.Duration))
+	}
+	fmt.Printf("volume:   %d%%\n", p.Volume)
+	fmt.Printf("shuffle:  %s  loop: %s  repeat: %s\n",
+		onoff(p.Shuffle), onoff(p.Loop), onoff(p.Repeat))
+}
@@ -0,0 +1,51 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// specialPaths are file names containing characters that are
+// significant in URLs.
+var specialPaths = []string{
+	"/music/Track #1.mp3",
+	"/music/Why?.mp3",
+	"/music/100% Hits.mp3",
+	"/music/a%20b.mp3",
+}
+
+// TestCtlEnqueueSpecialPaths checks that a path given to ctl enqueue
+// or play reaches the playlist unchanged.
+func TestCtlEnqueueSpecialPaths(t *testing.T) {
+	for _, p := range specialPaths {
+		uri := ctlURI(p)
+		if uri != p {
+			t.Errorf("ctlURI(%q) = %q", p, uri)
+		}
+		id := funcSetPlaylist(ioutil.Discard, nil, uri, true)
+		if got := idTrackMap[id]; got != p {
+			t.Errorf("enqueued %q as %q", p, got)
+		}
+	}
+}
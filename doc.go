@@ -8,6 +8,7 @@
 // Usage:
 // 
 //   mplayer-rc [mplayer-rc or mplayer/mpv flags] [files/URLs]
+//   mplayer-rc ctl command [args] (controls a running instance)
 // 
 // Description
 // 
@@ -43,6 +44,14 @@
 // You can then control the player using Android-VLC-Remote on your
 // Android device.
 // 
+// To run MPlayer-RC as a long-lived service which waits for the remote
+// to add media, give the -idle flag and no files:
+// 
+//     mplayer-rc -idle
+// 
+// The playlist then starts empty and tracks can be added from the
+// remote's file browser, either played at once or queued.
+// 
 // Android-VLC-Remote will prompt you for a password which you need to
 // inform MPlayer-RC about beforehand. For this you can use the command
 // line flag -password or put the line
@@ -55,6 +64,18 @@
 // 
 // to change the default listening port from 8080.
 // 
+// By default MPlayer-RC listens on all interfaces. To listen only on
+// particular addresses use
+// 
+//     listen=...
+// 
+// which takes a comma separated list of IP addresses or host names
+// (optionally with a port, IPv6 addresses in brackets) and Unix socket
+// paths (e.g. /run/mplayer-rc.sock or unix:/run/mplayer-rc.sock). The
+// line may be repeated. The -listen flag works likewise. Connections over
+// a Unix socket, e.g. from a local reverse proxy, are not subject to the
+// client access lists described below.
+// 
 // By default, MPlayer-RC uses MPlayer/MPlayer2 as its backend player. To
 // use MPV instead you can specify -backend mpv on the command line,
 // rename the mplayer-rc binary to mpv-rc, or put
@@ -63,6 +84,58 @@
 // 
 // in ~/.mplayer-rc.
 // 
+// By default the VLC remote password is sent in clear text over plain
+// HTTP. To serve HTTPS instead, use the -tls flag or put
+// 
+//     tls=yes
+// 
+// in ~/.mplayer-rc. A self-signed certificate is then generated and kept
+// in ~/.mplayer-rc.d for use on subsequent runs. To use your own
+// certificate instead, put
+// 
+//     tls-cert=/path/to/cert.pem
+//     tls-key=/path/to/key.pem
+// 
+// in ~/.mplayer-rc (or use the -tls-cert and -tls-key flags). To serve
+// plain HTTP on the normal port and HTTPS on a separate port, use
+// 
+//     tls-port=...
+// 
+// HTTPS is then served on tls-port at each listen= address, replacing
+// any port the address gives.
+// 
+// Rather than keeping the password in plain text, it can be stored as a
+// bcrypt or argon2 hash using
+// 
+//     password-hash=...
+// 
+// where the hash can be created with mplayer-rc -hash-password, which
+// reads the password from standard input. Further named accounts, for
+// use by clients other than Android-VLC-Remote (which always sends an
+// empty username), can be added with lines of the form
+// 
+//     user=name:hash
+//     user=name:hash:read-only
+// 
+// A read-only user may fetch the status, playlist and cover art, but may
+// not issue commands or browse files.
+// 
+// After 5 consecutive failed logins a client is locked out for 30
+// seconds, doubling with each further failure up to an hour. All
+// clients connecting over Unix sockets count as a single client for
+// this. Clients can also be restricted by address with any number of
+// lines of the form
+// 
+//     allow=192.168.1.0/24
+//     deny=192.168.1.13
+// 
+// or by a VLC style hosts file (one address or network per line, each of
+// which is allowed):
+// 
+//     hosts-file=/path/to/.hosts
+// 
+// Rejected clients are logged.
+// 
 // Options
 // 
 // Available flags:
@@ -70,17 +143,38 @@
 //   -V    show version, license and further information
 //   -backend backend
 //         set backend as the backend player (default mplayer)
+//   -idle start with an empty playlist if no files/URLs are given
+//   -listen addrs
+//         listen on comma separated addrs (IPs or Unix socket paths)
+//   -log-file file
+//         append log messages to file instead of stderr
 //   -password pass
 //         use pass as the VLC remote password
+//   -hash-password
+//         print a hash of the password read from stdin and exit
 //   -port port
 //         use port as the listening port for VLC commands (default 8080)
 //   -remap-commands
 //         use alternate actions for some VLC commands
+//   -resume
+//         resume long tracks from where they were last stopped
+//   -resume-session
+//         restore the playlist and player state saved on last exit
+//   -tls  serve VLC commands over HTTPS (self-signed unless -tls-cert given)
+//   -tls-cert file
+//         use file as the HTTPS certificate (implies -tls)
+//   -tls-key file
+//         use file as the HTTPS private key
+//   -tls-port port
+//         serve HTTPS on port, and plain HTTP on -port
+//   -v    log debug messages (-vv also logs backend input/output)
 // 
 // Files
 // 
 // ~/.mplayer-rc - configuration file
 // 
+// ~/.mplayer-rc.d - directory of files created by MPlayer-RC
+// 
 // Playlists
 // 
 // Files and URLs are not passed through to the backend player as command
@@ -147,14 +241,343 @@
 // 
 //     • Playlist tab: Selecting tracks works as normal.
 // 
+//     • Metadata: For internet radio streams the stream title (ICY
+// StreamTitle) and station name are passed through as "now_playing",
+// "title", "artist" and "station", and are updated as songs change.
+// 
+//     • Cover art: Art embedded in MP3 (ID3v2) and FLAC tags, or a
+// cover.jpg, folder.jpg or front.png (etc) file alongside the track, is
+// served from /art.
+// 
 // The following features of Android-VLC-Remote do not work:
 // 
 //     • Library tab.
 // 
 //     • DVD tab.
 // 
-//     • Metadata: The metadata passed through to the information box is
-// just the filename (as "title").
+//     • Metadata: For local files the metadata passed through to the
+// information box is just the filename (as "title").
+// 
+// Exit status
+// 
+// MPlayer-RC shuts down when told to quit by the remote, when the
+// backend exits, or on SIGINT/SIGTERM. It stops accepting requests, lets
+// those in progress finish, asks the backend to quit (killing it if it
+// has not done so after 5 seconds) and then exits with status 0 if quit
+// by the remote or by the backend's user, 1 if the backend failed, or
+// 128 plus the signal number if killed by a signal.
+// 
+// If the backend crashes (exits with a failure status or is killed by a
+// signal) it is restarted with the same flags, and the current track
+// resumed with its position, pause state and volume restored. If the
+// backend crashes more than 3 times within a minute MPlayer-RC gives up
+// and exits.
+// 
+// Resuming playback
+// 
+// If the -resume flag is given or resume=yes is set in ~/.mplayer-rc,
+// MPlayer-RC remembers where each long track was stopped and resumes
+// from there the next time the track is played. Positions are kept in
+// ~/.mplayer-rc.d/resume.json and forgotten once a track has played to
+// the end. The following lines control which tracks are resumed:
+// 
+//     resume-min-length=600
+//     resume-exclude=mp3,flac
+//     resume-key=hash
+// 
+// resume-min-length is the minimum track length in seconds (default
+// 600), resume-exclude lists file extensions which are never resumed,
+// and resume-key=hash identifies tracks by a hash of their content
+// rather than by path so that positions survive files being moved.
+// 
+// Saving the session
+// 
+// If session=yes is set in ~/.mplayer-rc, MPlayer-RC saves the playlist,
+// shuffle order, current track and position, loop/repeat state and
+// volume to ~/.mplayer-rc.d/session.json whenever they change and on
+// exit. Running
+// 
+//     mplayer-rc -resume-session
+// 
+// restores the saved session and carries on where it left off, so no
+// files need be given on the command line. Any files which are given
+// are added to the end of the restored playlist. -resume-session also
+// implies session=yes.
+// 
+// Running under systemd
+// 
+// On Linux, MPlayer-RC can be run as a systemd service of Type=notify.
+// It tells systemd it is ready once the backend has started and the
+// web server is listening, and if WatchdogSec= is set it pings the
+// watchdog from the loop which drives the backend, so that a hung
+// backend causes the service to be restarted. For example:
+// 
+//     [Service]
+//     Type=notify
+//     ExecStart=/usr/local/bin/mplayer-rc -idle -resume-session
+//     WatchdogSec=30
+//     Restart=on-failure
+// 
+// MPlayer-RC also accepts sockets passed by socket activation, which
+// are then used instead of the listen addresses. If -tls-port is given,
+// sockets with FileDescriptorName=https serve HTTPS and the others plain
+// HTTP. When logging to the journal, timestamps are left out of log
+// lines since the journal adds its own.
+// 
+// Logging
+// 
+// MPlayer-RC logs errors, warnings and informational messages to
+// stderr, one per line with any details as key=value pairs. The amount
+// logged is set by
+// 
+//     log-level=info
+// 
+// in ~/.mplayer-rc, where the level is one of error, warn, info, debug
+// or trace. The -v flag selects debug and -vv selects trace, which also
+// logs every line sent to and received from the backend. Note that -v
+// is therefore not passed on to the backend. HTTP requests are logged
+// at debug level, or at info level if
+// 
+//     access-log=yes
+// 
+// is set. To log to a file instead of stderr use -log-file or
+// 
+//     log-file=/path/to/mplayer-rc.log
+// 
+// Metrics
+// 
+// If metrics=yes is set in ~/.mplayer-rc, MPlayer-RC serves metrics in
+// the Prometheus text format at /metrics, using the same passwords as
+// the VLC remote (read-only users may read them). The metrics include
+// HTTP requests by VLC command, failed logins, the round trip time of
+// requests to the backend, tracks played, skipped and failed, backend
+// restarts, the playlist length, the playback state and the volume.
+// 
+// Health checks
+// 
+// For supervisors and load balancers, MPlayer-RC answers /healthz,
+// which succeeds as long as it is running, and /readyz, which succeeds
+// only if the backend answers a property query within 2 seconds and
+// fails with status 503 otherwise. Neither needs a password, though
+// the client access lists apply. Both return a JSON body giving the
+// status, the backend and its version (from its -version output), the
+// MPlayer-RC version and the uptime in seconds.
+// 
+// Push notifications
+// 
+// Rather than polling the status every second, clients may connect to
+// /events, which streams the player state as Server-Sent Events. It
+// uses the same passwords as the VLC remote (read-only users may
+// connect). A "status" event is sent on connection, followed by one of
+// the events track, state, volume, seek, metadata, options and playlist
+// whenever the corresponding part of the state changes. The data of
+// each event is a JSON object holding the whole state, for example:
+// 
+//     event: volume
+//     data: {"state":"playing","currentplid":4,"volume":200,...}
+// 
+// MPlayer-RC only queries the backend for events while a client is
+// connected, once a second and after each command.
+// 
+// Web remote
+// 
+// MPlayer-RC has a built-in web remote for use from any browser,
+// including on phones. Point the browser at the address MPlayer-RC is
+// listening on (e.g. http://mediabox:8080/) and log in with the VLC
+// remote password (leaving the username empty) or a user= account. It
+// has playback controls, seek and volume sliders, the playlist (click a
+// track to play it, drag it to reorder) and a file browser for adding
+// tracks. It uses the JSON versions of the VLC endpoints, which are
+// always served, and /events. As the browser then remembers the
+// password, VLC commands sent by pages of other sites (which browsers
+// mark with Sec-Fetch-Site or Origin headers) are refused.
+// 
+// Besides the standard VLC commands, the playlist order can be changed
+// with
+// 
+//     /requests/status.json?command=pl_move&psid=<id>&id=<id>
+// 
+// which moves track psid to the position of track id.
+// 
+// REST API
+// 
+// Alongside the VLC protocol MPlayer-RC serves a JSON REST API under
+// /api/v1, using the same passwords (read-only users may only GET):
+// 
+//     GET    /api/v1/player           the player state
+//     PATCH  /api/v1/player           change state, position, volume,
+//                                     loop, repeat or shuffle
+//     POST   /api/v1/player/play      play, optionally {"id": id}
+//     POST   /api/v1/player/next
+//     POST   /api/v1/player/previous
+//     GET    /api/v1/playlist         the playlist in playing order
+//     POST   /api/v1/playlist         add {"uri": uri, "play": bool}
+//     GET    /api/v1/playlist/{id}    a track
+//     PATCH  /api/v1/playlist/{id}    move it with {"position": n}
+//     DELETE /api/v1/playlist/{id}    remove it
+// 
+// For example:
+// 
+//     curl -u :pass -X PATCH -d '{"volume": 50}' http://mediabox:8080/api/v1/player
+// 
+// Volumes are percentages and positions are in seconds. Errors are
+// returned with an appropriate status code and a body of the form
+// {"error": "..."}. Request bodies must have a Content-Type of
+// application/json, or the request fails with status 415, and POSTs
+// without a body are refused if sent by pages of other sites. The full
+// OpenAPI description is served at /api/v1/openapi.json.
+// 
+// Command-line control
+// 
+// "mplayer-rc ctl" controls a running instance from the command line,
+// using the REST API:
+// 
+//     mplayer-rc ctl pause
+//     mplayer-rc ctl seek +30
+//     mplayer-rc ctl volume 50%
+//     mplayer-rc ctl enqueue ~/music/song.mp3
+//     mplayer-rc ctl status --json
+// 
+// Run "mplayer-rc ctl help" for the full list of commands. The address
+// and password are read from the config file (the first listen
+// address, or port on the local machine, and password), and may be
+// overridden with -host, -user and -password before the command, or
+// with the MPLAYER_RC_PASSWORD environment variable. If TLS is enabled
+// the certificate in cert.pem (or tls-cert) is trusted. The exit status
+// is 0 on success, 1 if the command failed and 2 on a usage error.
+// 
+// Kodi remotes
+// 
+// With kodi=yes in the config file MPlayer-RC also serves Kodi's
+// JSON-RPC API at /jsonrpc (over HTTP POST or GET), so that Kodi
+// remotes such as Kore and Yatse can control it. Add it in the remote
+// as a Kodi media center using MPlayer-RC's address and port, with an
+// empty username and the VLC remote password, or a user= account. The
+// supported methods are JSONRPC.Ping and Version,
+// Application.GetProperties and SetVolume, Player.GetActivePlayers,
+// GetProperties, GetItem, PlayPause, Stop, GoTo, Seek, SetShuffle,
+// SetRepeat and Open, and Playlist.GetPlaylists, GetProperties,
+// GetItems, Add, Insert, Remove, Swap and Clear. There is a single
+// audio player and playlist, both with id 0, and playlist positions
+// are in playing order. Kodi's library, notifications (port 9090) and
+// video features are not supported. So that pages of other sites
+// cannot use a password saved in a browser, only the methods that do
+// not change anything may be called over GET, and POSTs must have
+// Content-Type application/json.
+// 
+// MPD clients
+// 
+// With mpd= in the config file MPlayer-RC also listens for clients
+// speaking the Music Player Daemon protocol, such as mpc, ncmpcpp and
+// MPDroid. mpd=yes listens on port 6600 on all interfaces; otherwise
+// give a port, an address as for listen= (e.g. mpd=localhost:6600) or
+// a Unix socket path. The allow/deny lists apply (except over a Unix
+// socket), and clients must send the VLC remote password, or a user=
+// account's password, with MPD's password command before anything
+// else.
+// 
+//     mpc -h pass@mediabox status
+// 
+// Supported are the status, currentsong, playlistinfo, playlistid,
+// plchanges, play, playid, pause, stop, next, previous, seek, seekid,
+// seekcur, setvol, volume, getvol, add, addid, delete, deleteid,
+// clear, move, moveid, random, repeat, single and idle commands, along
+// with command lists. There is no music database, so add takes file
+// paths (absolute, or relative to MPlayer-RC's working directory) and
+// URLs. Playlist positions are in playing order, and MPD's single mode
+// is MPlayer-RC's repeat of the current track.
+// 
+// Desktop integration (MPRIS)
+// 
+// On Linux, mpris=yes in the config file publishes MPlayer-RC on the
+// D-Bus session bus as org.mpris.MediaPlayer2.mplayerrc (with an
+// .instance<pid> suffix if another instance has the name), so that
+// desktop media keys, GNOME and KDE media widgets and playerctl can
+// control it. The MediaPlayer2, Player and TrackList interfaces are
+// implemented using the same playlist as the remote, with tracks in
+// playing order. For example:
+// 
+//     playerctl -p mplayerrc play-pause
+//     playerctl -p mplayerrc metadata
+// 
+// If there is no session bus (e.g. when run as a system service) an
+// error is logged and MPlayer-RC carries on without it.
+// 
+// UPnP/DLNA renderer
+// 
+// With upnp= in the config file MPlayer-RC is also a UPnP
+// MediaRenderer, so that DLNA control points such as BubbleUPnP and
+// phones' cast menus can find it and push media to it. upnp=yes
+// listens on port 49494 on all interfaces; otherwise give a port or an
+// address as for listen=. The renderer is announced with SSDP on every
+// multicast interface under the name given by upnp-name= (by default
+// "MPlayer-RC on <host name>"). Only searches multicast from a network
+// of the interface are answered, so that the renderer cannot be used
+// to reflect traffic at other hosts.
+// 
+//     upnp=yes
+//     upnp-name=Living room
+// 
+// The AVTransport, RenderingControl and ConnectionManager services are
+// implemented. A URI set with SetAVTransportURI is added to the end of
+// the playlist and played by the next Play (at once if something is
+// already playing). It replaces the URI set before it, which is removed
+// from the playlist unless it is still playing, so casting does not
+// grow the playlist. Volumes are 0-100 as elsewhere. Control points
+// cannot log in, so only the allow/deny lists protect the renderer:
+// any client they admit can control playback.
+// 
+// Zeroconf (mDNS)
+// 
+// With mdns=yes in the config file MPlayer-RC advertises itself on the
+// LAN over multicast DNS, so that remotes can find it without being
+// told its address. The web server is advertised as _http._tcp (and
+// _https._tcp when serving HTTPS), with TXT records including vlc=1
+// and api=/requests/status.xml to mark it as a VLC compatible
+// endpoint, and the MPD server, if enabled, as _mpd._tcp. Listeners on
+// loopback addresses or Unix sockets are not advertised. The service
+// name is set with mdns-name= (by default "MPlayer-RC on <host
+// name>"), and should differ between instances on the same LAN as
+// names are not checked for conflicts.
+// 
+//     mdns=yes
+//     mdns-name=Kitchen
+// 
+//     avahi-browse -r _http._tcp
+// 
+// Keyboards and IR remotes
+// 
+// MPlayer-RC can also be controlled by buttons: input= in the config
+// file names Linux evdev devices to read (a comma separated list, or
+// several input= lines), and lirc=yes reads button presses from the
+// LIRC daemon at /var/run/lirc/lircd (or give the socket path). Devices
+// that go away, such as unplugged USB receivers, are reopened when they
+// come back. Reading evdev devices usually requires membership of the
+// input group.
+// 
+// Buttons are mapped to actions by a [keys] section at the end of the
+// config file, after all other settings. evdev keys are named as in
+// linux/input-event-codes.h (or by number), and LIRC buttons by the
+// names in lircd.conf. The actions are play, pause (a toggle), stop,
+// next, prev, shuffle, loop, repeat, fullscreen, "volume val" and
+// "seek val", where val is as sent by the VLC remote: [+|-]N[%] for
+// volumes and [+|-]N or N% for seeks. Relative volume and seek actions
+// repeat while the button is held.
+// 
+//     input=/dev/input/by-id/usb-flirc.tv_flirc-if01-event-kbd
+//     lirc=yes
+// 
+//     [keys]
+//     KEY_PLAYPAUSE=pause
+//     KEY_OK=pause
+//     KEY_LEFT=seek -10
+//     KEY_RIGHT=seek +10
+//     KEY_UP=volume +5%
+//     KEY_DOWN=volume -5%
+// 
+// Without a [keys] section the media keys (KEY_PLAYPAUSE, KEY_STOP,
+// KEY_NEXTSONG, KEY_VOLUMEUP, KEY_FASTFORWARD and so on) do what their
+// names say.
 // 
 // See also
 // 
@@ -0,0 +1,246 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// playerState is the state pushed to /events subscribers.
+type playerState struct {
+	State           string `json:"state"`
+	CurrentID       int    `json:"currentplid"`
+	Filename        string `json:"filename"`
+	Title           string `json:"title"`
+	Artist          string `json:"artist"`
+	NowPlaying      string `json:"now_playing"`
+	Station         string `json:"station"`
+	ArtworkURL      string `json:"artwork_url"`
+	Time            int    `json:"time"`
+	Length          int    `json:"length"`
+	Volume          int    `json:"volume"`
+	Loop            bool   `json:"loop"`
+	Repeat          bool   `json:"repeat"`
+	Random          bool   `json:"random"`
+	PlaylistLength  int    `json:"playlist_length"`
+	PlaylistVersion int    `json:"playlist_version"`
+}
+
+// playlistVersion is incremented whenever the playlist or its order
+// changes.
+var playlistVersion int
+
+// the event state. Like the playlist state it is only accessed from
+// the select loop.
+var (
+	subscribers = map[chan []byte]bool{}
+	lastState   *playerState
+	lastStateAt time.Time
+)
+
+type cmdSubscribe struct {
+	ch chan []byte
+}
+type cmdUnsubscribe struct {
+	ch chan []byte
+}
+
+// subscriberBuffer is how many events may be queued for a subscriber
+// before it is considered too slow and disconnected.
+const subscriberBuffer = 32
+
+// sseKeepAlive is how often a comment is sent to idle subscribers so
+// that proxies do not time out the connection.
+const sseKeepAlive = 15 * time.Second
+
+// currentState queries the backend for the player state.
+func currentState(in io.Writer, outChan <-chan string) *playerState {
+	s := &playerState{
+		State:           getProp(in, outChan, "state"),
+		CurrentID:       -1,
+		NowPlaying:      nowPlaying,
+		Station:         stationName,
+		ArtworkURL:      artworkURL(),
+		Time:            getInt(getProp(in, outChan, backend.propTimePos)),
+		Length:          getInt(getProp(in, outChan, backend.propLength)),
+		Volume:          getInt(getProp(in, outChan, backend.propVolume)),
+		Loop:            loop,
+		Repeat:          repeat,
+		Random:          shuffle,
+		PlaylistLength:  len(playlist),
+		PlaylistVersion: playlistVersion,
+	}
+	if len(playlist) > 0 {
+		s.CurrentID = playlist[playpos]
+	}
+	if filename := getProp(in, outChan, backend.propFilename); filename != "(unavailable)" {
+		s.Filename = filename
+		s.Title, s.Artist = getMeta(in, outChan, filename)
+	}
+	return s
+}
+
+// stateEvents returns the names of the events describing the change
+// from old to cur, given that elapsed time has passed between them.
+func stateEvents(old, cur *playerState, elapsed time.Duration) []string {
+	var events []string
+	if cur.CurrentID != old.CurrentID || cur.Filename != old.Filename {
+		events = append(events, "track")
+	} else if cur.State != "stopped" {
+		// a seek is a jump in position other than by playing
+		expected := old.Time
+		if old.State == "playing" {
+			expected += int(elapsed / time.Second)
+		}
+		if d := cur.Time - expected; d > 2 || d < -2 {
+			events = append(events, "seek")
+		}
+	}
+	if cur.State != old.State {
+		events = append(events, "state")
+	}
+	if cur.Volume != old.Volume {
+		events = append(events, "volume")
+	}
+	if cur.NowPlaying != old.NowPlaying || cur.Station != old.Station ||
+		cur.Title != old.Title || cur.Artist != old.Artist ||
+		cur.ArtworkURL != old.ArtworkURL {
+		events = append(events, "metadata")
+	}
+	if cur.Loop != old.Loop || cur.Repeat != old.Repeat ||
+		cur.Random != old.Random {
+		events = append(events, "options")
+	}
+	if cur.PlaylistVersion != old.PlaylistVersion {
+		events = append(events, "playlist")
+	}
+	return events
+}
+
+// sseEvent formats an event with the player state as its data.
+func sseEvent(name string, s *playerState) []byte {
+	b, _ := json.Marshal(s)
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "event: %s\ndata: %s\n\n", name, b)
+	return buf.Bytes()
+}
+
+// sendEvent queues an event for subscriber ch, disconnecting it if it
+// has fallen too far behind.
+func sendEvent(ch chan []byte, event []byte) {
+	select {
+	case ch <- event:
+	default:
+		logInfo("disconnecting slow event subscriber")
+		delete(subscribers, ch)
+		close(ch)
+	}
+}
+
+// publishEvents queries the player state, if anyone is subscribed,
+// and sends subscribers an event for each change since the last call.
+// It is called by the select loop after each command and periodically.
+func publishEvents(in io.Writer, outChan <-chan string) {
+	if len(subscribers) == 0 {
+		lastState = nil
+		return
+	}
+	cur := currentState(in, outChan)
+	now := time.Now()
+	if lastState != nil {
+		for _, name := range stateEvents(lastState, cur, now.Sub(lastStateAt)) {
+			event := sseEvent(name, cur)
+			for ch := range subscribers {
+				sendEvent(ch, event)
+			}
+		}
+	}
+	lastState, lastStateAt = cur, now
+}
+
+// funcSubscribe adds subscriber ch, sending it the current state as a
+// "status" event.
+func funcSubscribe(in io.Writer, outChan <-chan string, ch chan []byte) {
+	subscribers[ch] = true
+	cur := currentState(in, outChan)
+	sendEvent(ch, sseEvent("status", cur))
+	if lastState == nil {
+		lastState, lastStateAt = cur, time.Now()
+	}
+}
+
+func funcUnsubscribe(ch chan []byte) {
+	if subscribers[ch] {
+		delete(subscribers, ch)
+		close(ch)
+	}
+}
+
+// serveEvents streams player state changes to the client as
+// Server-Sent Events until it disconnects or mplayer-rc shuts down.
+func serveEvents(commandChan chan<- interface{}, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // for nginx
+	ch := make(chan []byte, subscriberBuffer)
+	commandChan <- cmdSubscribe{ch: ch}
+	defer func() {
+		commandChan <- cmdUnsubscribe{ch: ch}
+		// drain until the select loop closes ch, so that it never
+		// blocks on a departed subscriber
+		for range ch {
+		}
+	}()
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return // too slow
+			}
+			if _, err := w.Write(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-shutdownStarted:
+			return
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// readyTimeout is how long /readyz waits for the backend to answer.
+const readyTimeout = 2 * time.Second
+
+// startTime is when mplayer-rc started.
+var startTime = time.Now()
+
+// backendVersion is the backend's name and version, set by main.
+var backendVersion = "unknown"
+
+// probeBackendVersion runs the backend with -version and returns the
+// start of the first line it prints, e.g. "mpv 0.35.1" or "MPlayer
+// 1.4 (Debian)", or "unknown".
+func probeBackendVersion() string {
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+	out, _ := exec.CommandContext(ctx, backend.binary, "-version").CombinedOutput()
+	scanner := bufio.NewScanner(bytes.NewBuffer(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if i := strings.Index(line, " Copyright"); i > 0 {
+			line = line[:i]
+		}
+		if i := strings.Index(line, ","); i > 0 {
+			line = line[:i]
+		}
+		return line
+	}
+	return "unknown"
+}
+
+type cmdPing struct {
+	replyChan chan<- bool
+}
+
+// funcPing queries a property of the backend, which blocks until the
+// backend answers, and reports whether the backend is still running.
+func funcPing(proc *backendProcess, in io.Writer, outChan <-chan string) bool {
+	getProp(in, outChan, "pause")
+	return proc.running()
+}
+
+// healthData is the JSON body of /healthz and /readyz.
+type healthData struct {
+	Status         string `json:"status"`
+	Backend        string `json:"backend"`
+	BackendVersion string `json:"backend_version"`
+	Version        string `json:"version"` // of mplayer-rc
+	Uptime         int    `json:"uptime"`  // seconds
+}
+
+func writeHealth(w http.ResponseWriter, code int, status string) {
+	v := version
+	if v == "" {
+		v = "unknown"
+	}
+	b, _ := json.Marshal(healthData{
+		Status:         status,
+		Backend:        backend.binary,
+		BackendVersion: backendVersion,
+		Version:        v,
+		Uptime:         int(time.Since(startTime) / time.Second),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// startHealthHandlers registers /healthz, which reports that
+// mplayer-rc is running, and /readyz, which reports whether the
+// backend answers a property query within readyTimeout. Neither needs
+// a password, though the client access lists apply.
+func startHealthHandlers(commandChan chan<- interface{}) {
+	http.HandleFunc(
+		"/healthz",
+		func(w http.ResponseWriter, r *http.Request) {
+			if !admitted(w, r) {
+				return
+			}
+			writeHealth(w, http.StatusOK, "ok")
+		})
+	http.HandleFunc(
+		"/readyz",
+		func(w http.ResponseWriter, r *http.Request) {
+			if !admitted(w, r) {
+				return
+			}
+			if isShuttingDown() {
+				writeHealth(w, http.StatusServiceUnavailable, "shutting down")
+				return
+			}
+			// buffered so that a late reply does not block the
+			// select loop
+			replyChan := make(chan bool, 1)
+			commandChan <- cmdPing{replyChan: replyChan}
+			select {
+			case ok := <-replyChan:
+				if ok {
+					writeHealth(w, http.StatusOK, "ok")
+				} else {
+					writeHealth(w, http.StatusServiceUnavailable,
+						"backend not running")
+				}
+			case <-time.After(readyTimeout):
+				writeHealth(w, http.StatusServiceUnavailable,
+					"backend not responding")
+			}
+		})
+}
@@ -0,0 +1,403 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The input subsystem, for controlling mplayer-rc without a remote:
+// keyboards, IR receivers and the like read through Linux evdev
+// devices or a LIRC daemon. Buttons are mapped to the same commands
+// the VLC remote sends by the [keys] section of the config file.
+
+// the input settings, set by main
+var (
+	inputDevices []string                // evdev device paths
+	lircSocket   string                  // empty if LIRC is not used
+	inputKeys    map[string]inputBinding // upper-cased button name -> binding
+)
+
+const (
+	lircDefaultSocket = "/var/run/lirc/lircd"
+	// an input device or LIRC socket that goes away (e.g. a USB
+	// receiver unplugged) is retried this often
+	inputRetryInterval = 5 * time.Second
+)
+
+// inputBinding is what a button does.
+type inputBinding struct {
+	cmd    interface{} // sent to the select loop
+	repeat bool        // also sent while the button is held down
+}
+
+// defaultKeys is the key mapping used when the config file has no
+// [keys] section.
+var defaultKeys = []string{
+	"KEY_PLAYPAUSE=pause",
+	"KEY_PLAY=pause",
+	"KEY_PAUSE=pause",
+	"KEY_STOP=stop",
+	"KEY_STOPCD=stop",
+	"KEY_NEXTSONG=next",
+	"KEY_PREVIOUSSONG=prev",
+	"KEY_NEXT=next",
+	"KEY_PREVIOUS=prev",
+	"KEY_VOLUMEUP=volume +5%",
+	"KEY_VOLUMEDOWN=volume -5%",
+	"KEY_FASTFORWARD=seek +10",
+	"KEY_REWIND=seek -10",
+}
+
+// parseKeyMap parses key mappings of the form button=action, where
+// action is one of play, pause, stop, next, prev, shuffle, loop,
+// repeat, fullscreen, "volume val" or "seek val". The volume and seek
+// values are as the VLC remote sends them: [+|-]N[%] volumes (N out of
+// 320, or a percentage), and [+|-]N seconds or N% seeks.
+func parseKeyMap(lines []string) (map[string]inputBinding, error) {
+	keys := map[string]inputBinding{}
+	for _, line := range lines {
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("bad key mapping %q", line)
+		}
+		name := strings.ToUpper(strings.TrimSpace(line[:i]))
+		f := strings.Fields(line[i+1:])
+		if len(f) == 0 {
+			return nil, fmt.Errorf("bad key mapping %q", line)
+		}
+		var b inputBinding
+		switch strings.ToLower(f[0]) {
+		case "play":
+			b.cmd = cmdPlay{id: -1}
+		case "pause":
+			b.cmd = cmdPause{}
+		case "stop":
+			b.cmd = cmdStop{}
+		case "next":
+			b.cmd = cmdNext{}
+		case "prev", "previous":
+			b.cmd = cmdPrev{}
+		case "shuffle":
+			b.cmd = cmdShuffle{}
+		case "loop":
+			b.cmd = cmdLoop{}
+		case "repeat":
+			b.cmd = cmdRepeat{}
+		case "fullscreen":
+			b.cmd = cmdFullscreen{}
+		case "volume":
+			if len(f) != 2 {
+				return nil, fmt.Errorf("bad key mapping %q", line)
+			}
+			cmd, ok := parseInputVolume(f[1])
+			if !ok {
+				return nil, fmt.Errorf("bad volume in key mapping %q", line)
+			}
+			b = inputBinding{cmd: cmd, repeat: cmd.mode == volRel}
+		case "seek":
+			if len(f) != 2 {
+				return nil, fmt.Errorf("bad key mapping %q", line)
+			}
+			cmd, ok := parseInputSeek(f[1])
+			if !ok {
+				return nil, fmt.Errorf("bad seek in key mapping %q", line)
+			}
+			b = inputBinding{cmd: cmd, repeat: cmd.mode == seekRel}
+		default:
+			return nil, fmt.Errorf("unknown action in key mapping %q", line)
+		}
+		if _, ok := evdevCodes[name]; !ok && lircSocket == "" {
+			if _, err := strconv.Atoi(name); err != nil {
+				logWarn("key mapping names an unknown key", "key", name)
+			}
+		}
+		keys[name] = b
+	}
+	return keys, nil
+}
+
+func parseInputVolume(val string) (cmdVolume, bool) {
+	cmd := cmdVolume{mode: volAbs}
+	percent := strings.HasSuffix(val, "%")
+	val = strings.TrimSuffix(val, "%")
+	if strings.HasPrefix(val, "+") || strings.HasPrefix(val, "-") {
+		cmd.mode = volRel
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return cmd, false
+	}
+	if percent {
+		i = i * 320 / 100
+	}
+	cmd.val = i
+	return cmd, true
+}
+
+func parseInputSeek(val string) (cmdSeek, bool) {
+	cmd := cmdSeek{mode: seekAbs}
+	switch {
+	case strings.HasSuffix(val, "%"):
+		val = strings.TrimSuffix(val, "%")
+		cmd.mode = seekPct
+	case strings.HasPrefix(val, "+") || strings.HasPrefix(val, "-"):
+		cmd.mode = seekRel
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil || (cmd.mode == seekPct && (i < 0 || i > 100)) {
+		return cmd, false
+	}
+	cmd.val = i
+	return cmd, true
+}
+
+// startInput starts reading the configured input devices.
+func startInput(commandChan chan<- interface{}) {
+	for _, dev := range inputDevices {
+		serverTasks.Add(1)
+		go readEvdev(commandChan, dev)
+	}
+	if lircSocket != "" {
+		serverTasks.Add(1)
+		go readLIRC(commandChan, lircSocket)
+	}
+}
+
+// inputWait waits inputRetryInterval, returning false if shutdown
+// starts first.
+func inputWait() bool {
+	select {
+	case <-time.After(inputRetryInterval):
+		return true
+	case <-shutdownStarted:
+		return false
+	}
+}
+
+// closeOnShutdown closes c when shutdown starts, so that a read
+// blocked on it returns, unless the returned function is called
+// first.
+func closeOnShutdown(c io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-shutdownStarted:
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// inputPressed sends the command bound to button name, if any. held
+// is set for repeats while the button is held down.
+func inputPressed(commandChan chan<- interface{}, name string, held bool) {
+	b, ok := inputKeys[strings.ToUpper(name)]
+	if !ok {
+		logDebug("unmapped button", "key", name)
+		return
+	}
+	if (held && !b.repeat) || isShuttingDown() {
+		return
+	}
+	logDebug("button pressed", "key", name)
+	commandChan <- b.cmd
+}
+
+// evdev
+
+// evdevEventSize is the size of a struct input_event, which starts
+// with a struct timeval of two longs.
+const evdevEventSize = 2*strconv.IntSize/8 + 8
+
+const evKey = 1 // EV_KEY
+
+// readEvdev reads key presses from evdev device dev, reopening it if
+// it goes away, until shutdown.
+func readEvdev(commandChan chan<- interface{}, dev string) {
+	defer serverTasks.Done()
+	warned := false
+	for !isShuttingDown() {
+		f, err := os.Open(dev)
+		if err != nil {
+			if !warned {
+				logWarn("cannot open input device", "device", dev, "err", err)
+				warned = true
+			}
+			if !inputWait() {
+				return
+			}
+			continue
+		}
+		logInfo("reading input device", "device", dev)
+		warned = false
+		stop := closeOnShutdown(f)
+		buf := make([]byte, evdevEventSize)
+		for {
+			if _, err = io.ReadFull(f, buf); err != nil {
+				break
+			}
+			ev := buf[evdevEventSize-8:]
+			typ := binary.LittleEndian.Uint16(ev)
+			code := binary.LittleEndian.Uint16(ev[2:])
+			value := int32(binary.LittleEndian.Uint32(ev[4:]))
+			// value is 1 for a press, 2 for an autorepeat and 0 for
+			// a release
+			if typ != evKey || value == 0 {
+				continue
+			}
+			inputPressed(commandChan, evdevKeyName(code), value == 2)
+		}
+		stop()
+		f.Close()
+		if isShuttingDown() {
+			return
+		}
+		logWarn("input device closed", "device", dev, "err", err)
+		if !inputWait() {
+			return
+		}
+	}
+}
+
+// evdevKeyName returns the name of key code, or its number if it has
+// no name.
+func evdevKeyName(code uint16) string {
+	if name, ok := evdevNames[code]; ok {
+		return name
+	}
+	return strconv.Itoa(int(code))
+}
+
+// evdevCodes holds the key codes of linux/input-event-codes.h that
+// are likely to be found on keyboards and remote controls.
+var evdevCodes = map[string]uint16{
+	"KEY_ESC": 1, "KEY_1": 2, "KEY_2": 3, "KEY_3": 4, "KEY_4": 5,
+	"KEY_5": 6, "KEY_6": 7, "KEY_7": 8, "KEY_8": 9, "KEY_9": 10,
+	"KEY_0": 11, "KEY_MINUS": 12, "KEY_EQUAL": 13, "KEY_BACKSPACE": 14,
+	"KEY_TAB": 15, "KEY_Q": 16, "KEY_W": 17, "KEY_E": 18, "KEY_R": 19,
+	"KEY_T": 20, "KEY_Y": 21, "KEY_U": 22, "KEY_I": 23, "KEY_O": 24,
+	"KEY_P": 25, "KEY_LEFTBRACE": 26, "KEY_RIGHTBRACE": 27,
+	"KEY_ENTER": 28, "KEY_A": 30, "KEY_S": 31, "KEY_D": 32, "KEY_F": 33,
+	"KEY_G": 34, "KEY_H": 35, "KEY_J": 36, "KEY_K": 37, "KEY_L": 38,
+	"KEY_SEMICOLON": 39, "KEY_APOSTROPHE": 40, "KEY_GRAVE": 41,
+	"KEY_BACKSLASH": 43, "KEY_Z": 44, "KEY_X": 45, "KEY_C": 46,
+	"KEY_V": 47, "KEY_B": 48, "KEY_N": 49, "KEY_M": 50, "KEY_COMMA": 51,
+	"KEY_DOT": 52, "KEY_SLASH": 53, "KEY_SPACE": 57, "KEY_F1": 59,
+	"KEY_F2": 60, "KEY_F3": 61, "KEY_F4": 62, "KEY_F5": 63, "KEY_F6": 64,
+	"KEY_F7": 65, "KEY_F8": 66, "KEY_F9": 67, "KEY_F10": 68,
+	"KEY_KPMINUS": 74, "KEY_KPPLUS": 78, "KEY_F11": 87, "KEY_F12": 88,
+	"KEY_KPENTER": 96, "KEY_HOME": 102, "KEY_UP": 103, "KEY_PAGEUP": 104,
+	"KEY_LEFT": 105, "KEY_RIGHT": 106, "KEY_END": 107, "KEY_DOWN": 108,
+	"KEY_PAGEDOWN": 109, "KEY_INSERT": 110, "KEY_DELETE": 111,
+	"KEY_MUTE": 113, "KEY_VOLUMEDOWN": 114, "KEY_VOLUMEUP": 115,
+	"KEY_POWER": 116, "KEY_PAUSE": 119, "KEY_STOP": 128, "KEY_MENU": 139,
+	"KEY_SLEEP": 142, "KEY_BACK": 158, "KEY_FORWARD": 159,
+	"KEY_EJECTCD": 161, "KEY_NEXTSONG": 163, "KEY_PLAYPAUSE": 164,
+	"KEY_PREVIOUSSONG": 165, "KEY_STOPCD": 166, "KEY_RECORD": 167,
+	"KEY_REWIND": 168, "KEY_HOMEPAGE": 172, "KEY_EXIT": 174,
+	"KEY_PLAYCD": 200, "KEY_PAUSECD": 201, "KEY_PLAY": 207,
+	"KEY_FASTFORWARD": 208, "KEY_MEDIA": 226, "KEY_OK": 352,
+	"KEY_SELECT": 353, "KEY_INFO": 358, "KEY_SUBTITLE": 370,
+	"KEY_ZOOM": 372, "KEY_AUDIO": 392, "KEY_RED": 398, "KEY_GREEN": 399,
+	"KEY_YELLOW": 400, "KEY_BLUE": 401, "KEY_CHANNELUP": 402,
+	"KEY_CHANNELDOWN": 403, "KEY_NEXT": 407, "KEY_SHUFFLE": 410,
+	"KEY_PREVIOUS": 412,
+}
+
+// evdevNames maps key codes back to their names.
+var evdevNames = func() map[uint16]string {
+	names := map[uint16]string{}
+	for name, code := range evdevCodes {
+		names[code] = name
+	}
+	return names
+}()
+
+// LIRC
+
+// readLIRC reads button presses from the LIRC daemon's socket,
+// reconnecting if the connection is lost, until shutdown.
+func readLIRC(commandChan chan<- interface{}, socket string) {
+	defer serverTasks.Done()
+	warned := false
+	for !isShuttingDown() {
+		c, err := net.Dial("unix", socket)
+		if err != nil {
+			if !warned {
+				logWarn("cannot connect to lircd", "socket", socket, "err", err)
+				warned = true
+			}
+			if !inputWait() {
+				return
+			}
+			continue
+		}
+		logInfo("reading LIRC buttons", "socket", socket)
+		warned = false
+		stop := closeOnShutdown(c)
+		scanner := bufio.NewScanner(c)
+		inReply := false
+		for scanner.Scan() {
+			// lines are "code repeat button remote", with replies
+			// to commands (which are not sent) between BEGIN and END
+			line := scanner.Text()
+			switch {
+			case line == "BEGIN":
+				inReply = true
+				continue
+			case line == "END":
+				inReply = false
+				continue
+			case inReply:
+				continue
+			}
+			f := strings.Fields(line)
+			if len(f) != 4 {
+				continue
+			}
+			repeat, err := strconv.ParseUint(f[1], 16, 32)
+			if err != nil {
+				continue
+			}
+			inputPressed(commandChan, f[2], repeat > 0)
+		}
+		stop()
+		c.Close()
+		if isShuttingDown() {
+			return
+		}
+		logWarn("lircd connection closed", "socket", socket, "err", scanner.Err())
+		if !inputWait() {
+			return
+		}
+	}
+}
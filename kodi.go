@@ -0,0 +1,912 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// The Kodi JSON-RPC interface, served at /jsonrpc for remotes such as
+// Kore and Yatse. It implements the subset of Kodi's API (version 12)
+// those need to control audio playback, on top of the same commands
+// as the REST API. There is a single player and playlist, both with
+// id 0, and playlist positions are in playing order.
+
+// kodiEnabled, set by main, causes /jsonrpc to be served.
+var kodiEnabled bool
+
+type kodiRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	ID     json.RawMessage `json:"id"` // absent for notifications
+}
+
+type kodiResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *kodiError      `json:"error,omitempty"`
+}
+
+type kodiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// JSON-RPC error codes, as used by Kodi
+var (
+	kodiParseError     = &kodiError{-32700, "Parse error."}
+	kodiInvalidRequest = &kodiError{-32600, "Invalid request."}
+	kodiMethodNotFound = &kodiError{-32601, "Method not found."}
+	kodiInvalidParams  = &kodiError{-32602, "Invalid params."}
+	kodiFailed         = &kodiError{-32100, "Failed to execute method."}
+	kodiPermission     = &kodiError{-32100, "Permission denied."}
+)
+
+// kodiTime is Kodi's representation of a time.
+type kodiTime struct {
+	Hours        int `json:"hours"`
+	Minutes      int `json:"minutes"`
+	Seconds      int `json:"seconds"`
+	Milliseconds int `json:"milliseconds"`
+}
+
+func newKodiTime(secs int) kodiTime {
+	return kodiTime{Hours: secs / 3600, Minutes: secs / 60 % 60, Seconds: secs % 60}
+}
+
+func (t kodiTime) secs() int {
+	return t.Hours*3600 + t.Minutes*60 + t.Seconds + t.Milliseconds/1000
+}
+
+// kodiItem is a playlist entry or the current track.
+type kodiItem struct {
+	ID        int      `json:"id"`
+	Type      string   `json:"type"`
+	Label     string   `json:"label"`
+	Title     string   `json:"title"`
+	Artist    []string `json:"artist"`
+	File      string   `json:"file"`
+	Duration  int      `json:"duration"`
+	Thumbnail string   `json:"thumbnail"`
+}
+
+func newKodiItem(t apiTrack) kodiItem {
+	return kodiItem{
+		ID:     t.ID,
+		Type:   "song",
+		Label:  t.Name,
+		Title:  t.Name,
+		Artist: []string{},
+		File:   t.URI,
+	}
+}
+
+// kodiMethod implements a method. It is passed the request's params
+// and returns the result or an error.
+type kodiMethod struct {
+	role int // the role needed to call the method
+	fn   func(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError)
+}
+
+var kodiMethods = map[string]kodiMethod{
+	"JSONRPC.Ping":              {roleReadOnly, kodiPing},
+	"JSONRPC.Version":           {roleReadOnly, kodiVersion},
+	"Application.GetProperties": {roleReadOnly, kodiGetAppProperties},
+	"Application.SetVolume":     {roleFull, kodiSetVolume},
+	"Player.GetActivePlayers":   {roleReadOnly, kodiGetActivePlayers},
+	"Player.GetProperties":      {roleReadOnly, kodiGetPlayerProperties},
+	"Player.GetItem":            {roleReadOnly, kodiGetItem},
+	"Player.PlayPause":          {roleFull, kodiPlayPause},
+	"Player.Stop":               {roleFull, kodiStop},
+	"Player.GoTo":               {roleFull, kodiGoTo},
+	"Player.Seek":               {roleFull, kodiSeek},
+	"Player.SetShuffle":         {roleFull, kodiSetShuffle},
+	"Player.SetRepeat":          {roleFull, kodiSetRepeat},
+	"Player.Open":               {roleFull, kodiOpen},
+	"Playlist.GetPlaylists":     {roleReadOnly, kodiGetPlaylists},
+	"Playlist.GetProperties":    {roleReadOnly, kodiGetPlaylistProperties},
+	"Playlist.GetItems":         {roleReadOnly, kodiGetItems},
+	"Playlist.Add":              {roleFull, kodiAdd},
+	"Playlist.Insert":           {roleFull, kodiInsert},
+	"Playlist.Remove":           {roleFull, kodiRemove},
+	"Playlist.Swap":             {roleFull, kodiSwap},
+	"Playlist.Clear":            {roleFull, kodiClear},
+}
+
+// startKodi registers the /jsonrpc handler. Kodi accepts a request
+// either as the body of a POST or in the request parameter of a GET.
+// As a GET (like a POST of anything but JSON) can be sent cross-site
+// with the credentials a browser has cached, GETs may only call the
+// methods open to read-only users.
+func startKodi(commandChan chan<- interface{}) {
+	http.HandleFunc(
+		"/jsonrpc",
+		func(w http.ResponseWriter, r *http.Request) {
+			u := authorized(w, r, roleReadOnly)
+			if u == nil {
+				return
+			}
+			countRequest("jsonrpc", "")
+			var body []byte
+			switch r.Method {
+			case "GET":
+				body = []byte(r.FormValue("request"))
+				u = &user{name: u.name, role: roleReadOnly}
+			case "POST":
+				if !apiJSONRequest(w, r) {
+					return
+				}
+				var err error
+				body, err = ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+				if err != nil {
+					return
+				}
+			default:
+				w.Header().Set("Allow", "GET, POST")
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			reply := kodiHandle(commandChan, u, body)
+			if reply == nil {
+				// only notifications
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			b, err := json.Marshal(reply)
+			if err != nil {
+				logError("cannot encode JSON-RPC response", "err", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		})
+}
+
+// kodiHandle handles a request or batch of requests, returning the
+// response(s), or nil if there are none (i.e. only notifications).
+func kodiHandle(commandChan chan<- interface{}, u *user, body []byte) interface{} {
+	body = []byte(strings.TrimSpace(string(body)))
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return kodiResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: kodiParseError}
+		}
+		if len(batch) == 0 {
+			return kodiResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: kodiInvalidRequest}
+		}
+		replies := []kodiResponse{}
+		for _, b := range batch {
+			if reply := kodiCall(commandChan, u, b); reply != nil {
+				replies = append(replies, *reply)
+			}
+		}
+		if len(replies) == 0 {
+			return nil
+		}
+		return replies
+	}
+	if reply := kodiCall(commandChan, u, body); reply != nil {
+		return *reply
+	}
+	return nil
+}
+
+// kodiCall handles a single request, returning nil for a notification.
+func kodiCall(commandChan chan<- interface{}, u *user, body []byte) *kodiResponse {
+	var req kodiRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return &kodiResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: kodiParseError}
+	}
+	reply := &kodiResponse{JSONRPC: "2.0", ID: req.ID}
+	m, ok := kodiMethods[req.Method]
+	switch {
+	case req.Method == "":
+		reply.Error = kodiInvalidRequest
+	case !ok:
+		logDebug("unknown JSON-RPC method", "method", req.Method)
+		reply.Error = kodiMethodNotFound
+	case u.role < m.role:
+		reply.Error = kodiPermission
+	default:
+		reply.Result, reply.Error = m.fn(commandChan, req.Params)
+	}
+	if req.ID == nil {
+		return nil
+	}
+	return reply
+}
+
+// kodiParams decodes params into v. Only named parameters are
+// supported.
+func kodiParams(params json.RawMessage, v interface{}) *kodiError {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return kodiInvalidParams
+	}
+	return nil
+}
+
+func kodiPing(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	return "pong", nil
+}
+
+func kodiVersion(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	return map[string]interface{}{
+		"version": map[string]int{"major": 12, "minor": 0, "patch": 0},
+	}, nil
+}
+
+func kodiGetAppProperties(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	var p struct {
+		Properties []string `json:"properties"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	player := getAPIState(commandChan, true).player
+	v := version
+	if v == "" {
+		v = "unknown"
+	}
+	result := map[string]interface{}{}
+	for _, prop := range p.Properties {
+		switch prop {
+		case "volume":
+			result[prop] = player.Volume
+		case "muted":
+			result[prop] = false
+		case "name":
+			result[prop] = "MPlayer-RC"
+		case "version":
+			result[prop] = map[string]interface{}{
+				"major": 12, "minor": 0, "revision": v, "tag": "stable"}
+		}
+	}
+	return result, nil
+}
+
+// kodiSetVolume takes a volume of 0 to 100, or "increment" or
+// "decrement", and returns the new volume.
+func kodiSetVolume(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	var p struct {
+		Volume json.RawMessage `json:"volume"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	var vol int
+	var step string
+	if json.Unmarshal(p.Volume, &vol) == nil {
+		if vol < 0 || vol > 100 {
+			return nil, kodiInvalidParams
+		}
+	} else if json.Unmarshal(p.Volume, &step) == nil {
+		vol = getAPIState(commandChan, true).player.Volume
+		switch step {
+		case "increment":
+			vol += 5
+		case "decrement":
+			vol -= 5
+		default:
+			return nil, kodiInvalidParams
+		}
+		if vol < 0 {
+			vol = 0
+		}
+		if vol > 100 {
+			vol = 100
+		}
+	} else {
+		return nil, kodiInvalidParams
+	}
+	commandChan <- cmdVolume{val: vol * 320 / 100, mode: volAbs}
+	return getAPIState(commandChan, true).player.Volume, nil
+}
+
+// kodiPlayerID checks that params name player 0, if any.
+func kodiPlayerID(params json.RawMessage) *kodiError {
+	var p struct {
+		PlayerID *int `json:"playerid"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return err
+	}
+	if p.PlayerID != nil && *p.PlayerID != 0 {
+		return kodiFailed
+	}
+	return nil
+}
+
+// kodiPlaylistID checks that params name playlist 0, if any.
+func kodiPlaylistID(params json.RawMessage) *kodiError {
+	var p struct {
+		PlaylistID *int `json:"playlistid"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return err
+	}
+	if p.PlaylistID != nil && *p.PlaylistID != 0 {
+		return kodiFailed
+	}
+	return nil
+}
+
+func kodiGetActivePlayers(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	players := []map[string]interface{}{}
+	if getAPIState(commandChan, true).player.State != "stopped" {
+		players = append(players, map[string]interface{}{
+			"playerid": 0, "type": "audio", "playertype": "internal"})
+	}
+	return players, nil
+}
+
+func kodiGetPlayerProperties(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlayerID(params); err != nil {
+		return nil, err
+	}
+	var p struct {
+		Properties []string `json:"properties"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	st := getAPIState(commandChan, true)
+	player := st.player
+	position := -1
+	for i, t := range st.playlist.Tracks {
+		if t.Current {
+			position = i
+		}
+	}
+	result := map[string]interface{}{}
+	for _, prop := range p.Properties {
+		switch prop {
+		case "type":
+			result[prop] = "audio"
+		case "speed":
+			speed := 0
+			if player.State == "playing" {
+				speed = 1
+			}
+			result[prop] = speed
+		case "time":
+			result[prop] = newKodiTime(player.Position)
+		case "totaltime":
+			result[prop] = newKodiTime(player.Duration)
+		case "percentage":
+			pct := 0.0
+			if player.Duration > 0 {
+				pct = float64(player.Position) * 100 / float64(player.Duration)
+			}
+			result[prop] = pct
+		case "position":
+			result[prop] = position
+		case "playlistid":
+			result[prop] = 0
+		case "repeat":
+			repeat := "off"
+			if player.Repeat {
+				repeat = "one"
+			} else if player.Loop {
+				repeat = "all"
+			}
+			result[prop] = repeat
+		case "shuffled":
+			result[prop] = player.Shuffle
+		case "canseek", "canshuffle", "canrepeat", "canmove":
+			result[prop] = true
+		case "canchangespeed", "canrotate", "canzoom", "partymode",
+			"live", "subtitleenabled":
+			result[prop] = false
+		case "audiostreams", "subtitles", "videostreams":
+			result[prop] = []interface{}{}
+		}
+	}
+	return result, nil
+}
+
+func kodiGetItem(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlayerID(params); err != nil {
+		return nil, err
+	}
+	player := getAPIState(commandChan, true).player
+	item := kodiItem{Type: "unknown", Artist: []string{}}
+	if player.Track != nil {
+		item = newKodiItem(*player.Track)
+		item.Duration = player.Duration
+		item.Thumbnail = player.ArtworkURL
+		switch {
+		case player.Title != "":
+			item.Title = player.Title
+		case player.NowPlaying != "":
+			item.Title = player.NowPlaying
+		}
+		item.Label = item.Title
+		if player.Artist != "" {
+			item.Artist = []string{player.Artist}
+		}
+	}
+	return map[string]interface{}{"item": item}, nil
+}
+
+// kodiPlayPause takes play as true, false or "toggle" (the default),
+// and returns the new speed.
+func kodiPlayPause(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlayerID(params); err != nil {
+		return nil, err
+	}
+	var p struct {
+		Play json.RawMessage `json:"play"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	state := getAPIState(commandChan, true).player.State
+	var play bool
+	switch {
+	case p.Play == nil || string(p.Play) == `"toggle"`:
+		play = state != "playing"
+	case json.Unmarshal(p.Play, &play) != nil:
+		return nil, kodiInvalidParams
+	}
+	switch {
+	case play && state == "stopped":
+		commandChan <- cmdPlay{id: -1}
+	case play && state == "paused", !play && state == "playing":
+		commandChan <- cmdPause{}
+	}
+	speed := 0
+	if getAPIState(commandChan, true).player.State == "playing" {
+		speed = 1
+	}
+	return map[string]int{"speed": speed}, nil
+}
+
+func kodiStop(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlayerID(params); err != nil {
+		return nil, err
+	}
+	commandChan <- cmdStop{}
+	return "OK", nil
+}
+
+// kodiGoTo takes to as "next", "previous" or a playlist position.
+func kodiGoTo(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlayerID(params); err != nil {
+		return nil, err
+	}
+	var p struct {
+		To json.RawMessage `json:"to"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	var pos int
+	switch string(p.To) {
+	case `"next"`:
+		commandChan <- cmdNext{}
+	case `"previous"`:
+		commandChan <- cmdPrev{}
+	default:
+		if json.Unmarshal(p.To, &pos) != nil {
+			return nil, kodiInvalidParams
+		}
+		tracks := getAPIState(commandChan, false).playlist.Tracks
+		if pos < 0 || pos >= len(tracks) {
+			return nil, kodiInvalidParams
+		}
+		commandChan <- cmdPlay{id: tracks[pos].ID}
+	}
+	return "OK", nil
+}
+
+// kodiSteps are the relative seeks Player.Seek accepts, in seconds.
+var kodiSteps = map[string]int{
+	"smallforward": 30, "smallbackward": -30,
+	"bigforward": 600, "bigbackward": -600,
+}
+
+// kodiSeek takes value as a percentage, a step name, or an object
+// with one of percentage, time, step or seconds (relative), and
+// returns the new position.
+func kodiSeek(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlayerID(params); err != nil {
+		return nil, err
+	}
+	var p struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	var v struct {
+		Percentage *float64  `json:"percentage"`
+		Time       *kodiTime `json:"time"`
+		Step       string    `json:"step"`
+		Seconds    *int      `json:"seconds"`
+	}
+	var pct float64
+	if json.Unmarshal(p.Value, &pct) == nil {
+		v.Percentage = &pct
+	} else if json.Unmarshal(p.Value, &v.Step) != nil &&
+		json.Unmarshal(p.Value, &v) != nil {
+		return nil, kodiInvalidParams
+	}
+	player := getAPIState(commandChan, true).player
+	pos := player.Position
+	switch {
+	case v.Percentage != nil:
+		pos = int(*v.Percentage * float64(player.Duration) / 100)
+	case v.Time != nil:
+		pos = v.Time.secs()
+	case v.Seconds != nil:
+		pos += *v.Seconds
+	case v.Step != "":
+		step, ok := kodiSteps[v.Step]
+		if !ok {
+			return nil, kodiInvalidParams
+		}
+		pos += step
+	default:
+		return nil, kodiInvalidParams
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	commandChan <- cmdSeek{val: pos, mode: seekAbs}
+	player = getAPIState(commandChan, true).player
+	pct = 0
+	if player.Duration > 0 {
+		pct = float64(player.Position) * 100 / float64(player.Duration)
+	}
+	return map[string]interface{}{
+		"percentage": pct,
+		"time":       newKodiTime(player.Position),
+		"totaltime":  newKodiTime(player.Duration),
+	}, nil
+}
+
+// kodiToggle decodes a bool or "toggle" parameter, returning the
+// new value given the current one.
+func kodiToggle(raw json.RawMessage, current bool) (bool, *kodiError) {
+	if string(raw) == `"toggle"` {
+		return !current, nil
+	}
+	var b bool
+	if json.Unmarshal(raw, &b) != nil {
+		return false, kodiInvalidParams
+	}
+	return b, nil
+}
+
+func kodiSetShuffle(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlayerID(params); err != nil {
+		return nil, err
+	}
+	var p struct {
+		Shuffle json.RawMessage `json:"shuffle"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	current := getAPIState(commandChan, true).player.Shuffle
+	shuffle, err := kodiToggle(p.Shuffle, current)
+	if err != nil {
+		return nil, err
+	}
+	if shuffle != current {
+		commandChan <- cmdShuffle{}
+	}
+	return "OK", nil
+}
+
+// kodiSetRepeat takes repeat as "off", "one" (repeat the track),
+// "all" (loop the playlist) or "cycle" (off -> all -> one -> off).
+func kodiSetRepeat(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlayerID(params); err != nil {
+		return nil, err
+	}
+	var p struct {
+		Repeat string `json:"repeat"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	player := getAPIState(commandChan, true).player
+	mode := p.Repeat
+	if mode == "cycle" {
+		switch {
+		case player.Repeat:
+			mode = "off"
+		case player.Loop:
+			mode = "one"
+		default:
+			mode = "all"
+		}
+	}
+	var loop, repeat bool
+	switch mode {
+	case "off":
+	case "one":
+		repeat = true
+	case "all":
+		loop = true
+	default:
+		return nil, kodiInvalidParams
+	}
+	if loop != player.Loop {
+		commandChan <- cmdLoop{}
+		player.Repeat = false // cleared by cmdLoop
+	}
+	if repeat != player.Repeat {
+		commandChan <- cmdRepeat{}
+	}
+	return "OK", nil
+}
+
+// kodiPlaylistItem is an item to add to the playlist. Only files
+// (which may be URLs) are supported.
+type kodiPlaylistItem struct {
+	File string `json:"file"`
+}
+
+// kodiAddItem adds item to the playlist, playing it if play is set,
+// and returns its id.
+func kodiAddItem(commandChan chan<- interface{}, item kodiPlaylistItem, play bool) (int, *kodiError) {
+	if item.File == "" {
+		return -1, kodiInvalidParams
+	}
+	replyChan := make(chan int, 1)
+	commandChan <- cmdSetPlaylist{
+		uri: item.File, enqueue: !play, replyChan: replyChan}
+	id := <-replyChan
+	if id < 0 {
+		return -1, kodiFailed
+	}
+	return id, nil
+}
+
+// kodiOpen takes item as {"file": file} to add and play a file, or
+// {"playlistid": 0, "position": n} to play a playlist position.
+func kodiOpen(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	var p struct {
+		Item struct {
+			kodiPlaylistItem
+			PlaylistID *int `json:"playlistid"`
+			Position   int  `json:"position"`
+		} `json:"item"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	switch {
+	case p.Item.File != "":
+		if _, err := kodiAddItem(commandChan, p.Item.kodiPlaylistItem, true); err != nil {
+			return nil, err
+		}
+	case p.Item.PlaylistID != nil:
+		tracks := getAPIState(commandChan, false).playlist.Tracks
+		if *p.Item.PlaylistID != 0 ||
+			p.Item.Position < 0 || p.Item.Position >= len(tracks) {
+			return nil, kodiInvalidParams
+		}
+		commandChan <- cmdPlay{id: tracks[p.Item.Position].ID}
+	default:
+		return nil, kodiInvalidParams
+	}
+	return "OK", nil
+}
+
+func kodiGetPlaylists(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	return []map[string]interface{}{{"playlistid": 0, "type": "audio"}}, nil
+}
+
+func kodiGetPlaylistProperties(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlaylistID(params); err != nil {
+		return nil, err
+	}
+	var p struct {
+		Properties []string `json:"properties"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	n := len(getAPIState(commandChan, false).playlist.Tracks)
+	result := map[string]interface{}{}
+	for _, prop := range p.Properties {
+		switch prop {
+		case "type":
+			result[prop] = "audio"
+		case "size":
+			result[prop] = n
+		}
+	}
+	return result, nil
+}
+
+func kodiGetItems(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlaylistID(params); err != nil {
+		return nil, err
+	}
+	var p struct {
+		Limits struct {
+			Start int  `json:"start"`
+			End   *int `json:"end"`
+		} `json:"limits"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	tracks := getAPIState(commandChan, false).playlist.Tracks
+	start, end := p.Limits.Start, len(tracks)
+	if p.Limits.End != nil && *p.Limits.End >= 0 && *p.Limits.End < end {
+		end = *p.Limits.End
+	}
+	if start < 0 || start > end {
+		start = end
+	}
+	items := []kodiItem{}
+	for _, t := range tracks[start:end] {
+		items = append(items, newKodiItem(t))
+	}
+	return map[string]interface{}{
+		"items": items,
+		"limits": map[string]int{
+			"start": start, "end": end, "total": len(tracks)},
+	}, nil
+}
+
+// kodiItems decodes item, which may be a single item or an array.
+func kodiItems(raw json.RawMessage) ([]kodiPlaylistItem, *kodiError) {
+	var items []kodiPlaylistItem
+	if json.Unmarshal(raw, &items) != nil {
+		var item kodiPlaylistItem
+		if json.Unmarshal(raw, &item) != nil {
+			return nil, kodiInvalidParams
+		}
+		items = []kodiPlaylistItem{item}
+	}
+	return items, nil
+}
+
+func kodiAdd(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlaylistID(params); err != nil {
+		return nil, err
+	}
+	var p struct {
+		Item json.RawMessage `json:"item"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	items, err := kodiItems(p.Item)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if _, err := kodiAddItem(commandChan, item, false); err != nil {
+			return nil, err
+		}
+	}
+	return "OK", nil
+}
+
+// kodiInsert adds items at a playlist position.
+func kodiInsert(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlaylistID(params); err != nil {
+		return nil, err
+	}
+	var p struct {
+		Position int             `json:"position"`
+		Item     json.RawMessage `json:"item"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	items, err := kodiItems(p.Item)
+	if err != nil {
+		return nil, err
+	}
+	tracks := getAPIState(commandChan, false).playlist.Tracks
+	if p.Position < 0 || p.Position > len(tracks) {
+		return nil, kodiInvalidParams
+	}
+	for _, item := range items {
+		id, err := kodiAddItem(commandChan, item, false)
+		if err != nil {
+			return nil, err
+		}
+		if p.Position < len(tracks) {
+			// move it before the track originally at Position
+			commandChan <- cmdMove{id: id, target: tracks[p.Position].ID}
+		}
+	}
+	return "OK", nil
+}
+
+func kodiRemove(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlaylistID(params); err != nil {
+		return nil, err
+	}
+	var p struct {
+		Position int `json:"position"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	tracks := getAPIState(commandChan, false).playlist.Tracks
+	if p.Position < 0 || p.Position >= len(tracks) {
+		return nil, kodiInvalidParams
+	}
+	commandChan <- cmdRemove{id: tracks[p.Position].ID}
+	return "OK", nil
+}
+
+// kodiSwap swaps the tracks at two playlist positions using two
+// moves.
+func kodiSwap(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlaylistID(params); err != nil {
+		return nil, err
+	}
+	var p struct {
+		Position1 int `json:"position1"`
+		Position2 int `json:"position2"`
+	}
+	if err := kodiParams(params, &p); err != nil {
+		return nil, err
+	}
+	tracks := getAPIState(commandChan, false).playlist.Tracks
+	i, j := p.Position1, p.Position2
+	if i > j {
+		i, j = j, i
+	}
+	if i < 0 || j >= len(tracks) {
+		return nil, kodiInvalidParams
+	}
+	if i != j {
+		// the track at i moves to j, shifting i+1...j back by one,
+		// then the track from j moves from j-1 to i
+		commandChan <- cmdMove{id: tracks[i].ID, target: tracks[j].ID}
+		if j > i+1 {
+			commandChan <- cmdMove{id: tracks[j].ID, target: tracks[i+1].ID}
+		}
+	}
+	return "OK", nil
+}
+
+func kodiClear(commandChan chan<- interface{}, params json.RawMessage) (interface{}, *kodiError) {
+	if err := kodiPlaylistID(params); err != nil {
+		return nil, err
+	}
+	for _, t := range getAPIState(commandChan, false).playlist.Tracks {
+		commandChan <- cmdRemove{id: t.ID}
+	}
+	return "OK", nil
+}
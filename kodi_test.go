@@ -0,0 +1,55 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+// TestKodiAddSpecialPaths checks that a file added with Playlist.Add
+// reaches the playlist unchanged.
+func TestKodiAddSpecialPaths(t *testing.T) {
+	commandChan := make(chan interface{})
+	defer close(commandChan)
+	go func() {
+		for c := range commandChan {
+			if cmd, ok := c.(cmdSetPlaylist); ok {
+				cmd.replyChan <- funcSetPlaylist(ioutil.Discard, nil, cmd.uri, cmd.enqueue)
+			}
+		}
+	}()
+	u := &user{role: roleFull}
+	for _, p := range specialPaths {
+		body := fmt.Sprintf(`{"jsonrpc": "2.0", "id": 1, "method": "Playlist.Add",
+			"params": {"playlistid": 0, "item": {"file": %q}}}`, p)
+		reply, ok := kodiHandle(commandChan, u, []byte(body)).(kodiResponse)
+		if !ok || reply.Error != nil {
+			t.Errorf("adding %q: %+v", p, reply)
+			continue
+		}
+		if got := idTrackMap[idCounter-1]; got != p {
+			t.Errorf("added %q as %q", p, got)
+		}
+	}
+}
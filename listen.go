@@ -0,0 +1,78 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// listenAddr is an address the web server listens on.
+type listenAddr struct {
+	network string // "tcp" or "unix"
+	addr    string
+}
+
+func (a listenAddr) isUnix() bool {
+	return a.network == "unix"
+}
+
+// parseListen converts a listen address given in the config file or
+// on the command line into a listenAddr. spec may be empty (meaning
+// all interfaces), a host name or IP address with optional port (IPv6
+// addresses in brackets if a port is given), or a Unix socket path
+// (either absolute or prefixed with "unix:"). port is used if spec
+// does not give one.
+func parseListen(spec, port string) listenAddr {
+	if strings.HasPrefix(spec, "unix:") {
+		return listenAddr{network: "unix", addr: spec[len("unix:"):]}
+	}
+	if strings.HasPrefix(spec, "/") {
+		return listenAddr{network: "unix", addr: spec}
+	}
+	if ip := net.ParseIP(strings.Trim(spec, "[]")); ip != nil {
+		// bare IP address (IPv6 possibly bracketed)
+		return listenAddr{
+			network: "tcp", addr: net.JoinHostPort(ip.String(), port)}
+	}
+	if _, _, err := net.SplitHostPort(spec); err == nil {
+		return listenAddr{network: "tcp", addr: spec}
+	}
+	return listenAddr{network: "tcp", addr: net.JoinHostPort(spec, port)}
+}
+
+// listen opens a listener on a. Any stale Unix socket left behind by
+// a previous run is removed first.
+func listen(a listenAddr) (net.Listener, error) {
+	if a.isUnix() {
+		if fi, err := os.Lstat(a.addr); err == nil &&
+			fi.Mode()&os.ModeSocket != 0 {
+			if c, err := net.Dial("unix", a.addr); err == nil {
+				c.Close() // in use, so let net.Listen fail
+			} else {
+				os.Remove(a.addr)
+			}
+		}
+	}
+	return net.Listen(a.network, a.addr)
+}
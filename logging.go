@@ -0,0 +1,189 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// log levels. Messages above logLevel are discarded.
+const (
+	levelError = iota
+	levelWarn
+	levelInfo
+	levelDebug
+	levelTrace // every line sent to and received from the backend
+)
+
+var levelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+// syslog priorities for each level, prefixed to lines logged to the
+// journal (see sd-daemon(3))
+var levelPriorities = []int{3, 4, 6, 7, 7}
+
+// the logging settings, set by main
+var (
+	logLevel   = levelInfo
+	logAccess  bool // log every HTTP request at info level
+	logJournal bool // stderr is the journal, set by initSystemd
+)
+
+// parseLevel converts a level name (or number) to a level.
+func parseLevel(s string) (int, error) {
+	s = strings.ToLower(s)
+	for level, name := range levelNames {
+		if s == name {
+			return level, nil
+		}
+	}
+	if level, err := strconv.Atoi(s); err == nil &&
+		level >= levelError && level <= levelTrace {
+		return level, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// openLogFile sends log output to the file name, appending to it.
+func openLogFile(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	logJournal = false
+	return nil
+}
+
+// logf logs msg at level followed by the key/value pairs kv, e.g.
+//
+//   logf(levelWarn, "cannot play track", "track", "a.mp3")
+//
+// logs
+//
+//   mplayer-rc: warn: cannot play track track=a.mp3
+func logf(level int, msg string, kv ...interface{}) {
+	if level > logLevel {
+		return
+	}
+	b := new(bytes.Buffer)
+	if logJournal {
+		fmt.Fprintf(b, "<%d>", levelPriorities[level])
+	}
+	b.WriteString("mplayer-rc: ")
+	b.WriteString(levelNames[level])
+	b.WriteString(": ")
+	b.WriteString(msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(b, " %v=%s", kv[i], logValue(kv[i+1]))
+	}
+	log.Print(b.String())
+}
+
+// logValue formats v, quoting it if necessary so that each key=value
+// pair is unambiguous.
+func logValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func logError(msg string, kv ...interface{}) { logf(levelError, msg, kv...) }
+func logWarn(msg string, kv ...interface{})  { logf(levelWarn, msg, kv...) }
+func logInfo(msg string, kv ...interface{})  { logf(levelInfo, msg, kv...) }
+func logDebug(msg string, kv ...interface{}) { logf(levelDebug, msg, kv...) }
+func logTrace(msg string, kv ...interface{}) { logf(levelTrace, msg, kv...) }
+
+// traceWriter logs what is written to the backend at trace level.
+type traceWriter struct {
+	io.Writer
+}
+
+func (w traceWriter) Write(p []byte) (int, error) {
+	if logLevel >= levelTrace {
+		for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+			logTrace("backend <", "line", line)
+		}
+	}
+	return w.Writer.Write(p)
+}
+
+// statusWriter records the status code and size of an HTTP response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.size += n
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// accessLog wraps h to log each request at info level if logAccess is
+// set, or at debug level otherwise.
+func accessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		level := levelDebug
+		if logAccess {
+			level = levelInfo
+		}
+		if level > logLevel {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		logf(level, "http request", "client", r.RemoteAddr,
+			"method", r.Method, "uri", r.URL.RequestURI(),
+			"status", sw.status, "size", sw.size,
+			"duration", time.Since(start).Round(time.Millisecond))
+	})
+}
@@ -37,7 +37,6 @@ package main // import "xi2.org/x/mplayer-rc"
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -45,6 +44,7 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -90,18 +90,58 @@ var (
 
 	flagVersion       bool
 	flagPassword      string
+	flagHashPassword  bool
 	flagPort          string
 	flagRemapCommands bool
 	flagFormat        string
+	flagTLS           bool
+	flagTLSCert       string
+	flagTLSKey        string
+	flagTLSPort       string
+	flagListen        string
+	flagResume        bool
+	flagResumeSession bool
+	flagIdle          bool
+	flagVerbose       int
+	flagLogFile       string
 )
 
 // variables set by config file processing
 var (
 	confBackend       string
 	confPassword      string
+	confPasswordHash  string
+	confUsers         []string
+	confAllow         []string
+	confDeny          []string
+	confHostsFile     string
 	confPort          string = "8080"
 	confRemapCommands bool
 	confFormat        string = "xml"
+	confTLS           bool
+	confTLSCert       string
+	confTLSKey        string
+	confTLSPort       string
+	confListen        []string
+	confResume        bool
+	confResumeByHash  bool
+	confResumeMinLen  string
+	confResumeExclude string
+	confSession       bool
+	confLogLevel      string
+	confLogFile       string
+	confAccessLog     bool
+	confMetrics       bool
+	confKodi          bool
+	confMPD           string
+	confMPRIS         bool
+	confUPnP          string
+	confUPnPName      string
+	confMDNS          bool
+	confMDNSName      string
+	confInput         []string
+	confLIRC          string
+	confKeys          []string // the [keys] section, nil if absent
 )
 
 func trimTrailingSpace(s string) string {
@@ -111,19 +151,70 @@ func trimTrailingSpace(s string) string {
 	return s
 }
 
-// processConfig parses the config file and sets the conf* variables
-func processConfig() {
-	home := os.Getenv("HOME")
+// splitList splits a comma separated config value, dropping the
+// spaces around and the empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// homeDir returns the user's home directory.
+func homeDir() string {
 	if runtime.GOOS == "windows" {
-		home = os.Getenv("USERPROFILE")
+		return os.Getenv("USERPROFILE")
+	}
+	return os.Getenv("HOME")
+}
+
+// configDir returns the directory in which mplayer-rc keeps files it
+// creates itself (as opposed to the config file, ~/.mplayer-rc).
+func configDir() string {
+	return filepath.Join(homeDir(), ".mplayer-rc.d")
+}
+
+// defaultServiceName returns the name mplayer-rc is announced by on
+// the network (over UPnP or mDNS) unless another is configured.
+func defaultServiceName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "MPlayer-RC"
 	}
+	return "MPlayer-RC on " + host
+}
+
+// processConfig parses the config file and sets the conf* variables
+func processConfig() {
 	b, err := ioutil.ReadFile(
-		filepath.Join(home, ".mplayer-rc"))
+		filepath.Join(homeDir(), ".mplayer-rc"))
 	if err != nil {
 		return
 	}
 	scanner := bufio.NewScanner(bytes.NewBuffer(b))
+	section := ""
 	for scanner.Scan() {
+		// settings come before any [section] header
+		if strings.HasPrefix(scanner.Text(), "[") {
+			section = trimTrailingSpace(scanner.Text())
+			if section == "[keys]" && confKeys == nil {
+				confKeys = []string{}
+			}
+			continue
+		}
+		if section == "[keys]" {
+			p := strings.TrimSpace(scanner.Text())
+			if p != "" && p[0] != '#' {
+				confKeys = append(confKeys, p)
+			}
+			continue
+		}
+		if section != "" {
+			continue
+		}
 		if strings.HasPrefix(scanner.Text(), "backend=") {
 			p := scanner.Text()[len("backend="):]
 			confBackend = trimTrailingSpace(p)
@@ -132,6 +223,130 @@ func processConfig() {
 			p := scanner.Text()[len("password="):]
 			confPassword = trimTrailingSpace(p)
 		}
+		if strings.HasPrefix(scanner.Text(), "password-hash=") {
+			p := scanner.Text()[len("password-hash="):]
+			confPasswordHash = trimTrailingSpace(p)
+		}
+		if strings.HasPrefix(scanner.Text(), "user=") {
+			p := scanner.Text()[len("user="):]
+			confUsers = append(confUsers, trimTrailingSpace(p))
+		}
+		if strings.HasPrefix(scanner.Text(), "allow=") {
+			p := scanner.Text()[len("allow="):]
+			confAllow = append(confAllow, trimTrailingSpace(p))
+		}
+		if strings.HasPrefix(scanner.Text(), "deny=") {
+			p := scanner.Text()[len("deny="):]
+			confDeny = append(confDeny, trimTrailingSpace(p))
+		}
+		if strings.HasPrefix(scanner.Text(), "hosts-file=") {
+			p := scanner.Text()[len("hosts-file="):]
+			confHostsFile = trimTrailingSpace(p)
+		}
+		if strings.HasPrefix(scanner.Text(), "resume=") {
+			p := scanner.Text()[len("resume="):]
+			p = strings.ToLower(trimTrailingSpace(p))
+			switch p {
+			case "yes", "1", "true":
+				confResume = true
+			}
+		}
+		if strings.HasPrefix(scanner.Text(), "resume-key=") {
+			p := scanner.Text()[len("resume-key="):]
+			confResumeByHash = strings.ToLower(trimTrailingSpace(p)) == "hash"
+		}
+		if strings.HasPrefix(scanner.Text(), "resume-min-length=") {
+			p := scanner.Text()[len("resume-min-length="):]
+			confResumeMinLen = trimTrailingSpace(p)
+		}
+		if strings.HasPrefix(scanner.Text(), "resume-exclude=") {
+			p := scanner.Text()[len("resume-exclude="):]
+			confResumeExclude = trimTrailingSpace(p)
+		}
+		if strings.HasPrefix(scanner.Text(), "session=") {
+			p := scanner.Text()[len("session="):]
+			p = strings.ToLower(trimTrailingSpace(p))
+			switch p {
+			case "yes", "1", "true":
+				confSession = true
+			}
+		}
+		if strings.HasPrefix(scanner.Text(), "log-level=") {
+			p := scanner.Text()[len("log-level="):]
+			confLogLevel = trimTrailingSpace(p)
+		}
+		if strings.HasPrefix(scanner.Text(), "log-file=") {
+			p := scanner.Text()[len("log-file="):]
+			confLogFile = trimTrailingSpace(p)
+		}
+		if strings.HasPrefix(scanner.Text(), "access-log=") {
+			p := scanner.Text()[len("access-log="):]
+			p = strings.ToLower(trimTrailingSpace(p))
+			switch p {
+			case "yes", "1", "true":
+				confAccessLog = true
+			}
+		}
+		if strings.HasPrefix(scanner.Text(), "metrics=") {
+			p := scanner.Text()[len("metrics="):]
+			p = strings.ToLower(trimTrailingSpace(p))
+			switch p {
+			case "yes", "1", "true":
+				confMetrics = true
+			}
+		}
+		if strings.HasPrefix(scanner.Text(), "kodi=") {
+			p := scanner.Text()[len("kodi="):]
+			p = strings.ToLower(trimTrailingSpace(p))
+			switch p {
+			case "yes", "1", "true":
+				confKodi = true
+			}
+		}
+		if strings.HasPrefix(scanner.Text(), "mpris=") {
+			p := scanner.Text()[len("mpris="):]
+			p = strings.ToLower(trimTrailingSpace(p))
+			switch p {
+			case "yes", "1", "true":
+				confMPRIS = true
+			}
+		}
+		if strings.HasPrefix(scanner.Text(), "mpd=") {
+			p := scanner.Text()[len("mpd="):]
+			confMPD = trimTrailingSpace(p)
+		}
+		if strings.HasPrefix(scanner.Text(), "upnp=") {
+			p := scanner.Text()[len("upnp="):]
+			confUPnP = trimTrailingSpace(p)
+		}
+		if strings.HasPrefix(scanner.Text(), "upnp-name=") {
+			p := scanner.Text()[len("upnp-name="):]
+			confUPnPName = trimTrailingSpace(p)
+		}
+		if strings.HasPrefix(scanner.Text(), "mdns=") {
+			p := scanner.Text()[len("mdns="):]
+			p = strings.ToLower(trimTrailingSpace(p))
+			switch p {
+			case "yes", "1", "true":
+				confMDNS = true
+			}
+		}
+		if strings.HasPrefix(scanner.Text(), "mdns-name=") {
+			p := scanner.Text()[len("mdns-name="):]
+			confMDNSName = trimTrailingSpace(p)
+		}
+		if strings.HasPrefix(scanner.Text(), "input=") {
+			p := scanner.Text()[len("input="):]
+			confInput = append(confInput, splitList(p)...)
+		}
+		if strings.HasPrefix(scanner.Text(), "lirc=") {
+			p := scanner.Text()[len("lirc="):]
+			confLIRC = trimTrailingSpace(p)
+		}
+		if strings.HasPrefix(scanner.Text(), "listen=") {
+			p := scanner.Text()[len("listen="):]
+			confListen = append(confListen, splitList(p)...)
+		}
 		if strings.HasPrefix(scanner.Text(), "port=") {
 			p := scanner.Text()[len("port="):]
 			confPort = trimTrailingSpace(p)
@@ -148,6 +363,26 @@ func processConfig() {
 			p := scanner.Text()[len("format="):]
 			confFormat = strings.ToLower(trimTrailingSpace(p))
 		}
+		if strings.HasPrefix(scanner.Text(), "tls=") {
+			p := scanner.Text()[len("tls="):]
+			p = strings.ToLower(trimTrailingSpace(p))
+			switch p {
+			case "yes", "1", "true":
+				confTLS = true
+			}
+		}
+		if strings.HasPrefix(scanner.Text(), "tls-cert=") {
+			p := scanner.Text()[len("tls-cert="):]
+			confTLSCert = trimTrailingSpace(p)
+		}
+		if strings.HasPrefix(scanner.Text(), "tls-key=") {
+			p := scanner.Text()[len("tls-key="):]
+			confTLSKey = trimTrailingSpace(p)
+		}
+		if strings.HasPrefix(scanner.Text(), "tls-port=") {
+			p := scanner.Text()[len("tls-port="):]
+			confTLSPort = trimTrailingSpace(p)
+		}
 	}
 }
 
@@ -235,7 +470,10 @@ func processFlags(args []string) []string {
 
 	printUsage := func() {
 		fmt.Fprintf(os.Stderr,
-			"Usage: %s [mplayer-rc or mplayer/mpv flags] [files/URLs]\n\n",
+			"Usage: %s [mplayer-rc or mplayer/mpv flags] [files/URLs]\n",
+			filepath.Base(args[0]))
+		fmt.Fprintf(os.Stderr,
+			"       %s ctl command [args] (controls a running instance)\n\n",
 			filepath.Base(args[0]))
 		// Go 1.5+ package flag compatible format
 		fmt.Fprintf(os.Stderr, "  -V\t")
@@ -244,15 +482,48 @@ func processFlags(args []string) []string {
 		fmt.Fprintf(os.Stderr, "  -backend backend\n")
 		fmt.Fprintf(os.Stderr,
 			"    \tset backend as the backend player (default mplayer)\n")
+		fmt.Fprintf(os.Stderr, "  -idle\t")
+		fmt.Fprintf(os.Stderr,
+			"start with an empty playlist if no files/URLs are given\n")
+		fmt.Fprintf(os.Stderr, "  -listen addrs\n")
+		fmt.Fprintf(os.Stderr,
+			"    \tlisten on comma separated addrs (IPs or Unix socket paths)\n")
+		fmt.Fprintf(os.Stderr, "  -log-file file\n")
+		fmt.Fprintf(os.Stderr,
+			"    \tappend log messages to file instead of stderr\n")
 		fmt.Fprintf(os.Stderr, "  -password pass\n")
 		fmt.Fprintf(os.Stderr,
 			"    \tuse pass as the VLC remote password\n")
+		fmt.Fprintf(os.Stderr, "  -hash-password\n")
+		fmt.Fprintf(os.Stderr,
+			"    \tprint a hash of the password read from stdin and exit\n")
 		fmt.Fprintf(os.Stderr, "  -port port\n")
 		fmt.Fprintf(os.Stderr,
 			"    \tuse port as the listening port for VLC commands (default 8080)\n")
 		fmt.Fprintf(os.Stderr, "  -remap-commands\n")
 		fmt.Fprintf(os.Stderr,
 			"    \tuse alternate actions for some VLC commands\n")
+		fmt.Fprintf(os.Stderr, "  -resume\n")
+		fmt.Fprintf(os.Stderr,
+			"    \tresume long tracks from where they were last stopped\n")
+		fmt.Fprintf(os.Stderr, "  -resume-session\n")
+		fmt.Fprintf(os.Stderr,
+			"    \trestore the playlist and player state saved on last exit\n")
+		fmt.Fprintf(os.Stderr, "  -tls\t")
+		fmt.Fprintf(os.Stderr,
+			"serve VLC commands over HTTPS (self-signed unless -tls-cert given)\n")
+		fmt.Fprintf(os.Stderr, "  -tls-cert file\n")
+		fmt.Fprintf(os.Stderr,
+			"    \tuse file as the HTTPS certificate (implies -tls)\n")
+		fmt.Fprintf(os.Stderr, "  -tls-key file\n")
+		fmt.Fprintf(os.Stderr,
+			"    \tuse file as the HTTPS private key\n")
+		fmt.Fprintf(os.Stderr, "  -tls-port port\n")
+		fmt.Fprintf(os.Stderr,
+			"    \tserve HTTPS on port, and plain HTTP on -port\n")
+		fmt.Fprintf(os.Stderr, "  -v\t")
+		fmt.Fprintf(os.Stderr,
+			"log debug messages (-vv also logs backend input/output)\n")
 	}
 	printVersion := func() {
 		if version != "" {
@@ -288,11 +559,61 @@ func processFlags(args []string) []string {
 			i++
 			continue
 		}
+		if a == "-hash-password" {
+			flagHashPassword = true
+			break
+		}
+		if a == "-idle" || a == "--idle" {
+			// the backend is always run idle, so this is not passed on
+			flagIdle = true
+			continue
+		}
+		if a == "-v" || a == "-vv" {
+			flagVerbose += len(a) - 1
+			continue
+		}
+		if i < n-1 && a == "-log-file" {
+			flagLogFile = args[i+1]
+			i++
+			continue
+		}
+		if i < n-1 && a == "-listen" {
+			flagListen = args[i+1]
+			i++
+			continue
+		}
 		if i < n-1 && a == "-port" {
 			flagPort = args[i+1]
 			i++
 			continue
 		}
+		if a == "-resume" {
+			flagResume = true
+			continue
+		}
+		if a == "-resume-session" {
+			flagResumeSession = true
+			continue
+		}
+		if a == "-tls" {
+			flagTLS = true
+			continue
+		}
+		if i < n-1 && a == "-tls-cert" {
+			flagTLSCert = args[i+1]
+			i++
+			continue
+		}
+		if i < n-1 && a == "-tls-key" {
+			flagTLSKey = args[i+1]
+			i++
+			continue
+		}
+		if i < n-1 && a == "-tls-port" {
+			flagTLSPort = args[i+1]
+			i++
+			continue
+		}
 		if a == "-shuffle" || a == "--shuffle" {
 			doShuffle = true
 			continue
@@ -364,16 +685,41 @@ func processFlags(args []string) []string {
 		printVersion()
 		os.Exit(1)
 	}
-	if flagUsage || len(tracks) == 0 {
+	if flagHashPassword {
+		fmt.Fprintf(os.Stderr, "Password: ")
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Scan()
+		hash, err := hashPassword(scanner.Text())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(hash)
+		os.Exit(0)
+	}
+	if flagUsage || (len(tracks) == 0 && !flagResumeSession && !flagIdle) {
 		printUsage()
 		os.Exit(2)
 	}
 
-	// create playlist state
+	// create playlist state, appending any tracks given to the
+	// restored session
+	if flagResumeSession {
+		if err := loadSession(); err != nil {
+			if len(tracks) == 0 && !flagIdle {
+				log.Fatalf("mplayer-rc: cannot resume session: %v", err)
+			}
+			logWarn("cannot resume session", "err", err)
+			flagResumeSession = false
+		}
+	}
 	for _, f := range tracks {
 		addPlaylistEntry(f)
 	}
-	if doShuffle {
+	if len(playlist) == 0 {
+		// idle until the remote adds something to the playlist
+		stopped = true
+	}
+	if doShuffle && len(playlist) > 0 {
 		playpos = rand.Intn(len(playlist))
 		funcShuffle()
 	}
@@ -409,6 +755,20 @@ var (
 	responseFormat string
 	// the backend, set by setBackend
 	backend *backendData
+	// the HTTPS settings. If tlsPort is set then HTTP is served on
+	// the normal port and HTTPS on tlsPort, otherwise only HTTPS is
+	// served.
+	useTLS          bool
+	tlsCert, tlsKey string
+	tlsPort         string
+	// the addresses to listen on. An empty address means all
+	// interfaces.
+	listenSpecs []string
+	// the stream metadata of the current track (e.g. the ICY
+	// StreamTitle of an internet radio station), as printed by the
+	// backend. It is reset whenever a track is loaded.
+	nowPlaying  string
+	stationName string
 )
 
 // idCounter is incremented on each creation of a playlist id. id
@@ -424,34 +784,93 @@ func addPlaylistEntry(track string) {
 	posToShuf = append(posToShuf, len(playlist)-1)
 	shufToPos = append(shufToPos, len(playlist)-1)
 	idCounter++
+	playlistVersion++
+}
+
+// parseICYTitle extracts the stream title from the text following
+// backend.matchICYTitle. MPlayer prints the raw ICY metadata
+// (StreamTitle='...';StreamUrl='...';) whereas MPV prints just the
+// title.
+func parseICYTitle(s string) string {
+	if strings.HasPrefix(s, "StreamTitle='") {
+		s = s[len("StreamTitle='"):]
+		if i := strings.Index(s, "';"); i >= 0 {
+			s = s[:i]
+		} else {
+			s = strings.TrimSuffix(s, "'")
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+// backendProcess is a running backend.
+type backendProcess struct {
+	cmd *exec.Cmd
+	// exited is closed once the backend has exited and all its
+	// output has been put into outChan, just before outChan is
+	// closed
+	exited chan struct{}
+}
+
+// running reports whether the backend has not yet exited.
+func (p *backendProcess) running() bool {
+	select {
+	case <-p.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// exitStatus returns the exit status to use given that the backend
+// exited by itself.
+func (p *backendProcess) exitStatus() int {
+	if p.cmd.ProcessState != nil && p.cmd.ProcessState.Success() {
+		return exitOK
+	}
+	return exitFailure
 }
 
 // launchBackend starts up the backend with the provided flags in
-// slave mode. It returns the backend's stdin as an io.Writer, and the
-// combined stdout/stderr as a <-chan string.
+// slave mode. It returns the backend process, the backend's stdin as
+// an io.Writer, and the combined stdout/stderr as a <-chan string. The
+// channel is closed once the backend exits. An error is returned if
+// the backend fails to start.
 //
 // The stdout/stderr is prefiltered by a goroutine that looks for
 // matchCmdPrev/matchCmdNext strings. If it sees them it puts
-// cmdPrev{}/cmdNext{} into commandChan.
-func launchBackend(commandChan chan<- interface{}, flags []string) (io.Writer, <-chan string) {
+// cmdPrev{}/cmdNext{} into commandChan. Similarly, stream metadata
+// matching matchICYTitle/matchICYName is put into commandChan as
+// cmdMetadata{}.
+func launchBackend(commandChan chan<- interface{}, flags []string) (*backendProcess, io.Writer, <-chan string, error) {
 	startFlags := append([]string{}, backend.startFlags...)
 	flags = append(startFlags, flags...)
 	cmd := exec.Command(backend.binary, flags...)
-	in, err := cmd.StdinPipe()
+	cmd.SysProcAttr = backendSysProcAttr()
+	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, nil, err
 	}
+	in := traceWriter{stdin}
 	out, w := io.Pipe()
 	cmd.Stdout = w
 	cmd.Stderr = w
 	err = cmd.Start()
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, nil, err
 	}
+	proc := &backendProcess{cmd: cmd, exited: make(chan struct{})}
 	outChan := make(chan string, 1000)
 	go func() {
+		cmd.Wait()
+		w.Close() // stops the scanner below
+	}()
+	go func() {
+		defer close(outChan)
+		defer close(proc.exited)
 		scanner := bufio.NewScanner(out)
 		for scanner.Scan() {
+			logTrace("backend >", "line", scanner.Text())
 			switch {
 			case strings.HasPrefix(scanner.Text(), backend.matchCmdPrev):
 				go func() {
@@ -461,6 +880,18 @@ func launchBackend(commandChan chan<- interface{}, flags []string) (io.Writer, <
 				go func() {
 					commandChan <- cmdNext{}
 				}()
+			case strings.HasPrefix(scanner.Text(), backend.matchICYTitle):
+				title := parseICYTitle(
+					scanner.Text()[len(backend.matchICYTitle):])
+				go func() {
+					commandChan <- cmdMetadata{nowPlaying: &title}
+				}()
+			case strings.HasPrefix(scanner.Text(), backend.matchICYName):
+				name := strings.TrimSpace(
+					scanner.Text()[len(backend.matchICYName):])
+				go func() {
+					commandChan <- cmdMetadata{station: &name}
+				}()
 			default:
 				outChan <- scanner.Text()
 			}
@@ -473,14 +904,15 @@ func launchBackend(commandChan chan<- interface{}, flags []string) (io.Writer, <
 		if strings.HasPrefix(line, backend.matchStartupFail) {
 			// backend has failed to parse it's command line or has
 			// otherwise failed to start
-			log.Fatalf("%s: %s", backend.binary, line)
+			cmd.Process.Kill()
+			return nil, nil, nil, fmt.Errorf("%s: %s", backend.binary, line)
 		}
 		if strings.HasPrefix(line, backend.matchStartupOK) {
 			// all good hopefully...
-			break
+			return proc, in, outChan, nil
 		}
 	}
-	return in, outChan
+	return nil, nil, nil, fmt.Errorf("%s: exited during startup", backend.binary)
 }
 
 // escapeTrack escapes a filename/URL so it is suitable to pass
@@ -506,8 +938,9 @@ func getProp(in io.Writer, outChan <-chan string, prop string) string {
 		return "playing"
 	}
 	// now deal with real properties.
+	start := time.Now()
 	fmt.Fprintf(in, backend.cmdGetProp+"\n", prop, prop)
-	var ans string
+	ans := "(unavailable)" // if the backend has exited
 	for line := range outChan {
 		if line == "ANS_ERROR=PROPERTY_UNAVAILABLE" {
 			// convert MPlayer response to MPV response
@@ -524,6 +957,7 @@ func getProp(in io.Writer, outChan <-chan string, prop string) string {
 			break
 		}
 	}
+	propLatency.observe(time.Since(start))
 	switch ans {
 	case "(unavailable)", "(error)":
 		return ans
@@ -593,17 +1027,40 @@ type cmdSeek struct {
 }
 type cmdGetPlaylist struct {
 	replyChan chan<- string
+	format    string // "xml" or "json"
 }
 type cmdGetStatus struct {
 	replyChan chan<- string
+	format    string
 }
 type cmdGetBrowse struct {
 	replyChan chan<- string
+	format    string
 	uri       string
 }
-type cmdQuit struct{}
+type cmdMove struct {
+	id     int // the track to move
+	target int // the track whose place it takes
+}
+type cmdGetTrack struct {
+	replyChan chan<- string
+	id        int // track id, or -1 for the current track
+}
+type cmdQuit struct {
+	done chan<- struct{} // closed once the backend has quit
+}
 type cmdSetPlaylist struct {
-	uri string
+	uri       string
+	enqueue   bool       // add to the playlist without playing
+	replyChan chan<- int // if non-nil, receives the new id (-1 if uri is bad)
+}
+type cmdMetadata struct {
+	nowPlaying *string // new stream title, if non-nil
+	station    *string // new station name, if non-nil
+}
+type cmdRestore struct{} // resume a restored session
+type cmdGetMetrics struct {
+	replyChan chan<- string
 }
 
 // funcPlay plays the track given by id or plays the current playlist
@@ -632,6 +1089,7 @@ func funcPlay(in io.Writer, outChan <-chan string, id int) {
 	// this is true, send it a Noop command first.
 	fmt.Fprintf(in, backend.cmdNoop+"\n")
 	fmt.Fprintf(in, backend.cmdLoadfile+"\n", escapeTrack(idTrackMap[id]))
+	nowPlaying, stationName = "", ""
 	var playing bool
 	var playingTrack string
 	for line := range outChan {
@@ -644,8 +1102,9 @@ func funcPlay(in io.Writer, outChan <-chan string, id int) {
 			playing = true
 		}
 		if line == "" && playing {
-			log.Println(
-				backend.binary + ": cannot play track: " + playingTrack)
+			logWarn("cannot play track", "backend", backend.binary,
+				"track", playingTrack)
+			tracksFailed++
 			funcNext(in, outChan)
 			return
 		}
@@ -653,6 +1112,8 @@ func funcPlay(in io.Writer, outChan <-chan string, id int) {
 			if strings.HasPrefix(line, match) {
 				// valid track found
 				stopped = false
+				tracksPlayed++
+				resumeStart(in, outChan, id)
 				return
 			}
 		}
@@ -740,9 +1201,46 @@ func funcStop(in io.Writer, outChan <-chan string) {
 	}
 }
 
+// funcMove moves track id to the position of track target in the
+// playing order (i.e. the order playlist.xml shows), shifting the
+// tracks in between along by one. If shuffle is on only the shuffle
+// state is reordered, otherwise the playlist itself is.
+func funcMove(id, target int) {
+	from, ok1 := idPosMap[id]
+	to, ok2 := idPosMap[target]
+	if !ok1 || !ok2 || id == target {
+		return
+	}
+	from, to = posToShuf[from], posToShuf[to]
+	// order holds the playlist positions in playing order
+	order := append([]int{}, shufToPos...)
+	pos := order[from]
+	order = append(order[:from], order[from+1:]...)
+	order = append(order[:to], append([]int{pos}, order[to:]...)...)
+	if shuffle {
+		for shufpos, pos := range order {
+			shufToPos[shufpos] = pos
+			posToShuf[pos] = shufpos
+		}
+	} else {
+		current := playlist[playpos]
+		newPlaylist := make([]int, len(playlist))
+		for i, pos := range order {
+			newPlaylist[i] = playlist[pos]
+		}
+		playlist = newPlaylist
+		for pos, id := range playlist {
+			idPosMap[id] = pos
+		}
+		playpos = idPosMap[current]
+	}
+	playlistVersion++
+}
+
 // funcShuffle toggles shuffling on/off and recreates the shuffle state
 // accordingly.
 func funcShuffle() {
+	playlistVersion++
 	if shuffle {
 		shuffle = false
 		for i := range playlist {
@@ -752,6 +1250,9 @@ func funcShuffle() {
 		return
 	}
 	shuffle = true
+	if len(playlist) == 0 {
+		return
+	}
 	// the set of shuffled positions. Position zero is not included
 	// since the current track will be shuffled to position zero
 	shufSet := make([]int, len(playlist)-1)
@@ -823,6 +1324,15 @@ func funcSubtitle(in io.Writer) {
 	}
 }
 
+func funcMetadata(cmd cmdMetadata) {
+	if cmd.nowPlaying != nil {
+		nowPlaying = *cmd.nowPlaying
+	}
+	if cmd.station != nil {
+		stationName = *cmd.station
+	}
+}
+
 func funcFullscreen(in io.Writer) {
 	fmt.Fprintf(in, backend.cmdFullscreen+"\n")
 }
@@ -914,7 +1424,7 @@ func funcGetPlaylistXML() string {
 	buf.WriteString(`<?xml version="1.0" encoding="utf-8" standalone="yes" ?>`)
 	err := playlistTmpl.Execute(buf, data)
 	if err != nil {
-		log.Fatal(err)
+		logError("cannot create playlist", "err", err)
 	}
 	return buf.String()
 }
@@ -969,7 +1479,11 @@ const statusTmplTxt = `
 <information>
 <category name="meta">
 <info name='title'>{{.Title}}</info>
+<info name='artist'>{{.Artist}}</info>
+<info name='now_playing'>{{.NowPlaying}}</info>
+<info name='station'>{{.Station}}</info>
 <info name='filename'>{{.Filename}}</info>
+{{if .ArtworkURL}}<info name='artwork_url'>{{.ArtworkURL}}</info>{{end}}
 </category>
 </information>
 
@@ -986,7 +1500,11 @@ type statusTmplData struct {
 	State      string `json:"state"`
 	Time       int    `json:"time"`
 	Title      string `json:"title,omitempty"`
+	Artist     string `json:"artist,omitempty"`
+	NowPlaying string `json:"now_playing,omitempty"`
+	Station    string `json:"station,omitempty"`
 	Filename   string `json:"filename,omitempty"`
+	ArtworkURL string `json:"artwork_url,omitempty"`
 }
 
 var statusTmpl = template.Must(template.New("status").Parse(statusTmplTxt))
@@ -1005,6 +1523,36 @@ func getBool(prop string) bool {
 	return false
 }
 
+// getMeta returns the title and artist of the current track. A stream
+// title of the form "Artist - Title" is split into its two parts.
+// Otherwise the title falls back to the backend's media title (if it
+// has one) and then to filename.
+func getMeta(in io.Writer, outChan <-chan string, filename string) (title, artist string) {
+	if nowPlaying != "" {
+		if i := strings.Index(nowPlaying, " - "); i >= 0 {
+			return nowPlaying[i+len(" - "):], nowPlaying[:i]
+		}
+		return nowPlaying, ""
+	}
+	if backend.propMediaTitle != "" && filename != "" {
+		switch t := getProp(in, outChan, backend.propMediaTitle); t {
+		case "", "(unavailable)", "(error)":
+		default:
+			return t, ""
+		}
+	}
+	return filename, ""
+}
+
+// artworkURL returns the URL of the /art endpoint for the current
+// track, or "" if it has no cover art.
+func artworkURL() string {
+	if len(playlist) == 0 || stopped || !hasArt(playlist[playpos]) {
+		return ""
+	}
+	return "/art?item=" + strconv.Itoa(playlist[playpos])
+}
+
 // funcGetStatusXML constructs status.xml.
 func funcGetStatusXML(in io.Writer, outChan <-chan string) string {
 	data := &statusTmplData{}
@@ -1021,14 +1569,17 @@ func funcGetStatusXML(in io.Writer, outChan <-chan string) string {
 	data.Time = getInt(get(backend.propTimePos))
 	filename := get(backend.propFilename)
 	if filename != "(unavailable)" {
-		data.Title = filename
+		data.Title, data.Artist = getMeta(in, outChan, filename)
 		data.Filename = filename
 	}
+	data.NowPlaying = nowPlaying
+	data.Station = stationName
+	data.ArtworkURL = artworkURL()
 	buf := new(bytes.Buffer)
 	buf.WriteString(`<?xml version="1.0" encoding="utf-8" standalone="yes" ?>`)
 	err := statusTmpl.Execute(buf, data)
 	if err != nil {
-		log.Fatal(err)
+		logError("cannot create status", "err", err)
 	}
 	return buf.String()
 }
@@ -1042,6 +1593,11 @@ func funcGetStatusJSON(in io.Writer, outChan <-chan string) string {
 	if filename == "(unavailable)" {
 		filename = ""
 	}
+	title, artist := getMeta(in, outChan, filename)
+	currentplid := -1
+	if len(playlist) > 0 {
+		currentplid = playlist[playpos]
+	}
 	status := map[string]interface{}{
 		"audiodelay":    0,
 		"subtitledelay": 0,
@@ -1050,7 +1606,7 @@ func funcGetStatusJSON(in io.Writer, outChan <-chan string) string {
 		"version":       "2.2.2 Weatherwax",
 		"repeat":        repeat,
 		"time":          getInt(get(backend.propTimePos)),
-		"currentplid":   playlist[playpos],
+		"currentplid":   currentplid,
 		"information": map[string]interface{}{
 			"chapters": []string{},
 			"titles":   []string{},
@@ -1058,9 +1614,13 @@ func funcGetStatusJSON(in io.Writer, outChan <-chan string) string {
 			"title":    0,
 			"category": map[string]interface{}{
 				"meta": map[string]interface{}{
-					"filename": filename,
-					"album":    "",
-					"artist":   "",
+					"filename":    filename,
+					"title":       title,
+					"album":       "",
+					"artist":      artist,
+					"now_playing": nowPlaying,
+					"station":     stationName,
+					"artwork_url": artworkURL(),
 				},
 			},
 		},
@@ -1073,24 +1633,23 @@ func funcGetStatusJSON(in io.Writer, outChan <-chan string) string {
 	}
 
 	buf, _ := json.Marshal(status)
-	// log.Println(string(buf))
 	return string(buf)
 }
 
 func funcGetBrowseXML(uri string) string {
 	u, err := url.Parse(uri)
 	if err != nil {
-		log.Fatal(err)
+		logWarn("bad browse uri", "uri", uri, "err", err)
 		return "<root></root>"
 	}
-	log.Println(u)
+	logDebug("browse not supported for XML", "uri", u)
 	return "<root></root>"
 }
 
 func funcGetBrowseJSON(uri string) string {
 	u, err := url.Parse(uri)
 	if err != nil {
-		log.Fatal(err)
+		logWarn("bad browse uri", "uri", uri, "err", err)
 		return "{\"element\":[]}"
 	}
 
@@ -1124,21 +1683,56 @@ func funcGetBrowseJSON(uri string) string {
 	buf, _ := json.Marshal(map[string]interface{}{
 		"element": elements,
 	})
-	// log.Println(string(buf))
 	return string(buf)
 }
 
-func funcSetPlaylist(in io.Writer, uri string) {
-	u, err := url.Parse(uri)
-	if err != nil {
-		log.Fatal(err)
-		return
+// funcGetTrack returns the track (file/url) given by id, or the
+// current track if id is invalid. It returns "" if there is no such
+// track.
+func funcGetTrack(id int) string {
+	if track, ok := idTrackMap[id]; ok {
+		return track
 	}
-	// Add to internal playlist
-	addPlaylistEntry(u.Path)
-	// Add to player playlist
-	fmt.Fprintf(in, backend.cmdNoop+"\n")
-	fmt.Fprintf(in, backend.cmdLoadfile+"\n", escapeTrack(idTrackMap[idCounter-1]))
+	if len(playlist) == 0 {
+		return ""
+	}
+	return idTrackMap[playlist[playpos]]
+}
+
+// funcSetPlaylist adds the track given by uri to the end of the
+// playlist and, unless enqueue is true, plays it. It returns the new
+// track's id, or -1 if uri is invalid. file: URIs are converted to
+// paths, while other URLs (e.g. of internet radio streams) are passed
+// to the backend as they are.
+func funcSetPlaylist(in io.Writer, outChan <-chan string, uri string, enqueue bool) int {
+	track := uri
+	// plain paths are used as they are, since #, ? and % are valid in
+	// file names
+	if isURI(uri) {
+		u, err := url.Parse(uri)
+		if err != nil {
+			logWarn("bad playlist uri", "uri", uri, "err", err)
+			return -1
+		}
+		if u.Scheme == "file" {
+			track = u.Path
+		}
+	}
+	addPlaylistEntry(track)
+	id := idCounter - 1
+	if !enqueue {
+		funcPlay(in, outChan, id)
+	}
+	return id
+}
+
+// isURI reports whether s is a URI (e.g. file:///a/b or http://h/a)
+// rather than a path.
+func isURI(s string) bool {
+	if strings.HasPrefix(s, "/") {
+		return false
+	}
+	return strings.HasPrefix(s, "file:") || strings.Contains(s, "://")
 }
 
 // startSelectLoop starts the select loop whose purpose is to
@@ -1150,25 +1744,40 @@ func funcSetPlaylist(in io.Writer, uri string) {
 // funcXXX or getProp functions) or manipulations of global state are
 // performed from the select loop goroutine.
 //
-// When using Unix, startSelectLoop also starts up a signal handler in
-// a goroutine to handle SIGCHLD.
-func startSelectLoop(commandChan <-chan interface{}, in io.Writer, outChan <-chan string) {
+// If the backend crashes, the select loop relaunches it with flags
+// and restores playback (see funcRestore). If it exits normally or
+// crashes too often, the select loop calls shutdown. startSelectLoop
+// also starts up a signal handler in a goroutine to call shutdown on
+// SIGINT/SIGTERM.
+func startSelectLoop(commandChan chan interface{}, flags []string, proc *backendProcess, in io.Writer, outChan <-chan string) {
 	ticker := time.NewTicker(250 * time.Millisecond)
-	startSignalHandler()
+	startSignalHandler(commandChan)
 	go func() {
+		exited, out := proc.exited, outChan
+		var ticks int
 		for {
 			select {
 			case cmdIn := <-commandChan:
 				switch cmd := cmdIn.(type) {
 				case cmdPlay:
+					resumeCheckpoint(in, outChan)
 					funcPlay(in, outChan, cmd.id)
 				case cmdNext:
+					if !stopped {
+						tracksSkipped++
+					}
+					resumeCheckpoint(in, outChan)
 					funcNext(in, outChan)
 				case cmdPrev:
+					if !stopped {
+						tracksSkipped++
+					}
+					resumeCheckpoint(in, outChan)
 					funcPrev(in, outChan)
 				case cmdPause:
 					funcPause(in, outChan)
 				case cmdStop:
+					resumeCheckpoint(in, outChan)
 					funcStop(in, outChan)
 				case cmdShuffle:
 					funcShuffle()
@@ -1190,40 +1799,131 @@ func startSelectLoop(commandChan <-chan interface{}, in io.Writer, outChan <-cha
 					funcSeek(in, cmd.val, cmd.mode)
 				case cmdGetPlaylist:
 					var playlist string = ""
-					if responseFormat == "xml" {
+					if cmd.format == "xml" {
 						playlist = funcGetPlaylistXML()
-					} else if responseFormat == "json" {
+					} else if cmd.format == "json" {
 						playlist = funcGetPlaylistJSON()
 					}
 					cmd.replyChan <- playlist
 				case cmdGetStatus:
 					var status string = ""
-					if responseFormat == "xml" {
+					if cmd.format == "xml" {
 						status = funcGetStatusXML(in, outChan)
-					} else if responseFormat == "json" {
+					} else if cmd.format == "json" {
 						status = funcGetStatusJSON(in, outChan)
 					}
 					cmd.replyChan <- status
 				case cmdGetBrowse:
 					var browsefiles string = ""
-					if responseFormat == "xml" {
+					if cmd.format == "xml" {
 						browsefiles = funcGetBrowseXML(cmd.uri)
-					} else if responseFormat == "json" {
+					} else if cmd.format == "json" {
 						browsefiles = funcGetBrowseJSON(cmd.uri)
 					}
 					cmd.replyChan <- browsefiles
+				case cmdMove:
+					funcMove(cmd.id, cmd.target)
+				case cmdRemove:
+					funcRemove(in, outChan, cmd.id)
+				case cmdGetAPIState:
+					cmd.replyChan <- funcGetAPIState(in, outChan, cmd.player)
 				case cmdSetPlaylist:
-					funcSetPlaylist(in, cmd.uri)
+					if !cmd.enqueue {
+						resumeCheckpoint(in, outChan)
+					}
+					id := funcSetPlaylist(in, outChan, cmd.uri, cmd.enqueue)
+					if cmd.replyChan != nil {
+						cmd.replyChan <- id
+					}
+				case cmdMetadata:
+					funcMetadata(cmd)
+				case cmdGetTrack:
+					cmd.replyChan <- funcGetTrack(cmd.id)
+				case cmdRestore:
+					funcRestore(in, outChan)
+				case cmdGetMetrics:
+					cmd.replyChan <- funcGetMetrics(in, outChan)
+				case cmdPing:
+					cmd.replyChan <- funcPing(proc, in, outChan)
+				case cmdSubscribe:
+					funcSubscribe(in, outChan, cmd.ch)
+				case cmdUnsubscribe:
+					funcUnsubscribe(cmd.ch)
 				case cmdQuit:
-					fmt.Fprintf(in, backend.cmdQuit+"\n")
-					os.Exit(0)
+					funcQuit(proc, in, outChan)
+					ticker.Stop()
+					close(cmd.done)
+					return
+				}
+				saveSession(false)
+				switch cmdIn.(type) {
+				case cmdGetPlaylist, cmdGetStatus, cmdGetBrowse, cmdGetTrack,
+					cmdGetMetrics, cmdPing, cmdSubscribe, cmdUnsubscribe,
+					cmdGetAPIState:
+					// nothing has changed
+				default:
+					publishEvents(in, outChan)
+				}
+			case <-exited:
+				exited = nil
+				status := proc.exitStatus()
+				if isShuttingDown() {
+					// the backend was probably sent the same signal
+					// (e.g. SIGTERM to a systemd service's cgroup), so
+					// don't restart it
+					stopped = true
+					break
+				}
+				if status == exitOK {
+					stopped = true
+					logInfo("backend exited", "backend", backend.binary)
+					shutdown(commandChan, status)
+					break
 				}
-			case <-outChan:
+				if !allowRestart() {
+					stopped = true
+					logError("backend crashed too often, giving up",
+						"backend", backend.binary,
+						"crashes", maxRestarts+1, "within", restartWindow)
+					shutdown(commandChan, status)
+					break
+				}
+				logError("backend crashed, restarting it",
+					"backend", backend.binary, "status", proc.cmd.ProcessState)
+				newProc, newIn, newOutChan, err := launchBackend(commandChan, flags)
+				if err != nil {
+					logError("cannot restart backend",
+						"backend", backend.binary, "err", err)
+					stopped = true
+					shutdown(commandChan, exitFailure)
+					break
+				}
+				proc, in, outChan = newProc, newIn, newOutChan
+				exited, out = proc.exited, outChan
+				backendRestarts++
+				funcRestore(in, outChan)
+			case _, ok := <-out:
 				// discard unused output from the backend
+				if !ok {
+					out = nil // the backend has exited
+				}
 			case <-ticker.C:
-				if !stopped && getProp(in, outChan, "state") == "stopped" {
+				// the backend appears stopped if it has crashed, so check
+				// it is still running before moving to the next track
+				if !stopped && getProp(in, outChan, "state") == "stopped" &&
+					proc.running() {
+					resumeFinished()
 					funcNext(in, outChan)
 				}
+				watchdogPing()
+				ticks++
+				if ticks%4 == 0 && !stopped {
+					recordPlayback(in, outChan)
+					saveSession(false)
+				}
+				if ticks%4 == 0 {
+					publishEvents(in, outChan)
+				}
 			}
 		}
 	}()
@@ -1231,172 +1931,342 @@ func startSelectLoop(commandChan <-chan interface{}, in io.Writer, outChan <-cha
 
 // the http server
 
-func authorized(
-	w http.ResponseWriter, r *http.Request, username, password string) bool {
-	auth := r.Header.Get("Authorization")
-	if strings.HasPrefix(auth, "Basic ") {
-		b64 := base64.StdEncoding.EncodeToString(
-			[]byte(username + ":" + password))
-		if auth[6:] == b64 {
-			return true
-		}
-	}
-	w.Header().Add("WWW-Authenticate", "Basic realm=\"authenticate\"")
-	w.WriteHeader(401)
-	return false
-}
-
-func startWebServer(commandChan chan<- interface{}, password, port string) {
-	staturl := "/requests/status." + responseFormat
-	http.HandleFunc(
-		staturl, func(w http.ResponseWriter, r *http.Request) {
-			if !authorized(w, r, "", password) {
-				return
-			}
-			switch r.FormValue("command") {
-			case "pl_play":
-				id := -1
-				if idStr := r.FormValue("id"); idStr != "" {
-					if idVal, err := strconv.Atoi(idStr); err == nil {
-						id = idVal
-					}
+func startWebServer(commandChan chan<- interface{}, port string) {
+	// the VLC remote uses responseFormat, and the web UI uses JSON
+	formats := []string{responseFormat}
+	if responseFormat != "json" {
+		formats = append(formats, "json")
+	}
+	for _, format := range formats {
+		format := format
+		staturl := "/requests/status." + format
+		http.HandleFunc(
+			staturl, func(w http.ResponseWriter, r *http.Request) {
+				u := authorized(w, r, roleReadOnly)
+				if u == nil {
+					return
 				}
-				commandChan <- cmdPlay{id: id}
-			case "pl_next":
-				commandChan <- cmdNext{}
-			case "pl_previous":
-				commandChan <- cmdPrev{}
-			case "pl_pause":
-				commandChan <- cmdPause{}
-			case "pl_stop":
-				commandChan <- cmdStop{}
-			case "pl_random":
-				commandChan <- cmdShuffle{}
-			case "pl_loop":
-				commandChan <- cmdLoop{}
-			case "pl_repeat":
-				commandChan <- cmdRepeat{}
-			case "key":
-				switch r.FormValue("val") {
-				case "aspect-ratio":
-					commandChan <- cmdAspect{}
-				case "audio-track":
-					commandChan <- cmdAudio{}
-				case "subtitle-track":
-					commandChan <- cmdSubtitle{}
-				case "quit":
-					commandChan <- cmdQuit{}
+				if r.FormValue("command") != "" && u.role < roleFull {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
 				}
-			case "fullscreen":
-				commandChan <- cmdFullscreen{}
-			case "volume":
-				val := r.FormValue("val")
-				var off int
-				mode := volAbs
-				percent := false
-				if len(val) > 0 && val[len(val)-1] == '%' {
-					val = val[:len(val)-1]
-					percent = true
+				if r.FormValue("command") != "" && !sameSite(w, r) {
+					return
 				}
-				if len(val) > 0 {
-					switch val[0] {
-					// note: we get ' ' when + is not URL-encoded
-					case '+', '-', ' ':
-						// relative mode
-						mode = volRel
-						off = 1
-					default:
-						// absolute mode
+				countRequest("status", r.FormValue("command"))
+				switch r.FormValue("command") {
+				case "pl_play":
+					id := -1
+					if idStr := r.FormValue("id"); idStr != "" {
+						if idVal, err := strconv.Atoi(idStr); err == nil {
+							id = idVal
+						}
+					}
+					commandChan <- cmdPlay{id: id}
+				case "pl_next":
+					commandChan <- cmdNext{}
+				case "pl_previous":
+					commandChan <- cmdPrev{}
+				case "pl_pause":
+					commandChan <- cmdPause{}
+				case "pl_stop":
+					commandChan <- cmdStop{}
+				case "pl_random":
+					commandChan <- cmdShuffle{}
+				case "pl_loop":
+					commandChan <- cmdLoop{}
+				case "pl_repeat":
+					commandChan <- cmdRepeat{}
+				case "key":
+					switch r.FormValue("val") {
+					case "aspect-ratio":
+						commandChan <- cmdAspect{}
+					case "audio-track":
+						commandChan <- cmdAudio{}
+					case "subtitle-track":
+						commandChan <- cmdSubtitle{}
+					case "quit":
+						shutdown(commandChan, exitOK)
+					}
+				case "fullscreen":
+					commandChan <- cmdFullscreen{}
+				case "volume":
+					val := r.FormValue("val")
+					var off int
+					mode := volAbs
+					percent := false
+					if len(val) > 0 && val[len(val)-1] == '%' {
+						val = val[:len(val)-1]
+						percent = true
 					}
-					if i, err := strconv.Atoi(val[off:]); err == nil {
-						if percent {
-							i = i * 320 / 100
+					if len(val) > 0 {
+						switch val[0] {
+						// note: we get ' ' when + is not URL-encoded
+						case '+', '-', ' ':
+							// relative mode
+							mode = volRel
+							off = 1
+						default:
+							// absolute mode
 						}
-						if val[0] == '-' {
-							i = -i
+						if i, err := strconv.Atoi(val[off:]); err == nil {
+							if percent {
+								i = i * 320 / 100
+							}
+							if val[0] == '-' {
+								i = -i
+							}
+							commandChan <- cmdVolume{val: i, mode: mode}
 						}
-						commandChan <- cmdVolume{val: i, mode: mode}
 					}
-				}
-			case "seek":
-				val := r.FormValue("val")
-				var off int
-				mode := seekAbs
-				if len(val) > 0 && val[len(val)-1] == '%' {
-					// percent mode
-					val = val[:len(val)-1]
-					mode = seekPct
-				}
-				if len(val) > 0 &&
-					(val[len(val)-1] == 's' || val[len(val)-1] == 'S') {
-					val = val[:len(val)-1]
-				}
-				if len(val) > 0 {
-					switch val[0] {
-					// note: we get ' ' when + is not URL-encoded
-					case '+', '-', ' ':
-						// relative mode
-						mode = seekRel
-						off = 1
-					default:
-						// absolute mode
+				case "seek":
+					val := r.FormValue("val")
+					var off int
+					mode := seekAbs
+					if len(val) > 0 && val[len(val)-1] == '%' {
+						// percent mode
+						val = val[:len(val)-1]
+						mode = seekPct
 					}
-					if i, err := strconv.Atoi(val[off:]); err == nil {
-						if val[0] == '-' {
-							i = -i
+					if len(val) > 0 &&
+						(val[len(val)-1] == 's' || val[len(val)-1] == 'S') {
+						val = val[:len(val)-1]
+					}
+					if len(val) > 0 {
+						switch val[0] {
+						// note: we get ' ' when + is not URL-encoded
+						case '+', '-', ' ':
+							// relative mode
+							mode = seekRel
+							off = 1
+						default:
+							// absolute mode
+						}
+						if i, err := strconv.Atoi(val[off:]); err == nil {
+							if val[0] == '-' {
+								i = -i
+							}
+							commandChan <- cmdSeek{val: i, mode: mode}
 						}
-						commandChan <- cmdSeek{val: i, mode: mode}
+					}
+				case "pl_move":
+					id, err1 := strconv.Atoi(r.FormValue("psid"))
+					target, err2 := strconv.Atoi(r.FormValue("id"))
+					if err1 == nil && err2 == nil {
+						commandChan <- cmdMove{id: id, target: target}
+					}
+				case "in_play", "in_enqueue":
+					if inPath := r.FormValue("input"); inPath != "" {
+						commandChan <- cmdSetPlaylist{uri: inPath,
+							enqueue: r.FormValue("command") == "in_enqueue"}
 					}
 				}
-			case "in_play":
-				if inPath := r.FormValue("input"); inPath != "" {
-					commandChan <- cmdSetPlaylist{uri: inPath}
+				// allways output status after operation
+				replyChan := make(chan string, 1)
+				commandChan <- cmdGetStatus{replyChan: replyChan, format: format}
+				io.WriteString(w, <-replyChan)
+			})
+		plurl := "/requests/playlist." + format
+		http.HandleFunc(
+			plurl,
+			func(w http.ResponseWriter, r *http.Request) {
+				if authorized(w, r, roleReadOnly) == nil {
+					return
 				}
-			}
-			// allways output status after operation
-			replyChan := make(chan string, 1)
-			commandChan <- cmdGetStatus{replyChan: replyChan}
-			io.WriteString(w, <-replyChan)
-		})
-	plurl := "/requests/playlist." + responseFormat
+				countRequest("playlist", "")
+				// output playlist
+				replyChan := make(chan string, 1)
+				commandChan <- cmdGetPlaylist{replyChan: replyChan, format: format}
+				io.WriteString(w, <-replyChan)
+			})
+		brwurl := "/requests/browse." + format
+		http.HandleFunc(
+			brwurl,
+			func(w http.ResponseWriter, r *http.Request) {
+				if authorized(w, r, roleFull) == nil {
+					return
+				}
+				countRequest("browse", "")
+				// output browse data
+				replyChan := make(chan string, 1)
+				commandChan <- cmdGetBrowse{replyChan: replyChan, format: format,
+					uri: r.URL.Query().Get("uri")}
+				io.WriteString(w, <-replyChan)
+			})
+	}
 	http.HandleFunc(
-		plurl,
+		"/art",
 		func(w http.ResponseWriter, r *http.Request) {
-			if !authorized(w, r, "", password) {
+			if authorized(w, r, roleReadOnly) == nil {
 				return
 			}
-			// output playlist
+			id := -1
+			if idStr := r.FormValue("item"); idStr != "" {
+				if idVal, err := strconv.Atoi(idStr); err == nil {
+					id = idVal
+				}
+			}
 			replyChan := make(chan string, 1)
-			commandChan <- cmdGetPlaylist{replyChan: replyChan}
-			io.WriteString(w, <-replyChan)
+			commandChan <- cmdGetTrack{replyChan: replyChan, id: id}
+			art, err := findArt(<-replyChan)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", art.contentType)
+			w.Header().Set("ETag", art.etag)
+			w.Header().Set("Cache-Control", "private, max-age=3600")
+			http.ServeContent(w, r, "", art.modTime, bytes.NewReader(art.data))
 		})
-	brwurl := "/requests/browse." + responseFormat
+	startHealthHandlers(commandChan)
+	startWebUI()
+	startAPI(commandChan)
 	http.HandleFunc(
-		brwurl,
+		"/events",
 		func(w http.ResponseWriter, r *http.Request) {
-			if !authorized(w, r, "", password) {
+			if authorized(w, r, roleReadOnly) == nil {
 				return
 			}
-			// output browse data
-			replyChan := make(chan string, 1)
-			commandChan <- cmdGetBrowse{replyChan: replyChan, uri: r.URL.Query().Get("uri")}
-			io.WriteString(w, <-replyChan)
+			countRequest("events", "")
+			serveEvents(commandChan, w, r)
 		})
-	if http.ListenAndServe(":"+port, nil) != nil {
-		log.Fatalf("mplayer-rc: failed to start http server")
+	if kodiEnabled {
+		startKodi(commandChan)
+	}
+	if metricsEnabled {
+		http.HandleFunc(
+			"/metrics",
+			func(w http.ResponseWriter, r *http.Request) {
+				if authorized(w, r, roleReadOnly) == nil {
+					return
+				}
+				replyChan := make(chan string, 1)
+				commandChan <- cmdGetMetrics{replyChan: replyChan}
+				w.Header().Set("Content-Type", metricsContentType)
+				io.WriteString(w, <-replyChan)
+			})
+	}
+	// open all listeners before serving so that a bad address is
+	// reported straight away
+	type server struct {
+		*http.Server
+		l     net.Listener
+		https bool
+	}
+	var servers []server
+	add := func(a listenAddr, https bool) {
+		l, err := listen(a)
+		if err != nil {
+			log.Fatalf("mplayer-rc: failed to start http server: %v", err)
+		}
+		s := &http.Server{Handler: accessLog(http.DefaultServeMux)}
+		addWebServer(s)
+		servers = append(servers, server{Server: s, l: l, https: https})
+	}
+	if len(activatedListeners) > 0 {
+		// sockets passed in by systemd replace listenSpecs. With
+		// -tls-port, only those named "https" serve HTTPS.
+		for _, a := range activatedListeners {
+			s := &http.Server{Handler: accessLog(http.DefaultServeMux)}
+			addWebServer(s)
+			https := useTLS && (tlsPort == "" || a.name == "https")
+			servers = append(servers, server{Server: s, l: a, https: https})
+		}
+		listenSpecs = nil
+	}
+	for _, spec := range listenSpecs {
+		a := parseListen(spec, port)
+		add(a, useTLS && tlsPort == "" && !a.isUnix())
+		if useTLS && tlsPort != "" && !a.isUnix() {
+			// HTTPS is served on the same host at tlsPort, even if
+			// spec gives a port
+			host, _, _ := net.SplitHostPort(a.addr)
+			add(listenAddr{
+				network: "tcp", addr: net.JoinHostPort(host, tlsPort)}, true)
+		}
 	}
+	var mpdAddr net.Addr
+	if mpdListen != "" {
+		mpdAddr = startMPD(commandChan)
+	}
+	if mprisEnabled {
+		startMPRIS(commandChan)
+	}
+	if upnpListen != "" {
+		startUPnP(commandChan)
+	}
+	if mdnsEnabled {
+		// advertise the first listener of each kind
+		var httpPort, httpsPort int
+		for _, s := range servers {
+			switch port := mdnsPort(s.l.Addr()); {
+			case port == 0:
+			case s.https && httpsPort == 0:
+				httpsPort = port
+			case !s.https && httpPort == 0:
+				httpPort = port
+			}
+		}
+		startMDNS(httpPort, httpsPort, mpdAddr)
+	}
+	startInput(commandChan)
+	sdNotify("READY=1")
+	errChan := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s server) {
+			if s.https {
+				errChan <- s.ServeTLS(s.l, tlsCert, tlsKey)
+			} else {
+				errChan <- s.Serve(s.l)
+			}
+		}(s)
+	}
+	if err := <-errChan; err != http.ErrServerClosed {
+		log.Fatalf("mplayer-rc: http server: %v", err)
+	}
+	// shutdown is in progress and will exit
+	select {}
 }
 
 // main
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		processConfig()
+		os.Exit(runCtl(os.Args[2:]))
+	}
+	initSystemd()
 	processConfig()
 	args := setBackend()
 	flags := processFlags(args)
+	// set up logging first so that everything below is logged
+	if confLogLevel != "" {
+		level, err := parseLevel(confLogLevel)
+		if err != nil {
+			log.Fatalf("mplayer-rc: log-level: %v", err)
+		}
+		logLevel = level
+	}
+	if flagVerbose > 0 {
+		logLevel = levelInfo + flagVerbose
+		if logLevel > levelTrace {
+			logLevel = levelTrace
+		}
+	}
+	logAccess = confAccessLog
+	logFile := confLogFile
+	if flagLogFile != "" {
+		logFile = flagLogFile
+	}
+	if logFile != "" {
+		if err := openLogFile(logFile); err != nil {
+			log.Fatalf("mplayer-rc: %v", err)
+		}
+	}
 	// set some variables from config file
 	remapCommands = confRemapCommands
 	responseFormat = confFormat
-	password, port := confPassword, confPort
+	password, passwordHash, port := confPassword, confPasswordHash, confPort
 	// override with flags if appropriate
 	if flagRemapCommands {
 		remapCommands = true
@@ -1405,13 +2275,152 @@ func main() {
 		responseFormat = flagFormat
 	}
 	if flagPassword != "" {
-		password = flagPassword
+		password, passwordHash = flagPassword, ""
 	}
 	if flagPort != "" {
 		port = flagPort
 	}
+	useTLS, tlsCert, tlsKey, tlsPort = confTLS, confTLSCert, confTLSKey, confTLSPort
+	if flagTLS {
+		useTLS = true
+	}
+	if flagTLSCert != "" {
+		tlsCert = flagTLSCert
+	}
+	if flagTLSKey != "" {
+		tlsKey = flagTLSKey
+	}
+	if flagTLSPort != "" {
+		tlsPort = flagTLSPort
+	}
+	if tlsCert != "" || tlsPort != "" {
+		useTLS = true
+	}
+	if useTLS && tlsCert == "" {
+		var err error
+		tlsCert, tlsKey, err = selfSignedCert()
+		if err != nil {
+			log.Fatalf("mplayer-rc: cannot create certificate: %v", err)
+		}
+	}
+	resumeEnabled = confResume || flagResume
+	resumeByHash = confResumeByHash
+	if confResumeMinLen != "" {
+		if i, err := strconv.Atoi(confResumeMinLen); err == nil {
+			resumeMinLength = i
+		}
+	}
+	resumeExclude = map[string]bool{}
+	for _, ext := range strings.Split(confResumeExclude, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if ext[0] != '.' {
+			ext = "." + ext
+		}
+		resumeExclude[ext] = true
+	}
+	if resumeEnabled {
+		loadResumeStore()
+	}
+	sessionEnabled = confSession || flagResumeSession
+	metricsEnabled = confMetrics
+	kodiEnabled = confKodi
+	mprisEnabled = confMPRIS
+	switch strings.ToLower(confMPD) {
+	case "", "no", "0", "false":
+	case "yes", "1", "true":
+		mpdListen = ":" + mpdDefaultPort
+	default:
+		mpdListen = confMPD
+		if _, err := strconv.Atoi(confMPD); err == nil {
+			mpdListen = ":" + confMPD // just a port
+		}
+	}
+	switch strings.ToLower(confUPnP) {
+	case "", "no", "0", "false":
+	case "yes", "1", "true":
+		upnpListen = ":" + upnpDefaultPort
+	default:
+		upnpListen = confUPnP
+		if _, err := strconv.Atoi(confUPnP); err == nil {
+			upnpListen = ":" + confUPnP // just a port
+		}
+	}
+	upnpName = confUPnPName
+	mdnsEnabled = confMDNS
+	mdnsName = confMDNSName
+	inputDevices = confInput
+	switch strings.ToLower(confLIRC) {
+	case "", "no", "0", "false":
+	case "yes", "1", "true":
+		lircSocket = lircDefaultSocket
+	default:
+		lircSocket = confLIRC
+	}
+	if len(inputDevices) > 0 || lircSocket != "" {
+		keys := confKeys
+		if keys == nil {
+			keys = defaultKeys
+		}
+		var err error
+		if inputKeys, err = parseKeyMap(keys); err != nil {
+			log.Fatalf("mplayer-rc: %v", err)
+		}
+	}
+	listenSpecs = confListen
+	if flagListen != "" {
+		listenSpecs = splitList(flagListen)
+	}
+	if len(listenSpecs) == 0 {
+		listenSpecs = []string{""}
+	}
+	if useTLS && tlsKey == "" {
+		// allow the key to be bundled with the certificate
+		tlsKey = tlsCert
+	}
+	// set up users. The VLC remote uses the empty username.
+	switch {
+	case passwordHash != "":
+		if !isPasswordHash(passwordHash) {
+			log.Fatalf("mplayer-rc: password-hash must be a bcrypt or argon2 hash")
+		}
+		users[""] = &user{hash: passwordHash, role: roleFull}
+	case password != "":
+		users[""] = &user{password: password, role: roleFull}
+	}
+	for _, line := range confUsers {
+		u, err := parseUser(line)
+		if err != nil {
+			log.Fatalf("mplayer-rc: %v", err)
+		}
+		users[u.name] = u
+	}
+	// set up client access lists
+	for _, s := range confAllow {
+		n, err := parseNet(s)
+		if err != nil {
+			log.Fatalf("mplayer-rc: allow: %v", err)
+		}
+		allowNets = append(allowNets, n)
+	}
+	for _, s := range confDeny {
+		n, err := parseNet(s)
+		if err != nil {
+			log.Fatalf("mplayer-rc: deny: %v", err)
+		}
+		denyNets = append(denyNets, n)
+	}
+	if confHostsFile != "" {
+		nets, err := readHostsFile(confHostsFile)
+		if err != nil {
+			log.Fatalf("mplayer-rc: %v", err)
+		}
+		allowNets = append(allowNets, nets...)
+	}
 	// if password not set, exit
-	if password == "" {
+	if len(users) == 0 {
 		fmt.Fprint(os.Stderr,
 			`MPlayer-RC needs to have a password which is used to authorize
 the VLC Remote. You can specify the password using the command
@@ -1423,11 +2432,19 @@ in the file ~/.mplayer-rc.
 `)
 		os.Exit(1)
 	}
+	backendVersion = probeBackendVersion()
 	// create command channel
 	commandChan := make(chan interface{}, 1000)
 	// start backend, select loop and web server
-	in, outChan := launchBackend(commandChan, flags)
-	startSelectLoop(commandChan, in, outChan)
-	commandChan <- cmdPlay{id: -1} // initial play cmd
-	startWebServer(commandChan, password, port)
+	proc, in, outChan, err := launchBackend(commandChan, flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	startSelectLoop(commandChan, flags, proc, in, outChan)
+	if flagResumeSession {
+		commandChan <- cmdRestore{}
+	} else {
+		commandChan <- cmdPlay{id: -1} // initial play cmd
+	}
+	startWebServer(commandChan, port)
 }
@@ -0,0 +1,470 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// A minimal mDNS responder (RFC 6762) advertising mplayer-rc with
+// DNS-SD (RFC 6763), so that remotes on the LAN can find it without
+// being given its address. The web server is advertised as
+// _http._tcp (or _https._tcp) with TXT records marking it as a VLC
+// compatible endpoint, and the MPD server, if any, as _mpd._tcp.
+//
+// Names are not probed for conflicts, so instances on the same LAN
+// should be given distinct mdns-name settings.
+
+// the mDNS settings, set by main
+var (
+	mdnsEnabled bool
+	mdnsName    string // the service instance name, or "" for the default
+)
+
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const (
+	mdnsTypeA    = 1
+	mdnsTypePTR  = 12
+	mdnsTypeTXT  = 16
+	mdnsTypeAAAA = 28
+	mdnsTypeSRV  = 33
+	mdnsTypeANY  = 255
+
+	mdnsClassIN     = 1
+	mdnsCacheFlush  = 0x8000 // in a record's class
+	mdnsUnicastResp = 0x8000 // in a question's class
+
+	mdnsHostTTL  = 120  // for records naming the host
+	mdnsOtherTTL = 4500 // for the others
+)
+
+// mdnsService is a service advertised.
+type mdnsService struct {
+	typ  string // e.g. "_http._tcp"
+	port int
+	txt  []string
+}
+
+// mdnsRecord is a resource record.
+type mdnsRecord struct {
+	name   []string // labels, without the root
+	rtype  uint16
+	unique bool // sets the cache-flush bit
+	ttl    uint32
+	rdata  []byte
+	target []string // the name rdata refers to, if any
+}
+
+// mdnsIface is an interface the responder runs on.
+type mdnsIface struct {
+	ifi  net.Interface
+	nets []*net.IPNet
+	conn *net.UDPConn
+}
+
+// startMDNS starts advertising the web server on httpPort and
+// httpsPort and the MPD server on mpdAddr. A zero port or nil
+// address is not advertised.
+func startMDNS(httpPort, httpsPort int, mpdAddr net.Addr) {
+	txt := []string{"txtvers=1", "path=/", "vlc=1",
+		"api=/requests/status.xml", "product=MPlayer-RC",
+		"version=" + upnpVersion()}
+	var services []mdnsService
+	if httpPort != 0 {
+		services = append(services, mdnsService{"_http._tcp", httpPort, txt})
+	}
+	if httpsPort != 0 {
+		services = append(services, mdnsService{"_https._tcp", httpsPort, txt})
+	}
+	if port := mdnsPort(mpdAddr); port != 0 {
+		services = append(services, mdnsService{"_mpd._tcp", port, nil})
+	}
+	if len(services) == 0 {
+		logWarn("mdns: nothing to advertise")
+		return
+	}
+	all, err := net.Interfaces()
+	if err != nil {
+		logWarn("mdns: cannot list interfaces", "err", err)
+		return
+	}
+	var ifaces []*mdnsIface
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 ||
+			ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		mi := &mdnsIface{ifi: ifi}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				mi.nets = append(mi.nets, n)
+			}
+		}
+		if mdnsIfaceIPv4(mi) == nil {
+			continue
+		}
+		mi.conn, err = net.ListenMulticastUDP("udp4", &mi.ifi, mdnsAddr)
+		if err != nil {
+			logWarn("mdns: cannot join group", "iface", ifi.Name, "err", err)
+			continue
+		}
+		ifaces = append(ifaces, mi)
+	}
+	if len(ifaces) == 0 {
+		logWarn("mdns: no multicast interfaces, advertisement disabled")
+		return
+	}
+	host := mdnsHostName()
+	logInfo("mdns advertising", "name", mdnsInstance(), "host", strings.Join(host, "."))
+	for _, mi := range ifaces {
+		records := mdnsRecords(services, host, mi)
+		go mdnsServe(mi, records)
+		go mdnsAnnounce(mi, records)
+	}
+}
+
+// mdnsInstance returns the service instance name.
+func mdnsInstance() string {
+	if mdnsName != "" {
+		return mdnsName
+	}
+	return defaultServiceName()
+}
+
+// mdnsHostName returns the host's name in the .local domain.
+func mdnsHostName() []string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "mplayer-rc"
+	}
+	return []string{strings.SplitN(host, ".", 2)[0], "local"}
+}
+
+func mdnsIfaceIPv4(mi *mdnsIface) net.IP {
+	for _, n := range mi.nets {
+		if ip := n.IP.To4(); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// mdnsRecords returns the records advertised on interface mi.
+func mdnsRecords(services []mdnsService, host []string, mi *mdnsIface) []mdnsRecord {
+	var records []mdnsRecord
+	meta := []string{"_services", "_dns-sd", "_udp", "local"}
+	for _, s := range services {
+		typ := append(strings.Split(s.typ, "."), "local")
+		inst := append([]string{mdnsInstance()}, typ...)
+		records = append(records,
+			mdnsRecord{name: meta, rtype: mdnsTypePTR, ttl: mdnsOtherTTL,
+				rdata: mdnsEncodeName(typ), target: typ},
+			mdnsRecord{name: typ, rtype: mdnsTypePTR, ttl: mdnsOtherTTL,
+				rdata: mdnsEncodeName(inst), target: inst})
+		srv := make([]byte, 6)
+		binary.BigEndian.PutUint16(srv[4:], uint16(s.port))
+		records = append(records, mdnsRecord{name: inst, rtype: mdnsTypeSRV,
+			unique: true, ttl: mdnsHostTTL,
+			rdata: append(srv, mdnsEncodeName(host)...), target: host})
+		var txt []byte
+		for _, t := range s.txt {
+			txt = append(txt, byte(len(t)))
+			txt = append(txt, t...)
+		}
+		if len(txt) == 0 {
+			txt = []byte{0}
+		}
+		records = append(records, mdnsRecord{name: inst, rtype: mdnsTypeTXT,
+			unique: true, ttl: mdnsOtherTTL, rdata: txt})
+	}
+	for _, n := range mi.nets {
+		if ip := n.IP.To4(); ip != nil {
+			records = append(records, mdnsRecord{name: host, rtype: mdnsTypeA,
+				unique: true, ttl: mdnsHostTTL, rdata: ip})
+		} else if !n.IP.IsLinkLocalUnicast() {
+			records = append(records, mdnsRecord{name: host, rtype: mdnsTypeAAAA,
+				unique: true, ttl: mdnsHostTTL, rdata: n.IP.To16()})
+		}
+	}
+	return records
+}
+
+// mdnsServe answers the queries received on mi from hosts on its
+// networks. As every socket joined to the group sees every query,
+// this makes each query answered once, on the right interface.
+func mdnsServe(mi *mdnsIface, records []mdnsRecord) {
+	buf := make([]byte, 9000)
+	go func() {
+		<-shutdownStarted
+		mdnsSend(mi, mdnsAddr, mdnsResponse(0, nil, mdnsGoodbye(records), nil, false))
+		mi.conn.Close()
+	}()
+	for {
+		n, src, err := mi.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !isShuttingDown() {
+				logWarn("mdns: read failed", "iface", mi.ifi.Name, "err", err)
+			}
+			return
+		}
+		if !mdnsOnLink(mi, src.IP) || !clientAllowed(src.IP) {
+			continue
+		}
+		mdnsQuery(mi, records, buf[:n], src)
+	}
+}
+
+func mdnsOnLink(mi *mdnsIface, ip net.IP) bool {
+	for _, n := range mi.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// mdnsQuery answers query msg from src.
+func mdnsQuery(mi *mdnsIface, records []mdnsRecord, msg []byte, src *net.UDPAddr) {
+	if len(msg) < 12 {
+		return
+	}
+	id := binary.BigEndian.Uint16(msg)
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 != 0 {
+		return // a response
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	off := 12
+	// a query not from port 5353 is a legacy unicast query, which is
+	// answered like a normal DNS query
+	legacy := src.Port != mdnsAddr.Port
+	unicast := legacy
+	var questions [][]byte
+	var answers []mdnsRecord
+	seen := map[int]bool{}
+	for i := 0; i < qdcount; i++ {
+		name, next, err := mdnsParseName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return
+		}
+		qtype := binary.BigEndian.Uint16(msg[next:])
+		qclass := binary.BigEndian.Uint16(msg[next+2:])
+		off = next + 4
+		if qclass&mdnsUnicastResp != 0 {
+			unicast = true
+		}
+		if c := qclass &^ mdnsUnicastResp; c != mdnsClassIN && c != mdnsTypeANY {
+			continue
+		}
+		matched := false
+		for j, r := range records {
+			if mdnsNameEqual(r.name, name) && (qtype == r.rtype || qtype == mdnsTypeANY) {
+				matched = true
+				if !seen[j] {
+					seen[j] = true
+					answers = append(answers, r)
+				}
+			}
+		}
+		if matched && legacy {
+			// the question is echoed with its own name encoding
+			q := mdnsEncodeName(name)
+			q = append(q, msg[next:next+4]...)
+			questions = append(questions, q)
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+	// the records answers refer to go in the additional section
+	var extra []mdnsRecord
+	for i := 0; i < len(answers)+len(extra); i++ {
+		var r mdnsRecord
+		if i < len(answers) {
+			r = answers[i]
+		} else {
+			r = extra[i-len(answers)]
+		}
+		if r.target == nil {
+			continue
+		}
+		for j, t := range records {
+			if !seen[j] && mdnsNameEqual(t.name, r.target) {
+				seen[j] = true
+				extra = append(extra, t)
+			}
+		}
+	}
+	if !legacy {
+		id = 0
+	}
+	resp := mdnsResponse(id, questions, answers, extra, !legacy)
+	if unicast {
+		mdnsSend(mi, src, resp)
+	} else {
+		mdnsSend(mi, mdnsAddr, resp)
+	}
+}
+
+// mdnsAnnounce sends the records unsolicited at start, twice as the
+// RFC recommends.
+func mdnsAnnounce(mi *mdnsIface, records []mdnsRecord) {
+	resp := mdnsResponse(0, nil, records, nil, true)
+	for i := 0; i < 2; i++ {
+		mdnsSend(mi, mdnsAddr, resp)
+		select {
+		case <-time.After(time.Second):
+		case <-shutdownStarted:
+			return
+		}
+	}
+}
+
+// mdnsGoodbye returns records with a zero TTL, which withdraws them.
+func mdnsGoodbye(records []mdnsRecord) []mdnsRecord {
+	var bye []mdnsRecord
+	for _, r := range records {
+		r.ttl = 0
+		bye = append(bye, r)
+	}
+	return bye
+}
+
+func mdnsSend(mi *mdnsIface, to *net.UDPAddr, msg []byte) {
+	if _, err := mi.conn.WriteToUDP(msg, to); err != nil {
+		logDebug("mdns: send failed", "iface", mi.ifi.Name, "err", err)
+	}
+}
+
+// mdnsResponse builds a response message. The cache-flush bit is only
+// set on unique records if flush is set, as it must not be in legacy
+// unicast responses.
+func mdnsResponse(id uint16, questions [][]byte, answers, extra []mdnsRecord, flush bool) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // response, authoritative
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(questions)))
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(msg[10:], uint16(len(extra)))
+	for _, q := range questions {
+		msg = append(msg, q...)
+	}
+	for _, r := range append(answers, extra...) {
+		msg = append(msg, mdnsEncodeName(r.name)...)
+		class := uint16(mdnsClassIN)
+		if r.unique && flush {
+			class |= mdnsCacheFlush
+		}
+		ttl := r.ttl
+		if !flush && ttl > 10 {
+			ttl = 10 // legacy unicast responses have short TTLs
+		}
+		b := make([]byte, 10)
+		binary.BigEndian.PutUint16(b, r.rtype)
+		binary.BigEndian.PutUint16(b[2:], class)
+		binary.BigEndian.PutUint32(b[4:], ttl)
+		binary.BigEndian.PutUint16(b[8:], uint16(len(r.rdata)))
+		msg = append(msg, b...)
+		msg = append(msg, r.rdata...)
+	}
+	return msg
+}
+
+func mdnsEncodeName(labels []string) []byte {
+	var b []byte
+	for _, l := range labels {
+		if len(l) > 63 {
+			l = l[:63]
+		}
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+var errMDNSName = errors.New("mdns: bad name")
+
+// mdnsParseName parses the name at off in msg, following compression
+// pointers, and returns it and the offset after it.
+func mdnsParseName(msg []byte, off int) ([]string, int, error) {
+	var labels []string
+	next := -1
+	for hops := 0; hops < 32; hops++ {
+		if off >= len(msg) {
+			return nil, 0, errMDNSName
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return labels, next, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return nil, 0, errMDNSName
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		case n&0xc0 != 0:
+			return nil, 0, errMDNSName
+		default:
+			if off+1+n > len(msg) {
+				return nil, 0, errMDNSName
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+	return nil, 0, errMDNSName
+}
+
+func mdnsNameEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// mdnsPort returns the port of a, or 0 if it is not a TCP address
+// reachable from other hosts.
+func mdnsPort(a net.Addr) int {
+	t, ok := a.(*net.TCPAddr)
+	if !ok || t.IP.IsLoopback() {
+		return 0
+	}
+	return t.Port
+}
@@ -0,0 +1,178 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metricsEnabled, set by main, enables the /metrics endpoint.
+var metricsEnabled bool
+
+// the HTTP metrics, updated by the web server goroutines
+var httpMetrics = struct {
+	sync.Mutex
+	requests     map[string]int // command -> requests
+	authFailures int
+}{requests: map[string]int{}}
+
+// knownCommands are the VLC commands counted individually by
+// mplayer_rc_http_requests_total. Others are counted as "other" so
+// that clients cannot create arbitrarily many series.
+var knownCommands = map[string]bool{
+	"pl_play": true, "pl_next": true, "pl_previous": true,
+	"pl_pause": true, "pl_stop": true, "pl_random": true,
+	"pl_loop": true, "pl_repeat": true, "key": true, "fullscreen": true,
+	"volume": true, "seek": true, "in_play": true, "in_enqueue": true,
+	"pl_move": true,
+}
+
+// countRequest counts a request for command, or for endpoint if
+// command is empty (e.g. a plain status or playlist request).
+func countRequest(endpoint, command string) {
+	switch {
+	case command == "":
+		command = endpoint
+	case !knownCommands[command]:
+		command = "other"
+	}
+	httpMetrics.Lock()
+	httpMetrics.requests[command]++
+	httpMetrics.Unlock()
+}
+
+func countAuthFailure() {
+	httpMetrics.Lock()
+	httpMetrics.authFailures++
+	httpMetrics.Unlock()
+}
+
+// the backend metrics. Like the playlist state they are only
+// accessed from the select loop.
+var (
+	tracksPlayed    int
+	tracksSkipped   int // by Next/Prev while a track was playing
+	tracksFailed    int
+	backendRestarts int
+	// the histogram of getProp round trip times
+	propLatency = newHistogram(
+		.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1)
+)
+
+// histogram is a Prometheus style cumulative histogram.
+type histogram struct {
+	bounds []float64 // upper bounds of the buckets, excluding +Inf
+	counts []int     // observations <= each bound
+	count  int
+	sum    float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int, len(bounds))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// write writes h in the text exposition format.
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, b := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, b, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// writeMetric writes a metric without labels.
+func writeMetric(w io.Writer, name, typ, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n",
+		name, help, name, typ, name, value)
+}
+
+// funcGetMetrics constructs the /metrics response in the Prometheus
+// text exposition format.
+func funcGetMetrics(in io.Writer, outChan <-chan string) string {
+	buf := new(bytes.Buffer)
+
+	httpMetrics.Lock()
+	commands := make([]string, 0, len(httpMetrics.requests))
+	for c := range httpMetrics.requests {
+		commands = append(commands, c)
+	}
+	sort.Strings(commands)
+	fmt.Fprintf(buf, "# HELP mplayer_rc_http_requests_total HTTP requests by VLC command or endpoint.\n")
+	fmt.Fprintf(buf, "# TYPE mplayer_rc_http_requests_total counter\n")
+	for _, c := range commands {
+		fmt.Fprintf(buf, "mplayer_rc_http_requests_total{command=%q} %d\n",
+			c, httpMetrics.requests[c])
+	}
+	writeMetric(buf, "mplayer_rc_auth_failures_total", "counter",
+		"Failed HTTP logins.", httpMetrics.authFailures)
+	httpMetrics.Unlock()
+
+	propLatency.write(buf, "mplayer_rc_backend_request_duration_seconds",
+		"Round trip time of property requests to the backend.")
+	writeMetric(buf, "mplayer_rc_tracks_played_total", "counter",
+		"Tracks started.", tracksPlayed)
+	writeMetric(buf, "mplayer_rc_tracks_skipped_total", "counter",
+		"Tracks skipped by next/previous while playing.", tracksSkipped)
+	writeMetric(buf, "mplayer_rc_tracks_failed_total", "counter",
+		"Tracks the backend could not play.", tracksFailed)
+	writeMetric(buf, "mplayer_rc_backend_restarts_total", "counter",
+		"Restarts of the backend after a crash.", backendRestarts)
+	writeMetric(buf, "mplayer_rc_playlist_length", "gauge",
+		"Tracks in the playlist.", len(playlist))
+
+	state := getProp(in, outChan, "state")
+	fmt.Fprintf(buf, "# HELP mplayer_rc_playback_state Current playback state (1 for the current state).\n")
+	fmt.Fprintf(buf, "# TYPE mplayer_rc_playback_state gauge\n")
+	for _, s := range []string{"paused", "playing", "stopped"} {
+		v := 0
+		if s == state {
+			v = 1
+		}
+		fmt.Fprintf(buf, "mplayer_rc_playback_state{state=%q} %d\n", s, v)
+	}
+	volume := getInt(getProp(in, outChan, backend.propVolume))
+	writeMetric(buf, "mplayer_rc_volume", "gauge",
+		"Volume, 0 to 320 as used by the VLC remote.", volume)
+	return buf.String()
+}
+
+// metricsContentType is the content type of the text exposition
+// format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
@@ -0,0 +1,1091 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The MPD server. It speaks enough of the Music Player Daemon
+// protocol for MPD clients (mpc, ncmpcpp, MPDroid...) to control
+// playback and the playlist, sending the same commands as the REST
+// API. There is no music database: add takes file paths and URLs.
+// Playlist positions are in playing order, and MPD's single mode is
+// mplayer-rc's repeat (of the current track).
+
+// mpdListen, set by main, is the address the MPD server listens on,
+// or empty if it is disabled.
+var mpdListen string
+
+const (
+	mpdVersion     = "0.21.0" // the protocol version announced
+	mpdDefaultPort = "6600"
+)
+
+// MPD error codes
+const (
+	mpdErrArg        = 2
+	mpdErrPassword   = 3
+	mpdErrPermission = 4
+	mpdErrUnknown    = 5
+	mpdErrNoExist    = 50
+)
+
+type mpdError struct {
+	code int
+	msg  string
+}
+
+func (e *mpdError) Error() string {
+	return e.msg
+}
+
+func mpdErrorf(code int, format string, args ...interface{}) error {
+	return &mpdError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// mpdNoAuth is the role of commands which may be used before a
+// password is given.
+const mpdNoAuth = -1
+
+type mpdCommand struct {
+	role int // the role needed to use the command
+	fn   func(mc *mpdConn, args []string) error
+}
+
+// mpdCommands is set in init, as commands refers to it.
+var mpdCommands map[string]mpdCommand
+
+// mpdEventSubsystems maps events (see stateEvents) to the idle
+// subsystems they are reported as.
+var mpdEventSubsystems = map[string]string{
+	"track": "player", "seek": "player", "state": "player",
+	"metadata": "player", "volume": "mixer", "options": "options",
+	"playlist": "playlist",
+}
+
+// mpdSubsystems are the idle subsystems MPD clients may ask for. Only
+// those in mpdEventSubsystems are ever reported.
+var mpdSubsystems = map[string]bool{
+	"database": true, "update": true, "stored_playlist": true,
+	"playlist": true, "player": true, "mixer": true, "output": true,
+	"options": true, "partition": true, "sticker": true,
+	"subscription": true, "message": true, "neighbor": true,
+	"mount": true,
+}
+
+// mpdConn is a client connection.
+type mpdConn struct {
+	commandChan chan<- interface{}
+	conn        net.Conn
+	w           *bufio.Writer
+	ip          net.IP // nil for Unix socket clients
+	user        *user  // nil until a password is given
+	mu          sync.Mutex
+	changed     map[string]bool // subsystems changed since the last idle
+	notify      chan struct{}   // signalled when changed is added to
+}
+
+// startMPD opens the MPD listener and serves it in the background,
+// returning its address.
+func startMPD(commandChan chan<- interface{}) net.Addr {
+	l, err := listen(parseListen(mpdListen, mpdDefaultPort))
+	if err != nil {
+		log.Fatalf("mplayer-rc: failed to start mpd server: %v", err)
+	}
+	logInfo("mpd server listening", "addr", l.Addr())
+	go func() {
+		<-shutdownStarted
+		l.Close()
+	}()
+	// the accept loop counts as a task, so that connections are added
+	// to serverTasks before shutdown can find it empty
+	serverTasks.Add(1)
+	go func() {
+		defer serverTasks.Done()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				if isShuttingDown() {
+					return
+				}
+				logWarn("mpd server", "err", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			serverTasks.Add(1)
+			go func() {
+				defer serverTasks.Done()
+				serveMPD(commandChan, c)
+			}()
+		}
+	}()
+	return l.Addr()
+}
+
+// serveMPD handles an MPD client connection until it closes.
+func serveMPD(commandChan chan<- interface{}, c net.Conn) {
+	defer c.Close()
+	mc := &mpdConn{
+		commandChan: commandChan,
+		conn:        c,
+		w:           bufio.NewWriter(c),
+		changed:     map[string]bool{},
+		notify:      make(chan struct{}, 1),
+	}
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		mc.ip = addr.IP
+	}
+	if !clientAllowed(mc.ip) {
+		logWarn("rejected client: not allowed", "client", mc.ip)
+		return
+	}
+	if lockedOut(mc.ip) > 0 {
+		logWarn("rejected client: locked out", "client", mc.ip)
+		return
+	}
+	logDebug("mpd client connected", "client", c.RemoteAddr())
+	// subscribe to events for idle
+	ch := make(chan []byte, subscriberBuffer)
+	commandChan <- cmdSubscribe{ch: ch}
+	go mc.watch(ch)
+	defer func() {
+		commandChan <- cmdUnsubscribe{ch: ch}
+	}()
+	// read lines in a goroutine so that idle can wait for them and
+	// for events at the same time
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(c)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+	fmt.Fprintf(mc.w, "OK MPD %s\n", mpdVersion)
+	var list []string // commands in a command list
+	inList, listOK := false, false
+	for {
+		if mc.w.Flush() != nil {
+			return
+		}
+		var line string
+		var ok bool
+		select {
+		case line, ok = <-lines:
+			if !ok {
+				return
+			}
+		case <-shutdownStarted:
+			return
+		}
+		switch {
+		case line == "command_list_begin" || line == "command_list_ok_begin":
+			inList, listOK, list = true, line == "command_list_ok_begin", nil
+		case line == "command_list_end" && inList:
+			inList = false
+			mc.runList(list, listOK)
+		case inList:
+			list = append(list, line)
+		case line == "close":
+			return
+		case line == "idle" || strings.HasPrefix(line, "idle "):
+			if !mc.idle(line, lines) {
+				return
+			}
+		case line == "noidle":
+			// not idle, so nothing to cancel
+			mc.w.WriteString("OK\n")
+		default:
+			mc.runList([]string{line}, false)
+		}
+	}
+}
+
+// runList runs commands, replying OK if they all succeed (and
+// list_OK after each if listOK is set), or an error for the first to
+// fail.
+func (mc *mpdConn) runList(commands []string, listOK bool) {
+	for i, line := range commands {
+		args, err := mpdSplit(line)
+		name := ""
+		if err == nil {
+			name = args[0]
+			countRequest("mpd", "")
+			err = mc.run(args)
+		}
+		if err != nil {
+			code := mpdErrUnknown
+			if e, ok := err.(*mpdError); ok {
+				code = e.code
+			}
+			fmt.Fprintf(mc.w, "ACK [%d@%d] {%s} %s\n", code, i, name, err)
+			return
+		}
+		if listOK {
+			mc.w.WriteString("list_OK\n")
+		}
+	}
+	mc.w.WriteString("OK\n")
+}
+
+// run runs a command, writing its response (other than the final OK).
+func (mc *mpdConn) run(args []string) error {
+	cmd, ok := mpdCommands[args[0]]
+	if !ok {
+		return mpdErrorf(mpdErrUnknown, "unknown command \"%s\"", args[0])
+	}
+	if !mc.allowed(cmd.role) {
+		return mpdErrorf(mpdErrPermission,
+			"you don't have permission for \"%s\"", args[0])
+	}
+	return cmd.fn(mc, args[1:])
+}
+
+func (mc *mpdConn) allowed(role int) bool {
+	return role == mpdNoAuth || mc.user != nil && mc.user.role >= role
+}
+
+// watch records the subsystems changed by the events sent to ch.
+func (mc *mpdConn) watch(ch chan []byte) {
+	for event := range ch {
+		name := strings.TrimPrefix(
+			strings.SplitN(string(event), "\n", 2)[0], "event: ")
+		subsystem, ok := mpdEventSubsystems[name]
+		if !ok {
+			continue
+		}
+		mc.mu.Lock()
+		mc.changed[subsystem] = true
+		mc.mu.Unlock()
+		select {
+		case mc.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// idle waits until one of the subsystems requested by line has
+// changed, or the client sends noidle. It returns false if the client
+// should be disconnected.
+func (mc *mpdConn) idle(line string, lines <-chan string) bool {
+	args, err := mpdSplit(line)
+	want := map[string]bool{}
+	if err == nil && !mc.allowed(roleReadOnly) {
+		err = mpdErrorf(mpdErrPermission, "you don't have permission for \"idle\"")
+	}
+	if err == nil {
+		for _, s := range args[1:] {
+			if !mpdSubsystems[s] {
+				err = mpdErrorf(mpdErrArg, "Unrecognized idle event: %s", s)
+			}
+			want[s] = true
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(mc.w, "ACK [%d@0] {idle} %s\n", err.(*mpdError).code, err)
+		return true
+	}
+	if len(want) == 0 {
+		want = mpdSubsystems
+	}
+	// report returns the wanted subsystems that have changed,
+	// forgetting them
+	report := func() []string {
+		mc.mu.Lock()
+		defer mc.mu.Unlock()
+		var changed []string
+		for s := range mc.changed {
+			if want[s] {
+				changed = append(changed, s)
+				delete(mc.changed, s)
+			}
+		}
+		sort.Strings(changed)
+		return changed
+	}
+	changed := report()
+	if len(changed) == 0 {
+		mc.w.Flush()
+	}
+	for len(changed) == 0 {
+		select {
+		case line, ok := <-lines:
+			if !ok || line != "noidle" {
+				// anything but noidle while idle is an error
+				return false
+			}
+			changed = report()
+			mc.writeChanged(changed)
+			return true
+		case <-mc.notify:
+			changed = report()
+		case <-shutdownStarted:
+			return false
+		}
+	}
+	mc.writeChanged(changed)
+	return true
+}
+
+func (mc *mpdConn) writeChanged(changed []string) {
+	for _, s := range changed {
+		fmt.Fprintf(mc.w, "changed: %s\n", s)
+	}
+	mc.w.WriteString("OK\n")
+}
+
+// mpdSplit splits a command line into the command and its arguments,
+// which may be quoted with "" (with \ escaping " and \).
+func mpdSplit(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			break
+		}
+		if line[0] != '"' {
+			i := strings.IndexAny(line, " \t")
+			if i < 0 {
+				i = len(line)
+			}
+			args = append(args, line[:i])
+			line = line[i:]
+			continue
+		}
+		var arg []byte
+		i := 1
+		for ; i < len(line) && line[i] != '"'; i++ {
+			if line[i] == '\\' && i+1 < len(line) {
+				i++
+			}
+			arg = append(arg, line[i])
+		}
+		if i == len(line) {
+			return nil, mpdErrorf(mpdErrArg, "Missing closing '\"'")
+		}
+		args = append(args, string(arg))
+		line = line[i+1:]
+	}
+	if len(args) == 0 {
+		return nil, mpdErrorf(mpdErrUnknown, "No command given")
+	}
+	return args, nil
+}
+
+// mpdArgs checks the number of arguments is between min and max.
+func mpdArgs(args []string, min, max int) error {
+	if len(args) < min || len(args) > max {
+		return mpdErrorf(mpdErrArg, "wrong number of arguments")
+	}
+	return nil
+}
+
+func mpdInt(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, mpdErrorf(mpdErrArg, "Integer expected: %s", s)
+	}
+	return n, nil
+}
+
+func mpdBool(s string) (bool, error) {
+	switch s {
+	case "0":
+		return false, nil
+	case "1":
+		return true, nil
+	}
+	return false, mpdErrorf(mpdErrArg, "Boolean (0/1) expected: %s", s)
+}
+
+// mpdTime parses a time in seconds, which may be fractional.
+func mpdTime(s string) (int, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, mpdErrorf(mpdErrArg, "Float expected: %s", s)
+	}
+	return int(f), nil
+}
+
+// mpdRange parses a position or START:END range (END optional) into
+// a half-open range of positions within a playlist of length n.
+func mpdRange(s string, n int) (int, int, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		pos, err := mpdInt(s)
+		if err != nil {
+			return 0, 0, err
+		}
+		if pos < 0 || pos >= n {
+			return 0, 0, mpdErrorf(mpdErrArg, "Bad song index")
+		}
+		return pos, pos + 1, nil
+	}
+	start, err := mpdInt(s[:i])
+	if err != nil {
+		return 0, 0, err
+	}
+	end := n
+	if s[i+1:] != "" {
+		if end, err = mpdInt(s[i+1:]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if start < 0 || start > end || end > n {
+		return 0, 0, mpdErrorf(mpdErrArg, "Bad song index")
+	}
+	return start, end, nil
+}
+
+func (mc *mpdConn) state(player bool) apiState {
+	return getAPIState(mc.commandChan, player)
+}
+
+// mpdFind returns the position of track id in tracks.
+func mpdFind(tracks []apiTrack, id int) (int, error) {
+	for pos, t := range tracks {
+		if t.ID == id {
+			return pos, nil
+		}
+	}
+	return 0, mpdErrorf(mpdErrNoExist, "No such song")
+}
+
+func (mc *mpdConn) writeTrack(t apiTrack, pos int) {
+	fmt.Fprintf(mc.w, "file: %s\nTitle: %s\nPos: %d\nId: %d\n",
+		t.URI, t.Name, pos, t.ID)
+}
+
+func mpdPassword(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 1, 1); err != nil {
+		return err
+	}
+	if lockedOut(mc.ip) == 0 {
+		var found *user
+		for _, u := range users {
+			if u.checkPassword(args[0]) && (found == nil || u.role > found.role) {
+				found = u
+			}
+		}
+		if found != nil {
+			clearAuthFailures(mc.ip)
+			mc.user = found
+			return nil
+		}
+		logWarn("failed login", "user", "(mpd)", "client", mc.conn.RemoteAddr())
+		recordAuthFailure(mc.ip)
+		countAuthFailure()
+	}
+	return mpdErrorf(mpdErrPassword, "incorrect password")
+}
+
+func mpdPing(mc *mpdConn, args []string) error {
+	return nil
+}
+
+// mpdListCommands implements commands and notcommands.
+func mpdListCommands(allowed bool) func(mc *mpdConn, args []string) error {
+	return func(mc *mpdConn, args []string) error {
+		var names []string
+		for name, cmd := range mpdCommands {
+			if mc.allowed(cmd.role) == allowed {
+				names = append(names, name)
+			}
+		}
+		if allowed {
+			names = append(names, "close", "idle", "noidle",
+				"command_list_begin", "command_list_ok_begin",
+				"command_list_end")
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(mc.w, "command: %s\n", name)
+		}
+		return nil
+	}
+}
+
+// mpdNothing implements commands that have no output here, such as
+// those listing the (empty) music database.
+func mpdNothing(mc *mpdConn, args []string) error {
+	return nil
+}
+
+func mpdTagTypes(mc *mpdConn, args []string) error {
+	if len(args) == 0 {
+		mc.w.WriteString("tagtype: Artist\ntagtype: Title\ntagtype: Name\n")
+	}
+	return nil
+}
+
+func mpdURLHandlers(mc *mpdConn, args []string) error {
+	for _, scheme := range []string{"file", "http", "https", "mms", "rtmp", "rtsp"} {
+		fmt.Fprintf(mc.w, "handler: %s://\n", scheme)
+	}
+	return nil
+}
+
+func mpdOutputs(mc *mpdConn, args []string) error {
+	fmt.Fprintf(mc.w, "outputid: 0\noutputname: %s\nplugin: %s\noutputenabled: 1\n",
+		backend.binary, backend.binary)
+	return nil
+}
+
+func mpdStats(mc *mpdConn, args []string) error {
+	fmt.Fprintf(mc.w, "artists: 0\nalbums: 0\nsongs: 0\nuptime: %d\n"+
+		"db_playtime: 0\ndb_update: 0\nplaytime: 0\n",
+		int(time.Since(startTime)/time.Second))
+	return nil
+}
+
+func mpdStatus(mc *mpdConn, args []string) error {
+	st := mc.state(true)
+	p := st.player
+	state := map[string]string{
+		"playing": "play", "paused": "pause", "stopped": "stop"}[p.State]
+	fmt.Fprintf(mc.w, "volume: %d\nrepeat: %d\nrandom: %d\nsingle: %d\n"+
+		"consume: 0\nplaylist: %d\nplaylistlength: %d\nstate: %s\n",
+		p.Volume, mpdFlag(p.Loop || p.Repeat), mpdFlag(p.Shuffle),
+		mpdFlag(p.Repeat), st.playlist.Version, len(st.playlist.Tracks),
+		state)
+	if p.Track != nil {
+		pos, _ := mpdFind(st.playlist.Tracks, p.Track.ID)
+		fmt.Fprintf(mc.w, "song: %d\nsongid: %d\n", pos, p.Track.ID)
+	}
+	if p.State != "stopped" {
+		fmt.Fprintf(mc.w, "time: %d:%d\nelapsed: %d.000\nduration: %d.000\n",
+			p.Position, p.Duration, p.Position, p.Duration)
+	}
+	return nil
+}
+
+func mpdFlag(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func mpdCurrentSong(mc *mpdConn, args []string) error {
+	st := mc.state(true)
+	p := st.player
+	if p.Track == nil {
+		return nil
+	}
+	pos, _ := mpdFind(st.playlist.Tracks, p.Track.ID)
+	title := p.Track.Name
+	switch {
+	case p.Title != "":
+		title = p.Title
+	case p.NowPlaying != "":
+		title = p.NowPlaying
+	}
+	fmt.Fprintf(mc.w, "file: %s\n", p.Track.URI)
+	if p.Artist != "" {
+		fmt.Fprintf(mc.w, "Artist: %s\n", p.Artist)
+	}
+	fmt.Fprintf(mc.w, "Title: %s\n", title)
+	if p.Station != "" {
+		fmt.Fprintf(mc.w, "Name: %s\n", p.Station)
+	}
+	if p.Duration > 0 {
+		fmt.Fprintf(mc.w, "Time: %d\nduration: %d.000\n", p.Duration, p.Duration)
+	}
+	fmt.Fprintf(mc.w, "Pos: %d\nId: %d\n", pos, p.Track.ID)
+	return nil
+}
+
+func mpdPlaylistInfo(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 0, 1); err != nil {
+		return err
+	}
+	tracks := mc.state(false).playlist.Tracks
+	start, end := 0, len(tracks)
+	if len(args) == 1 {
+		var err error
+		if start, end, err = mpdRange(args[0], len(tracks)); err != nil {
+			return err
+		}
+	}
+	for pos := start; pos < end; pos++ {
+		mc.writeTrack(tracks[pos], pos)
+	}
+	return nil
+}
+
+func mpdPlaylistID(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 0, 1); err != nil {
+		return err
+	}
+	tracks := mc.state(false).playlist.Tracks
+	if len(args) == 0 {
+		return mpdPlaylistInfo(mc, nil)
+	}
+	id, err := mpdInt(args[0])
+	if err != nil {
+		return err
+	}
+	pos, err := mpdFind(tracks, id)
+	if err != nil {
+		return err
+	}
+	mc.writeTrack(tracks[pos], pos)
+	return nil
+}
+
+// mpdPlChanges implements plchanges and plchangesposid. The playlist
+// version does not say which tracks changed, so all are listed if it
+// differs.
+func mpdPlChanges(posid bool) func(mc *mpdConn, args []string) error {
+	return func(mc *mpdConn, args []string) error {
+		if err := mpdArgs(args, 1, 2); err != nil {
+			return err
+		}
+		version, err := mpdInt(args[0])
+		if err != nil {
+			return err
+		}
+		pl := mc.state(false).playlist
+		if version == pl.Version {
+			return nil
+		}
+		for pos, t := range pl.Tracks {
+			if posid {
+				fmt.Fprintf(mc.w, "cpos: %d\nId: %d\n", pos, t.ID)
+			} else {
+				mc.writeTrack(t, pos)
+			}
+		}
+		return nil
+	}
+}
+
+// mpdPlay plays track id (or the current track if -1), resuming it if
+// it is paused.
+func (mc *mpdConn) play(id int) {
+	p := mc.state(true).player
+	switch {
+	case id >= 0 && (p.Track == nil || p.Track.ID != id):
+		mc.commandChan <- cmdPlay{id: id}
+	case p.State == "stopped":
+		mc.commandChan <- cmdPlay{id: -1}
+	case p.State == "paused":
+		mc.commandChan <- cmdPause{}
+	}
+}
+
+func mpdPlayPos(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 0, 1); err != nil {
+		return err
+	}
+	id := -1
+	if len(args) == 1 {
+		tracks := mc.state(false).playlist.Tracks
+		pos, err := mpdInt(args[0])
+		if err != nil {
+			return err
+		}
+		if pos >= len(tracks) {
+			return mpdErrorf(mpdErrArg, "Bad song index")
+		}
+		if pos >= 0 {
+			id = tracks[pos].ID
+		}
+	}
+	mc.play(id)
+	return nil
+}
+
+func mpdPlayID(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 0, 1); err != nil {
+		return err
+	}
+	id := -1
+	if len(args) == 1 {
+		var err error
+		if id, err = mpdInt(args[0]); err != nil {
+			return err
+		}
+		if id >= 0 {
+			if _, err := mpdFind(mc.state(false).playlist.Tracks, id); err != nil {
+				return err
+			}
+		}
+	}
+	mc.play(id)
+	return nil
+}
+
+// mpdPause toggles pause, or with an argument of 1 pauses and 0
+// resumes.
+func mpdPause(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 0, 1); err != nil {
+		return err
+	}
+	state := mc.state(true).player.State
+	pause := state == "playing"
+	if len(args) == 1 {
+		var err error
+		if pause, err = mpdBool(args[0]); err != nil {
+			return err
+		}
+	}
+	if pause && state == "playing" || !pause && state == "paused" {
+		mc.commandChan <- cmdPause{}
+	}
+	return nil
+}
+
+// mpdSimple implements commands which send cmd to the select loop.
+func mpdSimple(cmd interface{}) func(mc *mpdConn, args []string) error {
+	return func(mc *mpdConn, args []string) error {
+		if err := mpdArgs(args, 0, 0); err != nil {
+			return err
+		}
+		mc.commandChan <- cmd
+		return nil
+	}
+}
+
+// mpdSeek implements seek (byID false) and seekid (byID true).
+func mpdSeek(byID bool) func(mc *mpdConn, args []string) error {
+	return func(mc *mpdConn, args []string) error {
+		if err := mpdArgs(args, 2, 2); err != nil {
+			return err
+		}
+		n, err := mpdInt(args[0])
+		if err != nil {
+			return err
+		}
+		t, err := mpdTime(args[1])
+		if err != nil {
+			return err
+		}
+		tracks := mc.state(false).playlist.Tracks
+		id := n
+		if byID {
+			if _, err := mpdFind(tracks, id); err != nil {
+				return err
+			}
+		} else {
+			if n < 0 || n >= len(tracks) {
+				return mpdErrorf(mpdErrArg, "Bad song index")
+			}
+			id = tracks[n].ID
+		}
+		mc.play(id)
+		mc.commandChan <- cmdSeek{val: t, mode: seekAbs}
+		return nil
+	}
+}
+
+// mpdSeekCur seeks within the current track, relatively if the time
+// has a sign.
+func mpdSeekCur(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 1, 1); err != nil {
+		return err
+	}
+	t, err := mpdTime(args[0])
+	if err != nil {
+		return err
+	}
+	if args[0][0] == '+' || args[0][0] == '-' {
+		t += mc.state(true).player.Position
+		if t < 0 {
+			t = 0
+		}
+	}
+	mc.commandChan <- cmdSeek{val: t, mode: seekAbs}
+	return nil
+}
+
+func mpdSetVol(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 1, 1); err != nil {
+		return err
+	}
+	vol, err := mpdInt(args[0])
+	if err != nil {
+		return err
+	}
+	if vol < 0 || vol > 100 {
+		return mpdErrorf(mpdErrArg, "Invalid volume value")
+	}
+	mc.commandChan <- cmdVolume{val: vol * 320 / 100, mode: volAbs}
+	return nil
+}
+
+// mpdVolume changes the volume by the argument.
+func mpdVolume(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 1, 1); err != nil {
+		return err
+	}
+	change, err := mpdInt(args[0])
+	if err != nil {
+		return err
+	}
+	vol := mc.state(true).player.Volume + change
+	if vol < 0 {
+		vol = 0
+	}
+	if vol > 100 {
+		vol = 100
+	}
+	mc.commandChan <- cmdVolume{val: vol * 320 / 100, mode: volAbs}
+	return nil
+}
+
+func mpdGetVol(mc *mpdConn, args []string) error {
+	fmt.Fprintf(mc.w, "volume: %d\n", mc.state(true).player.Volume)
+	return nil
+}
+
+func mpdRandom(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 1, 1); err != nil {
+		return err
+	}
+	random, err := mpdBool(args[0])
+	if err != nil {
+		return err
+	}
+	if random != mc.state(true).player.Shuffle {
+		mc.commandChan <- cmdShuffle{}
+	}
+	return nil
+}
+
+// mpdRepeat implements repeat (single false) and single (single
+// true). MPD's repeat with single off is mplayer-rc's loop, and single
+// is mplayer-rc's repeat.
+func mpdRepeat(single bool) func(mc *mpdConn, args []string) error {
+	return func(mc *mpdConn, args []string) error {
+		if err := mpdArgs(args, 1, 1); err != nil {
+			return err
+		}
+		on, err := mpdBool(args[0])
+		if err != nil {
+			return err
+		}
+		p := mc.state(true).player
+		mpdRep, mpdSingle := p.Loop || p.Repeat, p.Repeat
+		if single {
+			mpdSingle = on
+		} else {
+			mpdRep = on
+		}
+		repeat, loop := mpdSingle, mpdRep && !mpdSingle
+		switch {
+		case repeat && !p.Repeat, !repeat && !loop && p.Repeat:
+			mc.commandChan <- cmdRepeat{}
+		case loop && !p.Loop, !repeat && !loop && p.Loop:
+			mc.commandChan <- cmdLoop{}
+		}
+		return nil
+	}
+}
+
+func mpdConsume(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 1, 1); err != nil {
+		return err
+	}
+	if on, err := mpdBool(args[0]); err != nil || on {
+		return mpdErrorf(mpdErrArg, "consume mode is not supported")
+	}
+	return nil
+}
+
+// add adds uri to the playlist, returning its id.
+func (mc *mpdConn) add(uri string) (int, error) {
+	replyChan := make(chan int, 1)
+	mc.commandChan <- cmdSetPlaylist{uri: uri, enqueue: true, replyChan: replyChan}
+	id := <-replyChan
+	if id < 0 {
+		return -1, mpdErrorf(mpdErrNoExist, "Malformed URI")
+	}
+	return id, nil
+}
+
+func mpdAdd(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 1, 1); err != nil {
+		return err
+	}
+	_, err := mc.add(args[0])
+	return err
+}
+
+// mpdAddID adds a track, optionally at a position, and prints its id.
+func mpdAddID(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 1, 2); err != nil {
+		return err
+	}
+	tracks := mc.state(false).playlist.Tracks
+	pos := len(tracks)
+	if len(args) == 2 {
+		var err error
+		if pos, err = mpdInt(args[1]); err != nil {
+			return err
+		}
+		if pos < 0 || pos > len(tracks) {
+			return mpdErrorf(mpdErrArg, "Bad song index")
+		}
+	}
+	id, err := mc.add(args[0])
+	if err != nil {
+		return err
+	}
+	if pos < len(tracks) {
+		mc.commandChan <- cmdMove{id: id, target: tracks[pos].ID}
+	}
+	fmt.Fprintf(mc.w, "Id: %d\n", id)
+	return nil
+}
+
+func mpdDelete(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 1, 1); err != nil {
+		return err
+	}
+	tracks := mc.state(false).playlist.Tracks
+	start, end, err := mpdRange(args[0], len(tracks))
+	if err != nil {
+		return err
+	}
+	for _, t := range tracks[start:end] {
+		mc.commandChan <- cmdRemove{id: t.ID}
+	}
+	return nil
+}
+
+func mpdDeleteID(mc *mpdConn, args []string) error {
+	if err := mpdArgs(args, 1, 1); err != nil {
+		return err
+	}
+	id, err := mpdInt(args[0])
+	if err != nil {
+		return err
+	}
+	if _, err := mpdFind(mc.state(false).playlist.Tracks, id); err != nil {
+		return err
+	}
+	mc.commandChan <- cmdRemove{id: id}
+	return nil
+}
+
+func mpdClear(mc *mpdConn, args []string) error {
+	for _, t := range mc.state(false).playlist.Tracks {
+		mc.commandChan <- cmdRemove{id: t.ID}
+	}
+	return nil
+}
+
+// mpdMove implements move (byID false) and moveid (byID true).
+func mpdMove(byID bool) func(mc *mpdConn, args []string) error {
+	return func(mc *mpdConn, args []string) error {
+		if err := mpdArgs(args, 2, 2); err != nil {
+			return err
+		}
+		n, err := mpdInt(args[0])
+		if err != nil {
+			return err
+		}
+		to, err := mpdInt(args[1])
+		if err != nil {
+			return err
+		}
+		tracks := mc.state(false).playlist.Tracks
+		from := n
+		if byID {
+			if from, err = mpdFind(tracks, n); err != nil {
+				return err
+			}
+		}
+		if from < 0 || from >= len(tracks) || to < 0 || to >= len(tracks) {
+			return mpdErrorf(mpdErrArg, "Bad song index")
+		}
+		mc.commandChan <- cmdMove{id: tracks[from].ID, target: tracks[to].ID}
+		return nil
+	}
+}
+
+func init() {
+	readOnly := func(fn func(mc *mpdConn, args []string) error) mpdCommand {
+		return mpdCommand{role: roleReadOnly, fn: fn}
+	}
+	full := func(fn func(mc *mpdConn, args []string) error) mpdCommand {
+		return mpdCommand{role: roleFull, fn: fn}
+	}
+	mpdCommands = map[string]mpdCommand{
+		"password":       {mpdNoAuth, mpdPassword},
+		"ping":           {mpdNoAuth, mpdPing},
+		"commands":       {mpdNoAuth, mpdListCommands(true)},
+		"notcommands":    {mpdNoAuth, mpdListCommands(false)},
+		"tagtypes":       {mpdNoAuth, mpdTagTypes},
+		"urlhandlers":    readOnly(mpdURLHandlers),
+		"decoders":       readOnly(mpdNothing),
+		"outputs":        readOnly(mpdOutputs),
+		"stats":          readOnly(mpdStats),
+		"lsinfo":         readOnly(mpdNothing),
+		"listplaylists":  readOnly(mpdNothing),
+		"status":         readOnly(mpdStatus),
+		"currentsong":    readOnly(mpdCurrentSong),
+		"playlistinfo":   readOnly(mpdPlaylistInfo),
+		"playlistid":     readOnly(mpdPlaylistID),
+		"plchanges":      readOnly(mpdPlChanges(false)),
+		"plchangesposid": readOnly(mpdPlChanges(true)),
+		"getvol":         readOnly(mpdGetVol),
+		"play":           full(mpdPlayPos),
+		"playid":         full(mpdPlayID),
+		"pause":          full(mpdPause),
+		"stop":           full(mpdSimple(cmdStop{})),
+		"next":           full(mpdSimple(cmdNext{})),
+		"previous":       full(mpdSimple(cmdPrev{})),
+		"seek":           full(mpdSeek(false)),
+		"seekid":         full(mpdSeek(true)),
+		"seekcur":        full(mpdSeekCur),
+		"setvol":         full(mpdSetVol),
+		"volume":         full(mpdVolume),
+		"random":         full(mpdRandom),
+		"repeat":         full(mpdRepeat(false)),
+		"single":         full(mpdRepeat(true)),
+		"consume":        full(mpdConsume),
+		"add":            full(mpdAdd),
+		"addid":          full(mpdAddID),
+		"delete":         full(mpdDelete),
+		"deleteid":       full(mpdDeleteID),
+		"clear":          full(mpdClear),
+		"move":           full(mpdMove(false)),
+		"moveid":         full(mpdMove(true)),
+	}
+}
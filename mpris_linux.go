@@ -0,0 +1,649 @@
+// +build linux
+
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+// The MPRIS2 D-Bus interface, through which desktop media keys and
+// widgets control mplayer-rc. See
+// https://specifications.freedesktop.org/mpris-spec/latest/
+//
+// The methods are called in godbus's goroutines and, like the HTTP
+// handlers, send commands to the select loop. Playlist tracks are
+// exported as mprisTrackPrefix followed by the track id, in playing
+// order.
+
+// mprisEnabled, set by main, causes the interface to be published.
+var mprisEnabled bool
+
+const (
+	mprisName        = "org.mpris.MediaPlayer2.mplayerrc"
+	mprisPath        = "/org/mpris/MediaPlayer2"
+	mprisRoot        = "org.mpris.MediaPlayer2"
+	mprisPlayer      = "org.mpris.MediaPlayer2.Player"
+	mprisTrackList   = "org.mpris.MediaPlayer2.TrackList"
+	mprisProperties  = "org.freedesktop.DBus.Properties"
+	mprisNoTrack     = "/org/mpris/MediaPlayer2/TrackList/NoTrack"
+	mprisTrackPrefix = "/org/mplayerrc/track/"
+)
+
+type mpris struct {
+	conn        *dbus.Conn
+	commandChan chan<- interface{}
+}
+
+// the exported interfaces. Each is a separate type so that godbus
+// exports only its own methods on it.
+type (
+	mprisRootIface      struct{ *mpris }
+	mprisPlayerIface    struct{ *mpris }
+	mprisTrackListIface struct{ *mpris }
+	mprisPropsIface     struct{ *mpris }
+)
+
+// startMPRIS connects to the session bus and publishes the MPRIS
+// interfaces. Failure is logged but not fatal, as there may be no
+// session bus (e.g. when running as a service).
+func startMPRIS(commandChan chan<- interface{}) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		logError("cannot connect to the D-Bus session bus", "err", err)
+		return
+	}
+	m := &mpris{conn: conn, commandChan: commandChan}
+	exports := []struct {
+		v     interface{}
+		iface string
+	}{
+		{mprisRootIface{m}, mprisRoot},
+		{mprisPlayerIface{m}, mprisPlayer},
+		{mprisTrackListIface{m}, mprisTrackList},
+		{mprisPropsIface{m}, mprisProperties},
+		{introspect.Introspectable(mprisIntrospectXML), "org.freedesktop.DBus.Introspectable"},
+	}
+	for _, e := range exports {
+		mapping := map[string]string{}
+		if e.iface == mprisPlayer {
+			mapping["SeekBy"] = "Seek"
+		}
+		if err := conn.ExportWithMap(e.v, mapping, mprisPath, e.iface); err != nil {
+			logError("cannot export MPRIS interface", "iface", e.iface, "err", err)
+			conn.Close()
+			return
+		}
+	}
+	// if the name is taken by another instance, add a unique suffix
+	// as the specification suggests
+	name := mprisName
+	reply, err := conn.RequestName(name, dbus.NameFlagDoNotQueue)
+	if err == nil && reply != dbus.RequestNameReplyPrimaryOwner {
+		name = mprisName + ".instance" + strconv.Itoa(os.Getpid())
+		reply, err = conn.RequestName(name, dbus.NameFlagDoNotQueue)
+	}
+	if err == nil && reply != dbus.RequestNameReplyPrimaryOwner {
+		err = errNameTaken
+	}
+	if err != nil {
+		logError("cannot own D-Bus name", "name", name, "err", err)
+		conn.Close()
+		return
+	}
+	logInfo("published MPRIS interface", "name", name)
+	ch := make(chan []byte, subscriberBuffer)
+	commandChan <- cmdSubscribe{ch: ch}
+	go m.watch(ch)
+}
+
+type mprisError string
+
+func (e mprisError) Error() string {
+	return string(e)
+}
+
+const errNameTaken = mprisError("name already taken")
+
+func (m *mpris) state(player bool) apiState {
+	return getAPIState(m.commandChan, player)
+}
+
+func mprisTrackID(id int) dbus.ObjectPath {
+	return dbus.ObjectPath(mprisTrackPrefix + strconv.Itoa(id))
+}
+
+// mprisParseTrackID returns the track id of path, or -1.
+func mprisParseTrackID(path dbus.ObjectPath) int {
+	s := string(path)
+	if !strings.HasPrefix(s, mprisTrackPrefix) {
+		return -1
+	}
+	id, err := strconv.Atoi(s[len(mprisTrackPrefix):])
+	if err != nil {
+		return -1
+	}
+	return id
+}
+
+// mprisURL converts a track to a URL, as xesam:url must be one.
+func mprisURL(track string) string {
+	if strings.Contains(track, "://") {
+		return track
+	}
+	return (&url.URL{Scheme: "file", Path: track}).String()
+}
+
+// mprisMetadata returns the metadata of t, with the current track's
+// title, artist and length from p if it is the current track.
+func mprisMetadata(t *apiTrack, p *apiPlayer) map[string]dbus.Variant {
+	if t == nil {
+		return map[string]dbus.Variant{
+			"mpris:trackid": dbus.MakeVariant(dbus.ObjectPath(mprisNoTrack)),
+		}
+	}
+	md := map[string]dbus.Variant{
+		"mpris:trackid": dbus.MakeVariant(mprisTrackID(t.ID)),
+		"xesam:url":     dbus.MakeVariant(mprisURL(t.URI)),
+		"xesam:title":   dbus.MakeVariant(t.Name),
+	}
+	if p != nil && t.Current {
+		switch {
+		case p.Title != "":
+			md["xesam:title"] = dbus.MakeVariant(p.Title)
+		case p.NowPlaying != "":
+			md["xesam:title"] = dbus.MakeVariant(p.NowPlaying)
+		}
+		if p.Artist != "" {
+			md["xesam:artist"] = dbus.MakeVariant([]string{p.Artist})
+		}
+		if p.Station != "" {
+			md["xesam:album"] = dbus.MakeVariant(p.Station)
+		}
+		if p.Duration > 0 {
+			md["mpris:length"] = dbus.MakeVariant(int64(p.Duration) * 1e6)
+		}
+	}
+	return md
+}
+
+func mprisPlaybackStatus(state string) string {
+	switch state {
+	case "playing":
+		return "Playing"
+	case "paused":
+		return "Paused"
+	}
+	return "Stopped"
+}
+
+func mprisLoopStatus(p *apiPlayer) string {
+	switch {
+	case p.Repeat:
+		return "Track"
+	case p.Loop:
+		return "Playlist"
+	}
+	return "None"
+}
+
+// properties returns the properties of iface given st.
+func (m *mpris) properties(iface string, st apiState) map[string]dbus.Variant {
+	p := &st.player
+	v := dbus.MakeVariant
+	switch iface {
+	case mprisRoot:
+		return map[string]dbus.Variant{
+			"CanQuit":             v(true),
+			"CanRaise":            v(false),
+			"HasTrackList":        v(true),
+			"Identity":            v("MPlayer-RC"),
+			"SupportedUriSchemes": v([]string{"file", "http", "https", "mms", "rtmp", "rtsp"}),
+			"SupportedMimeTypes": v([]string{
+				"audio/mpeg", "audio/ogg", "audio/flac", "audio/x-wav",
+				"audio/mp4", "audio/aac", "video/mp4", "video/x-matroska",
+				"video/webm", "video/x-msvideo"}),
+		}
+	case mprisPlayer:
+		hasTrack := p.Track != nil
+		return map[string]dbus.Variant{
+			"PlaybackStatus": v(mprisPlaybackStatus(p.State)),
+			"LoopStatus":     v(mprisLoopStatus(p)),
+			"Rate":           v(1.0),
+			"Shuffle":        v(p.Shuffle),
+			"Metadata":       v(mprisMetadata(p.Track, p)),
+			"Volume":         v(float64(p.Volume) / 100),
+			"Position":       v(int64(p.Position) * 1e6),
+			"MinimumRate":    v(1.0),
+			"MaximumRate":    v(1.0),
+			"CanGoNext":      v(hasTrack),
+			"CanGoPrevious":  v(hasTrack),
+			"CanPlay":        v(hasTrack),
+			"CanPause":       v(hasTrack),
+			"CanSeek":        v(hasTrack),
+			"CanControl":     v(true),
+		}
+	case mprisTrackList:
+		tracks := []dbus.ObjectPath{}
+		for _, t := range st.playlist.Tracks {
+			tracks = append(tracks, mprisTrackID(t.ID))
+		}
+		return map[string]dbus.Variant{
+			"Tracks":        v(tracks),
+			"CanEditTracks": v(true),
+		}
+	}
+	return nil
+}
+
+// watch emits signals for the events sent to ch.
+func (m *mpris) watch(ch chan []byte) {
+	for event := range ch {
+		// gather all the events queued, then emit signals for them
+		// against a single fresh state
+		names := map[string]bool{}
+		for more := true; more; {
+			names[strings.TrimPrefix(
+				strings.SplitN(string(event), "\n", 2)[0], "event: ")] = true
+			select {
+			case event, more = <-ch:
+			default:
+				more = false
+			}
+		}
+		st := m.state(true)
+		player := m.properties(mprisPlayer, st)
+		changed := map[string]dbus.Variant{}
+		add := func(props ...string) {
+			for _, prop := range props {
+				changed[prop] = player[prop]
+			}
+		}
+		if names["track"] || names["metadata"] || names["playlist"] {
+			add("Metadata", "CanGoNext", "CanGoPrevious", "CanPlay",
+				"CanPause", "CanSeek")
+		}
+		if names["state"] {
+			add("PlaybackStatus")
+		}
+		if names["volume"] {
+			add("Volume")
+		}
+		if names["options"] {
+			add("LoopStatus", "Shuffle")
+		}
+		if len(changed) > 0 {
+			m.conn.Emit(mprisPath, mprisProperties+".PropertiesChanged",
+				mprisPlayer, changed, []string{})
+		}
+		if names["seek"] {
+			m.conn.Emit(mprisPath, mprisPlayer+".Seeked", player["Position"].Value())
+		}
+		if names["playlist"] {
+			current := dbus.ObjectPath(mprisNoTrack)
+			if st.player.Track != nil {
+				current = mprisTrackID(st.player.Track.ID)
+			}
+			m.conn.Emit(mprisPath, mprisTrackList+".TrackListReplaced",
+				m.properties(mprisTrackList, st)["Tracks"].Value(), current)
+			m.conn.Emit(mprisPath, mprisProperties+".PropertiesChanged",
+				mprisTrackList, map[string]dbus.Variant{}, []string{"Tracks"})
+		}
+	}
+}
+
+// org.mpris.MediaPlayer2
+
+func (m mprisRootIface) Raise() *dbus.Error {
+	return nil
+}
+
+func (m mprisRootIface) Quit() *dbus.Error {
+	shutdown(m.commandChan, exitOK)
+	return nil
+}
+
+// org.mpris.MediaPlayer2.Player
+
+func (m mprisPlayerIface) Next() *dbus.Error {
+	m.commandChan <- cmdNext{}
+	return nil
+}
+
+func (m mprisPlayerIface) Previous() *dbus.Error {
+	m.commandChan <- cmdPrev{}
+	return nil
+}
+
+func (m mprisPlayerIface) Pause() *dbus.Error {
+	if m.state(true).player.State == "playing" {
+		m.commandChan <- cmdPause{}
+	}
+	return nil
+}
+
+func (m mprisPlayerIface) PlayPause() *dbus.Error {
+	if m.state(true).player.State == "stopped" {
+		m.commandChan <- cmdPlay{id: -1}
+	} else {
+		m.commandChan <- cmdPause{}
+	}
+	return nil
+}
+
+func (m mprisPlayerIface) Stop() *dbus.Error {
+	m.commandChan <- cmdStop{}
+	return nil
+}
+
+func (m mprisPlayerIface) Play() *dbus.Error {
+	switch m.state(true).player.State {
+	case "stopped":
+		m.commandChan <- cmdPlay{id: -1}
+	case "paused":
+		m.commandChan <- cmdPause{}
+	}
+	return nil
+}
+
+// SeekBy (exported as Seek, a name go vet reserves for io.Seeker)
+// seeks by offset microseconds, going to the next track if that is
+// past the end of this one.
+func (m mprisPlayerIface) SeekBy(offset int64) *dbus.Error {
+	p := m.state(true).player
+	if p.Track == nil {
+		return nil
+	}
+	pos := p.Position + int(offset/1e6)
+	if pos < 0 {
+		pos = 0
+	}
+	if p.Duration > 0 && pos > p.Duration {
+		m.commandChan <- cmdNext{}
+		return nil
+	}
+	m.commandChan <- cmdSeek{val: pos, mode: seekAbs}
+	return nil
+}
+
+// SetPosition seeks to position microseconds, provided track is still
+// the current track.
+func (m mprisPlayerIface) SetPosition(track dbus.ObjectPath, position int64) *dbus.Error {
+	p := m.state(true).player
+	if p.Track == nil || mprisTrackID(p.Track.ID) != track ||
+		position < 0 || p.Duration > 0 && position > int64(p.Duration)*1e6 {
+		return nil
+	}
+	m.commandChan <- cmdSeek{val: int(position / 1e6), mode: seekAbs}
+	return nil
+}
+
+func (m mprisPlayerIface) OpenUri(uri string) *dbus.Error {
+	replyChan := make(chan int, 1)
+	m.commandChan <- cmdSetPlaylist{uri: uri, replyChan: replyChan}
+	if <-replyChan < 0 {
+		return dbus.MakeFailedError(mprisError("invalid uri: " + uri))
+	}
+	return nil
+}
+
+// org.mpris.MediaPlayer2.TrackList
+
+func (m mprisTrackListIface) GetTracksMetadata(ids []dbus.ObjectPath) ([]map[string]dbus.Variant, *dbus.Error) {
+	st := m.state(true)
+	tracks := map[dbus.ObjectPath]*apiTrack{}
+	for i := range st.playlist.Tracks {
+		t := &st.playlist.Tracks[i]
+		tracks[mprisTrackID(t.ID)] = t
+	}
+	mds := []map[string]dbus.Variant{}
+	for _, id := range ids {
+		if t, ok := tracks[id]; ok {
+			mds = append(mds, mprisMetadata(t, &st.player))
+		}
+	}
+	return mds, nil
+}
+
+// AddTrack adds uri after track after (or first, if after is
+// NoTrack), playing it if setAsCurrent is set.
+func (m mprisTrackListIface) AddTrack(uri string, after dbus.ObjectPath, setAsCurrent bool) *dbus.Error {
+	tracks := m.state(false).playlist.Tracks
+	var target int // the track to insert before, or 0 to append
+	if after == mprisNoTrack {
+		if len(tracks) > 0 {
+			target = tracks[0].ID
+		}
+	} else {
+		afterID := mprisParseTrackID(after)
+		for i, t := range tracks {
+			if t.ID == afterID && i+1 < len(tracks) {
+				target = tracks[i+1].ID
+			}
+		}
+	}
+	replyChan := make(chan int, 1)
+	m.commandChan <- cmdSetPlaylist{
+		uri: uri, enqueue: !setAsCurrent, replyChan: replyChan}
+	id := <-replyChan
+	if id < 0 {
+		return dbus.MakeFailedError(mprisError("invalid uri: " + uri))
+	}
+	if target != 0 {
+		m.commandChan <- cmdMove{id: id, target: target}
+	}
+	return nil
+}
+
+func (m mprisTrackListIface) RemoveTrack(track dbus.ObjectPath) *dbus.Error {
+	if id := mprisParseTrackID(track); id >= 0 {
+		m.commandChan <- cmdRemove{id: id}
+	}
+	return nil
+}
+
+func (m mprisTrackListIface) GoTo(track dbus.ObjectPath) *dbus.Error {
+	id := mprisParseTrackID(track)
+	for _, t := range m.state(false).playlist.Tracks {
+		if t.ID == id {
+			m.commandChan <- cmdPlay{id: id}
+		}
+	}
+	return nil
+}
+
+// org.freedesktop.DBus.Properties
+
+func (m mprisPropsIface) Get(iface, prop string) (dbus.Variant, *dbus.Error) {
+	props, err := m.GetAll(iface)
+	if err != nil {
+		return dbus.Variant{}, err
+	}
+	v, ok := props[prop]
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(mprisError("no such property: " + prop))
+	}
+	return v, nil
+}
+
+func (m mprisPropsIface) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	props := m.properties(iface, m.state(iface != mprisRoot))
+	if props == nil {
+		return nil, dbus.MakeFailedError(mprisError("no such interface: " + iface))
+	}
+	return props, nil
+}
+
+// Set sets the writable properties: LoopStatus, Rate (0 pauses, as
+// only 1 is supported), Shuffle and Volume.
+func (m mprisPropsIface) Set(iface, prop string, value dbus.Variant) *dbus.Error {
+	invalid := dbus.MakeFailedError(mprisError("invalid value for " + prop))
+	if iface != mprisPlayer {
+		return dbus.MakeFailedError(mprisError("property is read-only: " + prop))
+	}
+	p := m.state(true).player
+	switch prop {
+	case "LoopStatus":
+		s, ok := value.Value().(string)
+		if !ok {
+			return invalid
+		}
+		switch {
+		case s == "Track" && !p.Repeat, s == "None" && p.Repeat:
+			m.commandChan <- cmdRepeat{}
+		case s == "Playlist" && !p.Loop, s == "None" && p.Loop:
+			m.commandChan <- cmdLoop{}
+		case s != "Track" && s != "Playlist" && s != "None":
+			return invalid
+		}
+	case "Rate":
+		rate, ok := value.Value().(float64)
+		if !ok {
+			return invalid
+		}
+		if rate == 0 && p.State == "playing" {
+			m.commandChan <- cmdPause{}
+		}
+	case "Shuffle":
+		shuffle, ok := value.Value().(bool)
+		if !ok {
+			return invalid
+		}
+		if shuffle != p.Shuffle {
+			m.commandChan <- cmdShuffle{}
+		}
+	case "Volume":
+		vol, ok := value.Value().(float64)
+		if !ok {
+			return invalid
+		}
+		if vol < 0 {
+			vol = 0
+		}
+		if vol > 1 {
+			vol = 1
+		}
+		m.commandChan <- cmdVolume{val: int(vol*320 + 0.5), mode: volAbs}
+	default:
+		return dbus.MakeFailedError(mprisError("property is read-only: " + prop))
+	}
+	return nil
+}
+
+const mprisIntrospectXML = `<node>
+  <interface name="org.mpris.MediaPlayer2">
+    <method name="Raise"/>
+    <method name="Quit"/>
+    <property name="CanQuit" type="b" access="read"/>
+    <property name="CanRaise" type="b" access="read"/>
+    <property name="HasTrackList" type="b" access="read"/>
+    <property name="Identity" type="s" access="read"/>
+    <property name="SupportedUriSchemes" type="as" access="read"/>
+    <property name="SupportedMimeTypes" type="as" access="read"/>
+  </interface>
+  <interface name="org.mpris.MediaPlayer2.Player">
+    <method name="Next"/>
+    <method name="Previous"/>
+    <method name="Pause"/>
+    <method name="PlayPause"/>
+    <method name="Stop"/>
+    <method name="Play"/>
+    <method name="Seek">
+      <arg name="Offset" type="x" direction="in"/>
+    </method>
+    <method name="SetPosition">
+      <arg name="TrackId" type="o" direction="in"/>
+      <arg name="Position" type="x" direction="in"/>
+    </method>
+    <method name="OpenUri">
+      <arg name="Uri" type="s" direction="in"/>
+    </method>
+    <signal name="Seeked">
+      <arg name="Position" type="x"/>
+    </signal>
+    <property name="PlaybackStatus" type="s" access="read"/>
+    <property name="LoopStatus" type="s" access="readwrite"/>
+    <property name="Rate" type="d" access="readwrite"/>
+    <property name="Shuffle" type="b" access="readwrite"/>
+    <property name="Metadata" type="a{sv}" access="read"/>
+    <property name="Volume" type="d" access="readwrite"/>
+    <property name="Position" type="x" access="read"/>
+    <property name="MinimumRate" type="d" access="read"/>
+    <property name="MaximumRate" type="d" access="read"/>
+    <property name="CanGoNext" type="b" access="read"/>
+    <property name="CanGoPrevious" type="b" access="read"/>
+    <property name="CanPlay" type="b" access="read"/>
+    <property name="CanPause" type="b" access="read"/>
+    <property name="CanSeek" type="b" access="read"/>
+    <property name="CanControl" type="b" access="read"/>
+  </interface>
+  <interface name="org.mpris.MediaPlayer2.TrackList">
+    <method name="GetTracksMetadata">
+      <arg name="TrackIds" type="ao" direction="in"/>
+      <arg name="Metadata" type="aa{sv}" direction="out"/>
+    </method>
+    <method name="AddTrack">
+      <arg name="Uri" type="s" direction="in"/>
+      <arg name="AfterTrack" type="o" direction="in"/>
+      <arg name="SetAsCurrent" type="b" direction="in"/>
+    </method>
+    <method name="RemoveTrack">
+      <arg name="TrackId" type="o" direction="in"/>
+    </method>
+    <method name="GoTo">
+      <arg name="TrackId" type="o" direction="in"/>
+    </method>
+    <signal name="TrackListReplaced">
+      <arg name="Tracks" type="ao"/>
+      <arg name="CurrentTrack" type="o"/>
+    </signal>
+    <property name="Tracks" type="ao" access="read"/>
+    <property name="CanEditTracks" type="b" access="read"/>
+  </interface>
+  <interface name="org.freedesktop.DBus.Properties">
+    <method name="Get">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="property" type="s" direction="in"/>
+      <arg name="value" type="v" direction="out"/>
+    </method>
+    <method name="GetAll">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="properties" type="a{sv}" direction="out"/>
+    </method>
+    <method name="Set">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="property" type="s" direction="in"/>
+      <arg name="value" type="v" direction="in"/>
+    </method>
+    <signal name="PropertiesChanged">
+      <arg name="interface" type="s"/>
+      <arg name="changed" type="a{sv}"/>
+      <arg name="invalidated" type="as"/>
+    </signal>
+  </interface>` + introspect.IntrospectDataString + `</node>`
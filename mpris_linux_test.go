@@ -0,0 +1,193 @@
+// +build linux
+
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// TestMPRIS publishes the MPRIS interface on a private session bus,
+// with a stand-in select loop serving commands from the playlist
+// globals, and checks it from a separate bus connection. It is
+// skipped unless dbus-daemon is on the PATH.
+func TestMPRIS(t *testing.T) {
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+	daemon := exec.Command("dbus-daemon", "--session", "--nofork", "--print-address")
+	stdout, err := daemon.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer daemon.Wait()
+	defer daemon.Process.Kill()
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal("cannot read bus address: ", err)
+	}
+	addr = strings.TrimSpace(addr)
+	defer os.Setenv("DBUS_SESSION_BUS_ADDRESS", os.Getenv("DBUS_SESSION_BUS_ADDRESS"))
+	os.Setenv("DBUS_SESSION_BUS_ADDRESS", addr)
+
+	// the stand-in select loop is the only goroutine touching the
+	// playlist globals, starting from an empty, stopped playlist and
+	// a backend that has exited
+	out := make(chan string)
+	close(out)
+	commandChan := make(chan interface{})
+	defer func() {
+		// quit as the real loop does; closing commandChan would race
+		// with the sends from godbus's goroutines
+		done := make(chan struct{})
+		commandChan <- cmdQuit{done: done}
+		<-done
+	}()
+	go func() {
+		savedBackend := backend
+		backend = &backendMPV
+		idTrackMap, idPosMap = map[int]string{}, map[int]int{}
+		playlist, posToShuf, shufToPos = nil, nil, nil
+		playpos, shuffle, stopped = 0, false, true
+		for c := range commandChan {
+			switch cmd := c.(type) {
+			case cmdQuit:
+				backend = savedBackend
+				close(cmd.done)
+				return
+			case cmdGetAPIState:
+				cmd.replyChan <- funcGetAPIState(ioutil.Discard, out, cmd.player)
+			case cmdSetPlaylist:
+				cmd.replyChan <- funcSetPlaylist(ioutil.Discard, out, cmd.uri, cmd.enqueue)
+			case cmdMove:
+				funcMove(cmd.id, cmd.target)
+			case cmdRemove:
+				funcRemove(ioutil.Discard, out, cmd.id)
+			case cmdShuffle:
+				funcShuffle()
+			}
+		}
+	}()
+	var ids []dbus.ObjectPath
+	for _, p := range []string{"/music/a.mp3", "/music/b.mp3", "/music/c.mp3", "/music/d.mp3"} {
+		replyChan := make(chan int, 1)
+		commandChan <- cmdSetPlaylist{uri: p, enqueue: true, replyChan: replyChan}
+		ids = append(ids, mprisTrackID(<-replyChan))
+	}
+	startMPRIS(commandChan)
+
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	obj := conn.Object(mprisName, mprisPath)
+	getAll := func(iface string) map[string]dbus.Variant {
+		var props map[string]dbus.Variant
+		if err := obj.Call(mprisProperties+".GetAll", 0, iface).Store(&props); err != nil {
+			t.Fatalf("GetAll(%s): %v", iface, err)
+		}
+		return props
+	}
+	tracks := func() []dbus.ObjectPath {
+		return getAll(mprisTrackList)["Tracks"].Value().([]dbus.ObjectPath)
+	}
+
+	player := getAll(mprisPlayer)
+	for prop, want := range map[string]interface{}{
+		"PlaybackStatus": "Stopped",
+		"LoopStatus":     "None",
+		"Shuffle":        false,
+		"CanControl":     true,
+		"CanGoNext":      true,
+	} {
+		if got := player[prop].Value(); got != want {
+			t.Errorf("Player.%s = %v, want %v", prop, got, want)
+		}
+	}
+	md := player["Metadata"].Value().(map[string]dbus.Variant)
+	if got := md["mpris:trackid"].Value(); got != ids[0] {
+		t.Errorf("Metadata mpris:trackid = %v, want %v", got, ids[0])
+	}
+	if got := md["xesam:url"].Value(); got != "file:///music/a.mp3" {
+		t.Errorf("Metadata xesam:url = %v", got)
+	}
+	trackList := getAll(mprisTrackList)
+	if got := trackList["CanEditTracks"].Value(); got != true {
+		t.Errorf("TrackList.CanEditTracks = %v", got)
+	}
+	if got := tracks(); !reflect.DeepEqual(got, ids) {
+		t.Errorf("Tracks = %v, want %v", got, ids)
+	}
+
+	// Tracks follows the playing order while shuffled
+	commandChan <- cmdShuffle{}
+	got := tracks()
+	var want []dbus.ObjectPath
+	for _, t := range getAPIState(commandChan, false).playlist.Tracks {
+		want = append(want, mprisTrackID(t.ID))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("shuffled Tracks = %v, want %v", got, want)
+	}
+	if got := getAll(mprisPlayer)["Shuffle"].Value(); got != true {
+		t.Errorf("Player.Shuffle = %v after shuffling", got)
+	}
+	commandChan <- cmdShuffle{}
+
+	// AddTrack inserts after the given track and RemoveTrack removes
+	if err := obj.Call(mprisTrackList+".AddTrack", 0,
+		"file:///music/new%20one.mp3", ids[1], false).Err; err != nil {
+		t.Fatal("AddTrack: ", err)
+	}
+	got = tracks()
+	if len(got) != 5 || got[2] == ids[2] || !reflect.DeepEqual(got[:2], ids[:2]) {
+		t.Fatalf("Tracks after AddTrack = %v", got)
+	}
+	added := got[2]
+	var mds []map[string]dbus.Variant
+	if err := obj.Call(mprisTrackList+".GetTracksMetadata", 0,
+		[]dbus.ObjectPath{added}).Store(&mds); err != nil {
+		t.Fatal("GetTracksMetadata: ", err)
+	}
+	if len(mds) != 1 || mds[0]["xesam:title"].Value() != "new one.mp3" {
+		t.Errorf("metadata of added track = %v", mds)
+	}
+	if err := obj.Call(mprisTrackList+".RemoveTrack", 0, added).Err; err != nil {
+		t.Fatal("RemoveTrack: ", err)
+	}
+	if got := tracks(); !reflect.DeepEqual(got, ids) {
+		t.Errorf("Tracks after RemoveTrack = %v, want %v", got, ids)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// A crashed backend is restarted at most maxRestarts times within
+// restartWindow, after which mplayer-rc gives up and exits.
+const (
+	maxRestarts   = 3
+	restartWindow = time.Minute
+)
+
+// restartTimes holds the times of recent backend restarts.
+var restartTimes []time.Time
+
+// allowRestart reports whether the backend may be restarted without
+// exceeding the crash loop limit, and if so records the restart.
+func allowRestart() bool {
+	now := time.Now()
+	recent := restartTimes[:0]
+	for _, t := range restartTimes {
+		if now.Sub(t) < restartWindow {
+			recent = append(recent, t)
+		}
+	}
+	restartTimes = recent
+	if len(restartTimes) >= maxRestarts {
+		return false
+	}
+	restartTimes = append(restartTimes, now)
+	return true
+}
+
+// the playback state, recorded every second by the select loop (see
+// recordPlayback) so that it can be restored if the backend crashes.
+var (
+	lastVolume  = -1 // 0 -> 320, or -1 if unknown
+	lastTimePos int
+	lastPaused  bool
+)
+
+// recordPlayback records the volume, position and pause state of the
+// current track, and updates the resume store.
+func recordPlayback(in io.Writer, outChan <-chan string) {
+	timePos := getProp(in, outChan, backend.propTimePos)
+	switch timePos {
+	case "(unavailable)", "(error)":
+		// nothing playing or the backend has crashed
+		return
+	}
+	lastTimePos = getInt(timePos)
+	lastVolume = getInt(getProp(in, outChan, backend.propVolume))
+	lastPaused = getProp(in, outChan, "pause") == "yes"
+	resumeRecord(lastTimePos)
+}
+
+// funcRestore restores the playback state recorded by recordPlayback
+// after the backend has been relaunched, resuming the current track
+// unless playback was stopped.
+func funcRestore(in io.Writer, outChan <-chan string) {
+	timePos, paused := lastTimePos, lastPaused
+	if !stopped {
+		funcPlay(in, outChan, -1)
+		if timePos > 0 {
+			funcSeek(in, timePos, seekAbs)
+		}
+		if paused {
+			funcPause(in, outChan)
+		}
+	}
+	if lastVolume >= 0 {
+		funcVolume(in, lastVolume, volAbs)
+	}
+}
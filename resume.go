@@ -0,0 +1,254 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the resume settings, set by main
+var (
+	resumeEnabled   bool
+	resumeByHash    bool            // key tracks by content hash, not path
+	resumeMinLength = 600           // only resume tracks at least this long (seconds)
+	resumeExclude   map[string]bool // file extensions (e.g. ".mp3") never resumed
+)
+
+const (
+	// a position within resumeMargin of either end of a track is not
+	// worth resuming from
+	resumeMargin = 30
+	// the resume store is written at most this often while playing
+	resumeSaveInterval = 30 * time.Second
+	// the resume store keeps at most this many entries
+	resumeMaxEntries = 1000
+)
+
+type resumeEntry struct {
+	Pos     int       `json:"pos"`    // seconds
+	Length  int       `json:"length"` // seconds
+	Updated time.Time `json:"updated"`
+}
+
+// the resume store and its bookkeeping. Like the playlist state it is
+// only accessed from the select loop.
+var (
+	resumeStore   map[string]resumeEntry // resume key -> entry
+	resumeDirty   bool
+	resumeSaved   time.Time
+	resumeKeys    = map[int]string{} // track id -> resume key
+	resumeLengths = map[int]int{}    // track id -> length, if resumable
+)
+
+func resumeFile() string {
+	return filepath.Join(configDir(), "resume.json")
+}
+
+// loadResumeStore reads the resume store from disk.
+func loadResumeStore() {
+	resumeStore = map[string]resumeEntry{}
+	b, err := ioutil.ReadFile(resumeFile())
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(b, &resumeStore); err != nil {
+		logWarn("cannot load resume positions", "file", resumeFile(), "err", err)
+	}
+}
+
+// saveResumeStore writes the resume store to disk if it has changed,
+// discarding the oldest entries if there are too many.
+func saveResumeStore() {
+	if !resumeDirty {
+		return
+	}
+	if len(resumeStore) > resumeMaxEntries {
+		keys := make([]string, 0, len(resumeStore))
+		for k := range resumeStore {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return resumeStore[keys[i]].Updated.After(resumeStore[keys[j]].Updated)
+		})
+		for _, k := range keys[resumeMaxEntries:] {
+			delete(resumeStore, k)
+		}
+	}
+	b, err := json.MarshalIndent(resumeStore, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(configDir(), 0700); err == nil {
+			err = writeFile(resumeFile(), b, 0600)
+		}
+	}
+	if err != nil {
+		logError("cannot save resume positions", "err", err)
+		return
+	}
+	resumeDirty = false
+	resumeSaved = time.Now()
+}
+
+// resumeKey returns the resume store key of track id: its path, or a
+// hash of its size and first and last 64KiB if resumeByHash is set
+// (so that the position survives the file being moved or renamed).
+func resumeKey(id int) string {
+	if key, ok := resumeKeys[id]; ok {
+		return key
+	}
+	track := idTrackMap[id]
+	key := track
+	if p := trackPath(track); p != "" {
+		if abs, err := filepath.Abs(p); err == nil {
+			key = abs
+		}
+		if resumeByHash {
+			if h, err := hashFile(p); err == nil {
+				key = h
+			}
+		}
+	}
+	resumeKeys[id] = key
+	return key
+}
+
+func hashFile(name string) (string, error) {
+	const chunk = 64 << 10
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "%d\n", fi.Size())
+	if _, err := io.CopyN(h, f, chunk); err != nil && err != io.EOF {
+		return "", err
+	}
+	if fi.Size() > 2*chunk {
+		if _, err := f.Seek(-chunk, io.SeekEnd); err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+	}
+	return "sha1:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// resumeStart is called by funcPlay once track id has started
+// playing. If the track is resumable and has a stored position, it
+// seeks there.
+func resumeStart(in io.Writer, outChan <-chan string, id int) {
+	if !resumeEnabled {
+		return
+	}
+	delete(resumeLengths, id)
+	track := idTrackMap[id]
+	if resumeExclude[strings.ToLower(filepath.Ext(trackPath(track)))] {
+		return
+	}
+	length := getInt(getProp(in, outChan, backend.propLength))
+	if length < resumeMinLength {
+		return
+	}
+	resumeLengths[id] = length
+	e, ok := resumeStore[resumeKey(id)]
+	if ok && e.Pos > resumeMargin && e.Pos < length-resumeMargin {
+		funcSeek(in, e.Pos, seekAbs)
+	}
+}
+
+// resumeRecord records timePos as the position of the current track,
+// if it is resumable, and periodically saves the resume store.
+func resumeRecord(timePos int) {
+	if !resumeEnabled || len(playlist) == 0 {
+		return
+	}
+	id := playlist[playpos]
+	length, ok := resumeLengths[id]
+	if !ok {
+		return
+	}
+	key := resumeKey(id)
+	if timePos < length-resumeMargin {
+		resumeStore[key] = resumeEntry{
+			Pos: timePos, Length: length, Updated: time.Now()}
+	} else {
+		delete(resumeStore, key)
+	}
+	resumeDirty = true
+	if time.Since(resumeSaved) >= resumeSaveInterval {
+		saveResumeStore()
+	}
+}
+
+// resumeFinished forgets the position of the current track, which has
+// played to the end.
+func resumeFinished() {
+	if !resumeEnabled || len(playlist) == 0 {
+		return
+	}
+	id := playlist[playpos]
+	if _, ok := resumeLengths[id]; !ok {
+		return
+	}
+	if _, ok := resumeStore[resumeKey(id)]; ok {
+		delete(resumeStore, resumeKey(id))
+		resumeDirty = true
+	}
+	saveResumeStore()
+}
+
+// resumeCheckpoint records the position of the current track and
+// saves the resume store. It is called when playback is stopped or a
+// different track is chosen, and on quit.
+func resumeCheckpoint(in io.Writer, outChan <-chan string) {
+	if !resumeEnabled {
+		return
+	}
+	if !stopped {
+		timePos := getProp(in, outChan, backend.propTimePos)
+		switch timePos {
+		case "(unavailable)", "(error)":
+		default:
+			resumeRecord(getInt(timePos))
+		}
+	}
+	saveResumeStore()
+}
+
+func init() {
+	quitHooks = append(quitHooks, resumeCheckpoint)
+}
@@ -0,0 +1,179 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// sessionEnabled, set by main, causes the session to be saved.
+var sessionEnabled bool
+
+// session is the saved playlist and player state.
+type session struct {
+	IDs       []int    `json:"ids"`    // playlist pos -> track id
+	Tracks    []string `json:"tracks"` // playlist pos -> track
+	PosToShuf []int    `json:"pos_to_shuf"`
+	PlayPos   int      `json:"playpos"`
+	Shuffle   bool     `json:"shuffle"`
+	Loop      bool     `json:"loop"`
+	Repeat    bool     `json:"repeat"`
+	Stopped   bool     `json:"stopped"`
+	Volume    int      `json:"volume"`   // 0 -> 320, or -1 if unknown
+	TimePos   int      `json:"time_pos"` // seconds
+}
+
+// lastSession is the last session written, with TimePos zeroed, so
+// that the session is only written when something other than the
+// playback position has changed.
+var lastSession []byte
+
+func sessionFile() string {
+	return filepath.Join(configDir(), "session.json")
+}
+
+// currentSession captures the current playlist and player state.
+func currentSession() *session {
+	s := &session{
+		IDs:       append([]int{}, playlist...),
+		PosToShuf: append([]int{}, posToShuf...),
+		PlayPos:   playpos,
+		Shuffle:   shuffle,
+		Loop:      loop,
+		Repeat:    repeat,
+		Stopped:   stopped,
+		Volume:    lastVolume,
+		TimePos:   lastTimePos,
+	}
+	for _, id := range playlist {
+		s.Tracks = append(s.Tracks, idTrackMap[id])
+	}
+	return s
+}
+
+// saveSession writes the session file if the session has changed
+// since it was last written, or unconditionally if force is set.
+func saveSession(force bool) {
+	if !sessionEnabled {
+		return
+	}
+	s := currentSession()
+	timePos := s.TimePos
+	s.TimePos = 0
+	key, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	if !force && bytes.Equal(key, lastSession) {
+		return
+	}
+	s.TimePos = timePos
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(configDir(), 0700); err == nil {
+			err = writeFile(sessionFile(), b, 0600)
+		}
+	}
+	if err != nil {
+		logError("cannot save session", "err", err)
+		return
+	}
+	lastSession = key
+}
+
+// loadSession reconstructs the playlist, shuffle, loop/repeat and
+// stopped state from the session file. It also sets lastVolume and
+// lastTimePos so that funcRestore restores the volume and position.
+func loadSession() error {
+	b, err := ioutil.ReadFile(sessionFile())
+	if err != nil {
+		return err
+	}
+	var s session
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	n := len(s.IDs)
+	if len(s.Tracks) != n {
+		return errors.New("corrupt session: ids and tracks differ")
+	}
+	// build the state in locals so that the globals are untouched if
+	// the session turns out to be corrupt
+	tracks := map[int]string{}
+	positions := map[int]int{}
+	counter := idCounter
+	for pos, id := range s.IDs {
+		if _, dup := tracks[id]; dup || id < 4 {
+			return errors.New("corrupt session: bad track id")
+		}
+		tracks[id] = s.Tracks[pos]
+		positions[id] = pos
+		if id >= counter {
+			counter = id + 1
+		}
+	}
+	toShuf := make([]int, n)
+	toPos := make([]int, n)
+	for i := range toPos {
+		toPos[i] = -1
+	}
+	valid := len(s.PosToShuf) == n
+	for pos := 0; valid && pos < n; pos++ {
+		shuf := s.PosToShuf[pos]
+		if shuf < 0 || shuf >= n || toPos[shuf] != -1 {
+			valid = false
+			break
+		}
+		toShuf[pos] = shuf
+		toPos[shuf] = pos
+	}
+	if !valid {
+		// not a permutation, so fall back to playlist order
+		for i := range toShuf {
+			toShuf[i], toPos[i] = i, i
+		}
+		s.Shuffle = false
+	}
+	idTrackMap, idPosMap, idCounter = tracks, positions, counter
+	playlist = append([]int{}, s.IDs...)
+	posToShuf, shufToPos = toShuf, toPos
+	playpos = 0
+	if s.PlayPos >= 0 && s.PlayPos < n {
+		playpos = s.PlayPos
+	}
+	shuffle, loop, repeat = s.Shuffle, s.Loop, s.Repeat
+	stopped = s.Stopped
+	lastVolume, lastTimePos = s.Volume, s.TimePos
+	return nil
+}
+
+func init() {
+	quitHooks = append(quitHooks, func(in io.Writer, outChan <-chan string) {
+		saveSession(true)
+	})
+}
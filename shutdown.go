@@ -0,0 +1,154 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// exit statuses. Exits caused by a signal use 128 + the signal
+// number, as a shell would.
+const (
+	exitOK      = 0 // quit by the remote or the backend's user
+	exitFailure = 1 // the backend failed
+)
+
+// shutdownTimeout bounds how long shutdown waits for in-flight HTTP
+// requests to finish, and separately for the backend to quit before
+// it is killed.
+const shutdownTimeout = 5 * time.Second
+
+var (
+	webServersMu sync.Mutex
+	webServers   []*http.Server
+	shutdownOnce sync.Once
+	shuttingDown int32 // set to 1 (atomically) by shutdown
+	// shutdownStarted is closed by shutdown, so that long-lived
+	// requests (e.g. /events) can finish
+	shutdownStarted = make(chan struct{})
+	// serverTasks counts the goroutines serving clients and devices
+	// other than through the web servers (e.g. MPD connections and
+	// input devices), which end when shutdownStarted is closed
+	serverTasks sync.WaitGroup
+)
+
+// addWebServer registers s to be shut down by shutdown.
+func addWebServer(s *http.Server) {
+	webServersMu.Lock()
+	webServers = append(webServers, s)
+	webServersMu.Unlock()
+}
+
+// quitHooks are run from the select loop when it receives cmdQuit,
+// before the backend is told to quit, so that state can be persisted.
+// If the backend has already exited, getProp returns "(unavailable)"
+// to them.
+var quitHooks []func(in io.Writer, outChan <-chan string)
+
+// shutdown stops mplayer-rc and exits with status code. It stops the
+// web servers accepting requests, waits for in-flight requests and
+// serverTasks to finish, then sends cmdQuit to the select loop and
+// waits for it to stop the backend.
+//
+// shutdown returns immediately, doing its work in a goroutine, so it
+// may be called from any goroutine including the select loop. Only
+// the first call has any effect.
+func shutdown(commandChan chan<- interface{}, code int) {
+	shutdownOnce.Do(func() {
+		atomic.StoreInt32(&shuttingDown, 1)
+		close(shutdownStarted)
+		sdNotify("STOPPING=1")
+		go func() {
+			ctx, cancel := context.WithTimeout(
+				context.Background(), shutdownTimeout)
+			defer cancel()
+			webServersMu.Lock()
+			servers := append([]*http.Server{}, webServers...)
+			webServersMu.Unlock()
+			var wg sync.WaitGroup
+			for _, s := range servers {
+				wg.Add(1)
+				go func(s *http.Server) {
+					s.Shutdown(ctx)
+					wg.Done()
+				}(s)
+			}
+			wg.Wait()
+			tasksDone := make(chan struct{})
+			go func() {
+				serverTasks.Wait()
+				close(tasksDone)
+			}()
+			select {
+			case <-tasksDone:
+			case <-ctx.Done():
+				logWarn("timed out waiting for clients to disconnect")
+			}
+			done := make(chan struct{})
+			commandChan <- cmdQuit{done: done}
+			select {
+			case <-done:
+			case <-time.After(2 * shutdownTimeout):
+				logError("timed out waiting for select loop")
+			}
+			os.Exit(code)
+		}()
+	})
+}
+
+// isShuttingDown reports whether shutdown has been called.
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// funcQuit runs quitHooks and tells the backend to quit, killing it if
+// it does not do so within shutdownTimeout.
+func funcQuit(proc *backendProcess, in io.Writer, outChan <-chan string) {
+	for _, hook := range quitHooks {
+		hook(in, outChan)
+	}
+	if !proc.running() {
+		return
+	}
+	fmt.Fprintf(in, backend.cmdQuit+"\n")
+	timeout := time.After(shutdownTimeout)
+	for {
+		select {
+		case <-proc.exited:
+			return
+		case <-outChan:
+			// discard output so the backend does not block on it
+		case <-timeout:
+			logWarn("backend did not quit, killing it",
+				"backend", backend.binary)
+			proc.cmd.Process.Kill()
+			timeout = nil
+		}
+	}
+}
@@ -23,6 +23,23 @@
 
 package main
 
-func startSignalHandler() {
-	// currently a noop on non-unix
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// startSignalHandler calls shutdown on an interrupt.
+func startSignalHandler(commandChan chan<- interface{}) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	go func() {
+		<-sigChan
+		shutdown(commandChan, 128+2)
+	}()
+}
+
+// backendSysProcAttr returns the backend's process attributes.
+func backendSysProcAttr() *syscall.SysProcAttr {
+	return nil
 }
@@ -26,15 +26,29 @@ package main
 import (
 	"os"
 	"os/signal"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
-func startSignalHandler() {
+// startSignalHandler calls shutdown on SIGINT, SIGTERM or SIGHUP. The
+// backend exiting (SIGCHLD) is noticed by the select loop waiting on
+// the backend process rather than here, since SIGCHLD does not say
+// which child exited.
+func startSignalHandler(commandChan chan<- interface{}) {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, unix.SIGCHLD)
+	signal.Notify(sigChan, unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
 	go func() {
-		<-sigChan
-		os.Exit(0)
+		sig := <-sigChan
+		shutdown(commandChan, 128+int(sig.(unix.Signal)))
 	}()
 }
+
+// backendSysProcAttr puts the backend in its own process group, so
+// that a Ctrl-C in the terminal reaches only mplayer-rc, which then
+// stops the backend itself. Were the backend to see the signal too,
+// it could exit before shutdown had started and be taken to have
+// crashed.
+func backendSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
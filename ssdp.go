@@ -0,0 +1,284 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SSDP, by which UPnP control points find the MediaRenderer. It
+// answers M-SEARCH requests and sends NOTIFY advertisements on every
+// IPv4 multicast interface.
+
+var ssdpAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// ssdpAnswered records when M-SEARCH requests were last answered,
+// keyed by requester and search target, as a request arriving on
+// several interfaces is seen by each of their sockets.
+var (
+	ssdpAnsweredMu sync.Mutex
+	ssdpAnswered   = map[string]time.Time{}
+)
+
+// startSSDP starts SSDP for the UPnP server listening on addr.
+func startSSDP(addr *net.TCPAddr) {
+	ifaces, err := ssdpInterfaces()
+	if err != nil || len(ifaces) == 0 {
+		logWarn("upnp: no multicast interfaces, discovery disabled", "err", err)
+		return
+	}
+	n := 0
+	for i := range ifaces {
+		c, err := net.ListenMulticastUDP("udp4", &ifaces[i], ssdpAddr)
+		if err != nil {
+			logWarn("upnp: cannot join ssdp group", "iface", ifaces[i].Name, "err", err)
+			continue
+		}
+		if err := ssdpRecvDst(c); err != nil {
+			logWarn("upnp: cannot read ssdp destinations", "iface", ifaces[i].Name, "err", err)
+		}
+		n++
+		go ssdpServe(c, ssdpNets(&ifaces[i]), addr)
+	}
+	if n == 0 {
+		return
+	}
+	go ssdpAdvertise(ifaces, addr)
+}
+
+// ssdpInterfaces returns the interfaces that are up and support
+// multicast.
+func ssdpInterfaces() ([]net.Interface, error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ifaces []net.Interface
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 &&
+			ssdpIfaceIP(&ifi) != nil {
+			ifaces = append(ifaces, ifi)
+		}
+	}
+	return ifaces, nil
+}
+
+// ssdpNets returns the networks of ifi.
+func ssdpNets(ifi *net.Interface) []*net.IPNet {
+	var nets []*net.IPNet
+	addrs, _ := ifi.Addrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// ssdpIfaceIP returns the first IPv4 address of ifi, or nil.
+func ssdpIfaceIP(ifi *net.Interface) net.IP {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			return n.IP.To4()
+		}
+	}
+	return nil
+}
+
+// ssdpTargets returns the notification types (search targets) and
+// unique service names advertised.
+func ssdpTargets() (nts, usns []string) {
+	uuid := "uuid:" + upnpUUID()
+	nts = []string{"upnp:rootdevice", uuid, upnpDeviceType}
+	for _, s := range upnpServices {
+		nts = append(nts, s.serviceType())
+	}
+	for _, nt := range nts {
+		if nt == uuid {
+			usns = append(usns, uuid)
+		} else {
+			usns = append(usns, uuid+"::"+nt)
+		}
+	}
+	return nts, usns
+}
+
+// ssdpLocation returns the device description URL as reached from ip.
+func ssdpLocation(ip net.IP, addr *net.TCPAddr) string {
+	if !addr.IP.IsUnspecified() {
+		ip = addr.IP
+	}
+	return "http://" + net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port)) +
+		"/upnp/device.xml"
+}
+
+// ssdpServe answers the M-SEARCH requests received on c from the
+// networks nets. Only searches sent to the multicast group are
+// answered: as c is bound to the wildcard address, it also receives
+// unicast ones, which could come from anywhere with a forged source
+// and turn the renderer into a reflector.
+func ssdpServe(c *net.UDPConn, nets []*net.IPNet, addr *net.TCPAddr) {
+	buf := make([]byte, 2048)
+	oob := make([]byte, 256)
+	for {
+		n, oobn, _, src, err := c.ReadMsgUDP(buf, oob)
+		if err != nil {
+			logWarn("upnp: ssdp read failed", "err", err)
+			return
+		}
+		if dst := ssdpDst(oob[:oobn]); dst != nil && !dst.Equal(ssdpAddr.IP) {
+			continue
+		}
+		if !ssdpOnLink(nets, src.IP) || !clientAllowed(src.IP) {
+			continue
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" ||
+			req.Header.Get("MAN") != `"ssdp:discover"` ||
+			(req.Host != ssdpAddr.String() && req.Host != ssdpAddr.IP.String()) {
+			continue
+		}
+		st := req.Header.Get("ST")
+		key := src.String() + " " + st
+		ssdpAnsweredMu.Lock()
+		recent := time.Since(ssdpAnswered[key]) < time.Second
+		ssdpAnswered[key] = time.Now()
+		for k, t := range ssdpAnswered {
+			if time.Since(t) > time.Minute {
+				delete(ssdpAnswered, k)
+			}
+		}
+		ssdpAnsweredMu.Unlock()
+		if recent {
+			continue
+		}
+		mx, _ := strconv.Atoi(req.Header.Get("MX"))
+		go ssdpRespond(src, st, mx, addr)
+	}
+}
+
+func ssdpOnLink(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ssdpRespond answers a search for st from src, after a random delay
+// of up to mx seconds as the protocol requires.
+func ssdpRespond(src *net.UDPAddr, st string, mx int, addr *net.TCPAddr) {
+	nts, usns := ssdpTargets()
+	var matches []int
+	for i, nt := range nts {
+		if st == "ssdp:all" || st == nt {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+	if mx > 5 {
+		mx = 5
+	}
+	if mx > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(mx) * int64(time.Second))))
+	}
+	c, err := net.DialUDP("udp4", nil, src)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	location := ssdpLocation(c.LocalAddr().(*net.UDPAddr).IP, addr)
+	for _, i := range matches {
+		fmt.Fprintf(c, "HTTP/1.1 200 OK\r\n"+
+			"CACHE-CONTROL: max-age=%d\r\n"+
+			"DATE: %s\r\n"+
+			"EXT:\r\n"+
+			"LOCATION: %s\r\n"+
+			"SERVER: %s\r\n"+
+			"ST: %s\r\n"+
+			"USN: %s\r\n"+
+			"\r\n",
+			upnpMaxAge, time.Now().UTC().Format(http.TimeFormat),
+			location, upnpServerHeader(), nts[i], usns[i])
+	}
+}
+
+// ssdpAdvertise sends NOTIFY advertisements on each interface, at
+// start and then periodically, and withdraws them on shutdown.
+func ssdpAdvertise(ifaces []net.Interface, addr *net.TCPAddr) {
+	ssdpNotify(ifaces, addr, "ssdp:alive")
+	ticker := time.NewTicker(upnpMaxAge / 3 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ssdpNotify(ifaces, addr, "ssdp:alive")
+		case <-shutdownStarted:
+			ssdpNotify(ifaces, addr, "ssdp:byebye")
+			return
+		}
+	}
+}
+
+func ssdpNotify(ifaces []net.Interface, addr *net.TCPAddr, nts string) {
+	targets, usns := ssdpTargets()
+	for i := range ifaces {
+		ip := ssdpIfaceIP(&ifaces[i])
+		if ip == nil {
+			continue
+		}
+		c, err := net.DialUDP("udp4", &net.UDPAddr{IP: ip}, ssdpAddr)
+		if err != nil {
+			logDebug("upnp: cannot send ssdp notify", "iface", ifaces[i].Name, "err", err)
+			continue
+		}
+		for j, nt := range targets {
+			msg := "NOTIFY * HTTP/1.1\r\n" +
+				"HOST: 239.255.255.250:1900\r\n" +
+				"NT: " + nt + "\r\n" +
+				"NTS: " + nts + "\r\n" +
+				"USN: " + usns[j] + "\r\n"
+			if nts == "ssdp:alive" {
+				msg += fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", upnpMaxAge) +
+					"LOCATION: " + ssdpLocation(ip, addr) + "\r\n" +
+					"SERVER: " + upnpServerHeader() + "\r\n"
+			}
+			c.Write([]byte(msg + "\r\n"))
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,156 @@
+// +build linux
+
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// systemd integration: readiness and watchdog notification for
+// Type=notify services, socket activation, and journal friendly
+// logging. See sd_notify(3), sd_listen_fds(3) and systemd.exec(5).
+// All of it is inactive unless the relevant environment variables
+// have been set by systemd.
+
+// sdNotify sends state (e.g. "READY=1") to the service manager. It
+// does nothing if mplayer-rc was not started as a notify service.
+func sdNotify(state string) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return
+	}
+	// a leading @ denotes an abstract socket, which net handles
+	c, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		logWarn("sd_notify failed", "err", err)
+		return
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(state)); err != nil {
+		logWarn("sd_notify failed", "err", err)
+	}
+}
+
+// the watchdog state. watchdogInterval is half the interval given by
+// WatchdogSec=, or zero if the watchdog is not enabled.
+var (
+	watchdogInterval time.Duration
+	watchdogLast     time.Time
+)
+
+// watchdogPing tells the service manager mplayer-rc is alive if
+// watchdogInterval has passed since it last did so. It is called by
+// the select loop so that a wedged select loop (e.g. waiting on an
+// unresponsive backend) causes systemd to restart mplayer-rc.
+func watchdogPing() {
+	if watchdogInterval == 0 || time.Since(watchdogLast) < watchdogInterval {
+		return
+	}
+	sdNotify("WATCHDOG=1")
+	watchdogLast = time.Now()
+}
+
+// activatedListener is a listening socket passed in by systemd.
+type activatedListener struct {
+	net.Listener
+	name string // from FileDescriptorName=, if set
+}
+
+// activatedListeners are the sockets passed in by systemd. If there
+// are any, the web server uses them instead of listenSpecs.
+var activatedListeners []activatedListener
+
+// the first file descriptor passed by socket activation
+const listenFdsStart = 3
+
+// initSystemd reads the systemd environment variables, taking over
+// any sockets passed in, and unsets them so that they are not seen by
+// the backend. It must be called before the backend is launched, so
+// that the sockets are not inherited by it.
+func initSystemd() {
+	defer func() {
+		for _, v := range []string{"LISTEN_PID", "LISTEN_FDS",
+			"LISTEN_FDNAMES", "WATCHDOG_PID", "WATCHDOG_USEC"} {
+			os.Unsetenv(v)
+		}
+	}()
+	pid := strconv.Itoa(os.Getpid())
+	if p := os.Getenv("WATCHDOG_PID"); p == "" || p == pid {
+		usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+		if err == nil && usec > 0 {
+			watchdogInterval = time.Duration(usec) * time.Microsecond / 2
+		}
+	}
+	if journalStream() {
+		// the journal timestamps each line itself
+		log.SetFlags(0)
+		logJournal = true
+	}
+	if os.Getenv("LISTEN_PID") != pid {
+		return
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+		// FileListener dups the descriptor (close-on-exec), so the
+		// original can be closed
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("mplayer-rc: socket activation: fd %d: %v", fd, err)
+		}
+		a := activatedListener{Listener: l}
+		if i < len(names) {
+			a.name = names[i]
+		}
+		activatedListeners = append(activatedListeners, a)
+	}
+}
+
+// journalStream reports whether stderr is connected to the journal.
+func journalStream() bool {
+	var dev, ino uint64
+	js := os.Getenv("JOURNAL_STREAM")
+	if _, err := fmt.Sscanf(js, "%d:%d", &dev, &ino); err != nil {
+		return false
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		return false
+	}
+	return uint64(st.Dev) == dev && uint64(st.Ino) == ino
+}
@@ -0,0 +1,1129 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The UPnP MediaRenderer, so that DLNA control points (BubbleUPnP,
+// phones' cast menus...) can push media to mplayer-rc. It is served
+// on its own plain HTTP listener, as control points cannot log in,
+// and is found by them through SSDP (see ssdp.go). The AVTransport,
+// RenderingControl and ConnectionManager services send the same
+// commands as the REST API.
+//
+// SetAVTransportURI adds the URI to the end of the playlist, and the
+// next Play plays it.
+
+// the UPnP settings, set by main
+var (
+	upnpListen string // empty if disabled
+	upnpName   string // the friendly name, or "" for the default
+)
+
+const upnpDefaultPort = "49494"
+
+const (
+	upnpDeviceType = "urn:schemas-upnp-org:device:MediaRenderer:1"
+	upnpMaxAge     = 1800 // seconds an advertisement is valid for
+)
+
+// upnpService is a service of the MediaRenderer.
+type upnpService struct {
+	name       string // e.g. "AVTransport"
+	actions    []upnpAction
+	stateVars  []upnpStateVar
+	lastChange string // LastChange event namespace, if it has one
+}
+
+func (s *upnpService) serviceType() string {
+	return "urn:schemas-upnp-org:service:" + s.name + ":1"
+}
+
+type upnpAction struct {
+	name string
+	in   []upnpArg
+	out  []upnpArg
+	fn   func(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError)
+}
+
+// upnpArg is an action argument and its related state variable.
+type upnpArg struct {
+	name, stateVar string
+}
+
+type upnpStateVar struct {
+	name     string
+	dataType string
+	events   bool
+	allowed  []string
+}
+
+// upnpValue is an output argument. Their order matters to some
+// control points.
+type upnpValue struct {
+	name, value string
+}
+
+type upnpError struct {
+	code int
+	desc string
+}
+
+var (
+	upnpInvalidAction   = &upnpError{401, "Invalid Action"}
+	upnpInvalidArgs     = &upnpError{402, "Invalid Args"}
+	upnpActionFailed    = &upnpError{501, "Action Failed"}
+	upnpSeekModeInvalid = &upnpError{710, "Seek mode not supported"}
+	upnpSeekTarget      = &upnpError{711, "Illegal seek target"}
+	upnpInstanceID      = &upnpError{718, "Invalid InstanceID"}
+)
+
+// the UPnP state, guarded by upnpMu
+var (
+	upnpMu sync.Mutex
+	// upnpPending is the track added by SetAVTransportURI, to be
+	// played by the next Play, or -1
+	upnpPending = -1
+	// upnpLast is the track added by the last SetAVTransportURI, which
+	// the next one replaces, or -1
+	upnpLast = -1
+	// upnpMetaData holds the DIDL-Lite metadata control points gave
+	// for the tracks they added, by track id. Entries are deleted when
+	// their tracks leave the playlist.
+	upnpMetaData = map[int]string{}
+	// upnpSets counts the SetAVTransportURI calls, so that upnpPrune
+	// can tell a track added since it fetched the playlist
+	upnpSets int
+	upnpSubs     = map[string]*upnpSub{} // event subscriptions by SID
+)
+
+// upnpUUID returns the device's UUID, which is derived from the host
+// name and friendly name so that it is stable across restarts.
+func upnpUUID() string {
+	host, _ := os.Hostname()
+	h := sha1.Sum([]byte("mplayer-rc\n" + host + "\n" + upnpFriendlyName()))
+	h[6] = h[6]&0x0f | 0x50 // version 5
+	h[8] = h[8]&0x3f | 0x80 // variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+func upnpFriendlyName() string {
+	if upnpName != "" {
+		return upnpName
+	}
+	return defaultServiceName()
+}
+
+// startUPnP opens the UPnP listener and starts serving it and SSDP.
+func startUPnP(commandChan chan<- interface{}) {
+	a := parseListen(upnpListen, upnpDefaultPort)
+	if a.isUnix() {
+		log.Fatalf("mplayer-rc: upnp: a TCP address is needed")
+	}
+	l, err := listen(a)
+	if err != nil {
+		log.Fatalf("mplayer-rc: failed to start upnp server: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upnp/device.xml", func(w http.ResponseWriter, r *http.Request) {
+		if !admitted(w, r) {
+			return
+		}
+		countRequest("upnp", "")
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		io.WriteString(w, upnpDeviceXML())
+	})
+	for _, s := range upnpServices {
+		s := s
+		mux.HandleFunc("/upnp/"+s.name+".xml", func(w http.ResponseWriter, r *http.Request) {
+			if !admitted(w, r) {
+				return
+			}
+			countRequest("upnp", "")
+			w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+			io.WriteString(w, s.scpd())
+		})
+		mux.HandleFunc("/upnp/control/"+s.name, func(w http.ResponseWriter, r *http.Request) {
+			if !admitted(w, r) {
+				return
+			}
+			countRequest("upnp", "")
+			upnpControl(commandChan, s, w, r)
+		})
+		mux.HandleFunc("/upnp/event/"+s.name, func(w http.ResponseWriter, r *http.Request) {
+			if !admitted(w, r) {
+				return
+			}
+			countRequest("upnp", "")
+			upnpEvent(commandChan, s, w, r)
+		})
+	}
+	srv := &http.Server{Handler: accessLog(mux)}
+	addWebServer(srv)
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			logError("upnp server", "err", err)
+		}
+	}()
+	tcpAddr := l.Addr().(*net.TCPAddr)
+	logInfo("upnp renderer listening", "addr", tcpAddr, "name", upnpFriendlyName())
+	startSSDP(tcpAddr)
+	ch := make(chan []byte, subscriberBuffer)
+	commandChan <- cmdSubscribe{ch: ch}
+	go upnpWatch(commandChan, ch)
+}
+
+// upnpEscape escapes s for inclusion in XML.
+func upnpEscape(s string) string {
+	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+func upnpDeviceXML() string {
+	buf := new(bytes.Buffer)
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>` + upnpDeviceType + `</deviceType>
+    <friendlyName>` + upnpEscape(upnpFriendlyName()) + `</friendlyName>
+    <manufacturer>MPlayer-RC</manufacturer>
+    <manufacturerURL>https://xi2.org/x/mplayer-rc</manufacturerURL>
+    <modelName>MPlayer-RC</modelName>
+    <modelNumber>` + upnpEscape(upnpVersion()) + `</modelNumber>
+    <UDN>uuid:` + upnpUUID() + `</UDN>
+    <dlna:X_DLNADOC>DMR-1.50</dlna:X_DLNADOC>
+    <serviceList>
+`)
+	for _, s := range upnpServices {
+		fmt.Fprintf(buf, `      <service>
+        <serviceType>%s</serviceType>
+        <serviceId>urn:upnp-org:serviceId:%s</serviceId>
+        <SCPDURL>/upnp/%s.xml</SCPDURL>
+        <controlURL>/upnp/control/%s</controlURL>
+        <eventSubURL>/upnp/event/%s</eventSubURL>
+      </service>
+`, s.serviceType(), s.name, s.name, s.name, s.name)
+	}
+	buf.WriteString("    </serviceList>\n  </device>\n</root>\n")
+	return buf.String()
+}
+
+// scpd returns the service description.
+func (s *upnpService) scpd() string {
+	buf := new(bytes.Buffer)
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+`)
+	for _, a := range s.actions {
+		fmt.Fprintf(buf, "    <action>\n      <name>%s</name>\n      <argumentList>\n", a.name)
+		for _, args := range []struct {
+			dir  string
+			args []upnpArg
+		}{{"in", a.in}, {"out", a.out}} {
+			for _, arg := range args.args {
+				fmt.Fprintf(buf, "        <argument><name>%s</name><direction>%s</direction>"+
+					"<relatedStateVariable>%s</relatedStateVariable></argument>\n",
+					arg.name, args.dir, arg.stateVar)
+			}
+		}
+		buf.WriteString("      </argumentList>\n    </action>\n")
+	}
+	buf.WriteString("  </actionList>\n  <serviceStateTable>\n")
+	for _, v := range s.stateVars {
+		events := "no"
+		if v.events {
+			events = "yes"
+		}
+		fmt.Fprintf(buf, "    <stateVariable sendEvents=\"%s\"><name>%s</name><dataType>%s</dataType>",
+			events, v.name, v.dataType)
+		if len(v.allowed) > 0 {
+			buf.WriteString("<allowedValueList>")
+			for _, a := range v.allowed {
+				fmt.Fprintf(buf, "<allowedValue>%s</allowedValue>", a)
+			}
+			buf.WriteString("</allowedValueList>")
+		}
+		buf.WriteString("</stateVariable>\n")
+	}
+	buf.WriteString("  </serviceStateTable>\n</scpd>\n")
+	return buf.String()
+}
+
+// upnpControl handles a SOAP action request.
+func upnpControl(commandChan chan<- interface{}, s *upnpService, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var env struct {
+		Body struct {
+			Action struct {
+				XMLName xml.Name
+				Args    []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&env); err != nil {
+		upnpFault(w, upnpInvalidAction)
+		return
+	}
+	name := env.Body.Action.XMLName.Local
+	args := map[string]string{}
+	for _, arg := range env.Body.Action.Args {
+		args[arg.XMLName.Local] = arg.Value
+	}
+	var action *upnpAction
+	for i := range s.actions {
+		if s.actions[i].name == name {
+			action = &s.actions[i]
+		}
+	}
+	if action == nil {
+		logDebug("unknown upnp action", "service", s.name, "action", name)
+		upnpFault(w, upnpInvalidAction)
+		return
+	}
+	for _, arg := range action.in {
+		if _, ok := args[arg.name]; !ok {
+			upnpFault(w, upnpInvalidArgs)
+			return
+		}
+	}
+	if id, ok := args["InstanceID"]; ok && id != "0" {
+		upnpFault(w, upnpInstanceID)
+		return
+	}
+	out, uerr := action.fn(commandChan, args)
+	if uerr != nil {
+		upnpFault(w, uerr)
+		return
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" `+
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`+
+		`<u:%sResponse xmlns:u="%s">`, name, s.serviceType())
+	for _, v := range out {
+		fmt.Fprintf(buf, "<%s>%s</%s>", v.name, upnpEscape(v.value), v.name)
+	}
+	fmt.Fprintf(buf, "</u:%sResponse></s:Body></s:Envelope>\n", name)
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	w.Write(buf.Bytes())
+}
+
+func upnpFault(w http.ResponseWriter, e *upnpError) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" `+
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`+
+		`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>`+
+		`<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">`+
+		`<errorCode>%d</errorCode><errorDescription>%s</errorDescription>`+
+		`</UPnPError></detail></s:Fault></s:Body></s:Envelope>`+"\n", e.code, e.desc)
+}
+
+// upnpTime formats secs as H:MM:SS.
+func upnpTime(secs int) string {
+	return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+}
+
+// upnpParseTime parses H+:MM:SS[.F+], returning -1 if it is invalid.
+func upnpParseTime(s string) int {
+	f := strings.Split(strings.SplitN(s, ".", 2)[0], ":")
+	if len(f) != 3 {
+		return -1
+	}
+	secs := 0
+	for _, n := range f {
+		v, err := strconv.Atoi(n)
+		if err != nil || v < 0 {
+			return -1
+		}
+		secs = secs*60 + v
+	}
+	return secs
+}
+
+// upnpDIDL returns DIDL-Lite metadata describing the current track.
+func upnpDIDL(t *apiTrack, p *apiPlayer) string {
+	if t == nil {
+		return ""
+	}
+	title := t.Name
+	switch {
+	case p.Title != "":
+		title = p.Title
+	case p.NowPlaying != "":
+		title = p.NowPlaying
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" `+
+		`xmlns:dc="http://purl.org/dc/elements/1.1/" `+
+		`xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">`+
+		`<item id="%d" parentID="0" restricted="1"><dc:title>%s</dc:title>`,
+		t.ID, upnpEscape(title))
+	if p.Artist != "" {
+		fmt.Fprintf(buf, "<upnp:artist>%s</upnp:artist>", upnpEscape(p.Artist))
+	}
+	fmt.Fprintf(buf, "<upnp:class>object.item.audioItem.musicTrack</upnp:class>"+
+		`<res duration="%s">%s</res></item></DIDL-Lite>`,
+		upnpTime(p.Duration), upnpEscape(t.URI))
+	return buf.String()
+}
+
+// upnpTransport is the AVTransport state derived from the player.
+type upnpTransport struct {
+	state    string // e.g. PLAYING
+	uri      string // the AVTransportURI
+	metaData string
+	player   apiPlayer
+	tracks   int
+}
+
+func upnpGetTransport(commandChan chan<- interface{}) upnpTransport {
+	st := getAPIState(commandChan, true)
+	t := upnpTransport{player: st.player, tracks: len(st.playlist.Tracks)}
+	t.state = map[string]string{
+		"playing": "PLAYING", "paused": "PAUSED_PLAYBACK",
+		"stopped": "STOPPED"}[st.player.State]
+	upnpMu.Lock()
+	pending := upnpPending
+	upnpMu.Unlock()
+	track := st.player.Track
+	for i := range st.playlist.Tracks {
+		if st.playlist.Tracks[i].ID == pending {
+			track = &st.playlist.Tracks[i]
+		}
+	}
+	if track == nil {
+		t.state = "NO_MEDIA_PRESENT"
+		return t
+	}
+	t.uri = track.URI
+	upnpMu.Lock()
+	t.metaData = upnpMetaData[track.ID]
+	upnpMu.Unlock()
+	if t.metaData == "" && st.player.Track != nil && track.ID == st.player.Track.ID {
+		t.metaData = upnpDIDL(track, &st.player)
+	}
+	return t
+}
+
+func upnpPlayMode(p *apiPlayer) string {
+	switch {
+	case p.Repeat:
+		return "REPEAT_ONE"
+	case p.Loop:
+		return "REPEAT_ALL"
+	case p.Shuffle:
+		return "SHUFFLE"
+	}
+	return "NORMAL"
+}
+
+// AVTransport actions
+
+func upnpSetAVTransportURI(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	uri := args["CurrentURI"]
+	if uri == "" {
+		return nil, upnpInvalidArgs
+	}
+	replyChan := make(chan int, 1)
+	commandChan <- cmdSetPlaylist{uri: uri, enqueue: true, replyChan: replyChan}
+	id := <-replyChan
+	if id < 0 {
+		return nil, upnpInvalidArgs
+	}
+	upnpMu.Lock()
+	upnpPending = id
+	upnpSets++
+	last := upnpLast
+	upnpLast = id
+	if md := args["CurrentURIMetaData"]; md != "" {
+		upnpMetaData[id] = md
+	}
+	upnpMu.Unlock()
+	// an URI set while playing replaces what is playing, as control
+	// points expect
+	p := getAPIState(commandChan, true).player
+	if p.State != "stopped" {
+		upnpPlay(commandChan, nil)
+		p = getAPIState(commandChan, true).player
+	}
+	// the previous URI is replaced in the playlist too, so that
+	// casting track after track does not grow it without bound
+	if last >= 0 && (p.State == "stopped" || p.Track == nil || p.Track.ID != last) {
+		commandChan <- cmdRemove{id: last}
+		upnpMu.Lock()
+		delete(upnpMetaData, last)
+		upnpMu.Unlock()
+	}
+	return nil, nil
+}
+
+func upnpPlay(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	upnpMu.Lock()
+	pending := upnpPending
+	upnpPending = -1
+	upnpMu.Unlock()
+	p := getAPIState(commandChan, true).player
+	switch {
+	case pending >= 0 && (p.Track == nil || p.Track.ID != pending):
+		commandChan <- cmdPlay{id: pending}
+	case p.State == "stopped":
+		commandChan <- cmdPlay{id: -1}
+	case p.State == "paused":
+		commandChan <- cmdPause{}
+	}
+	return nil, nil
+}
+
+func upnpPause(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	if getAPIState(commandChan, true).player.State == "playing" {
+		commandChan <- cmdPause{}
+	}
+	return nil, nil
+}
+
+func upnpStop(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	commandChan <- cmdStop{}
+	return nil, nil
+}
+
+func upnpNext(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	commandChan <- cmdNext{}
+	return nil, nil
+}
+
+func upnpPrevious(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	commandChan <- cmdPrev{}
+	return nil, nil
+}
+
+// upnpSeek seeks to a time (REL_TIME or ABS_TIME) in the current
+// track, or plays a track (TRACK_NR, counting from 1 in playing
+// order).
+func upnpSeek(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	switch args["Unit"] {
+	case "REL_TIME", "ABS_TIME":
+		secs := upnpParseTime(args["Target"])
+		if secs < 0 {
+			return nil, upnpSeekTarget
+		}
+		commandChan <- cmdSeek{val: secs, mode: seekAbs}
+	case "TRACK_NR":
+		n, err := strconv.Atoi(args["Target"])
+		tracks := getAPIState(commandChan, false).playlist.Tracks
+		if err != nil || n < 1 || n > len(tracks) {
+			return nil, upnpSeekTarget
+		}
+		commandChan <- cmdPlay{id: tracks[n-1].ID}
+	default:
+		return nil, upnpSeekModeInvalid
+	}
+	return nil, nil
+}
+
+func upnpGetPositionInfo(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	st := getAPIState(commandChan, true)
+	p := &st.player
+	track, uri, metaData := "0", "", ""
+	if p.Track != nil {
+		for i, t := range st.playlist.Tracks {
+			if t.Current {
+				track = strconv.Itoa(i + 1)
+			}
+		}
+		uri = p.Track.URI
+		upnpMu.Lock()
+		metaData = upnpMetaData[p.Track.ID]
+		upnpMu.Unlock()
+		if metaData == "" {
+			metaData = upnpDIDL(p.Track, p)
+		}
+	}
+	return []upnpValue{
+		{"Track", track},
+		{"TrackDuration", upnpTime(p.Duration)},
+		{"TrackMetaData", metaData},
+		{"TrackURI", uri},
+		{"RelTime", upnpTime(p.Position)},
+		{"AbsTime", upnpTime(p.Position)},
+		{"RelCount", "2147483647"},
+		{"AbsCount", "2147483647"},
+	}, nil
+}
+
+func upnpGetTransportInfo(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	t := upnpGetTransport(commandChan)
+	return []upnpValue{
+		{"CurrentTransportState", t.state},
+		{"CurrentTransportStatus", "OK"},
+		{"CurrentSpeed", "1"},
+	}, nil
+}
+
+func upnpGetMediaInfo(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	t := upnpGetTransport(commandChan)
+	return []upnpValue{
+		{"NrTracks", strconv.Itoa(t.tracks)},
+		{"MediaDuration", upnpTime(t.player.Duration)},
+		{"CurrentURI", t.uri},
+		{"CurrentURIMetaData", t.metaData},
+		{"NextURI", ""},
+		{"NextURIMetaData", ""},
+		{"PlayMedium", "NETWORK"},
+		{"RecordMedium", "NOT_IMPLEMENTED"},
+		{"WriteStatus", "NOT_IMPLEMENTED"},
+	}, nil
+}
+
+func upnpGetTransportSettings(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	p := getAPIState(commandChan, true).player
+	return []upnpValue{
+		{"PlayMode", upnpPlayMode(&p)},
+		{"RecQualityMode", "NOT_IMPLEMENTED"},
+	}, nil
+}
+
+func upnpGetDeviceCapabilities(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	return []upnpValue{
+		{"PlayMedia", "NETWORK"},
+		{"RecMedia", "NOT_IMPLEMENTED"},
+		{"RecQualityModes", "NOT_IMPLEMENTED"},
+	}, nil
+}
+
+const upnpTransportActions = "Play,Pause,Stop,Seek,Next,Previous"
+
+func upnpGetCurrentTransportActions(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	return []upnpValue{{"Actions", upnpTransportActions}}, nil
+}
+
+// RenderingControl actions
+
+func upnpGetVolume(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	vol := getAPIState(commandChan, true).player.Volume
+	return []upnpValue{{"CurrentVolume", strconv.Itoa(vol)}}, nil
+}
+
+func upnpSetVolume(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	vol, err := strconv.Atoi(args["DesiredVolume"])
+	if err != nil || vol < 0 || vol > 100 {
+		return nil, upnpInvalidArgs
+	}
+	commandChan <- cmdVolume{val: vol * 320 / 100, mode: volAbs}
+	return nil, nil
+}
+
+func upnpGetMute(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	return []upnpValue{{"CurrentMute", "0"}}, nil
+}
+
+// upnpSetMute only accepts unmuting, as muting is not supported.
+func upnpSetMute(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	switch args["DesiredMute"] {
+	case "0", "false":
+		return nil, nil
+	}
+	return nil, upnpActionFailed
+}
+
+func upnpListPresets(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	return []upnpValue{{"CurrentPresetNameList", "FactoryDefaults"}}, nil
+}
+
+func upnpSelectPreset(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	if args["PresetName"] != "FactoryDefaults" {
+		return nil, upnpInvalidArgs
+	}
+	return nil, nil
+}
+
+// ConnectionManager actions
+
+// upnpSinkProtocolInfo lists the media types the renderer accepts.
+var upnpSinkProtocolInfo = func() string {
+	var info []string
+	for _, mime := range []string{
+		"audio/mpeg", "audio/mp4", "audio/aac", "audio/x-aac",
+		"audio/ogg", "audio/flac", "audio/x-flac", "audio/wav",
+		"audio/x-wav", "audio/L16", "audio/x-ms-wma", "video/mp4",
+		"video/mpeg", "video/x-matroska", "video/webm", "video/x-msvideo",
+		"application/ogg", "application/vnd.apple.mpegurl",
+	} {
+		info = append(info, "http-get:*:"+mime+":*")
+	}
+	return strings.Join(info, ",")
+}()
+
+func upnpGetProtocolInfo(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	return []upnpValue{{"Source", ""}, {"Sink", upnpSinkProtocolInfo}}, nil
+}
+
+func upnpGetCurrentConnectionIDs(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	return []upnpValue{{"ConnectionIDs", "0"}}, nil
+}
+
+func upnpGetCurrentConnectionInfo(commandChan chan<- interface{}, args map[string]string) ([]upnpValue, *upnpError) {
+	if args["ConnectionID"] != "0" {
+		return nil, upnpInvalidArgs
+	}
+	return []upnpValue{
+		{"RcsID", "0"},
+		{"AVTransportID", "0"},
+		{"ProtocolInfo", ""},
+		{"PeerConnectionManager", ""},
+		{"PeerConnectionID", "-1"},
+		{"Direction", "Input"},
+		{"Status", "OK"},
+	}, nil
+}
+
+// the services
+var (
+	upnpInstanceArg = upnpArg{"InstanceID", "A_ARG_TYPE_InstanceID"}
+
+	upnpAVTransport = &upnpService{
+		name:       "AVTransport",
+		lastChange: "urn:schemas-upnp-org:metadata-1-0/AVT/",
+		actions: []upnpAction{
+			{name: "SetAVTransportURI", fn: upnpSetAVTransportURI,
+				in: []upnpArg{upnpInstanceArg,
+					{"CurrentURI", "AVTransportURI"},
+					{"CurrentURIMetaData", "AVTransportURIMetaData"}}},
+			{name: "Play", fn: upnpPlay,
+				in: []upnpArg{upnpInstanceArg, {"Speed", "TransportPlaySpeed"}}},
+			{name: "Pause", fn: upnpPause, in: []upnpArg{upnpInstanceArg}},
+			{name: "Stop", fn: upnpStop, in: []upnpArg{upnpInstanceArg}},
+			{name: "Next", fn: upnpNext, in: []upnpArg{upnpInstanceArg}},
+			{name: "Previous", fn: upnpPrevious, in: []upnpArg{upnpInstanceArg}},
+			{name: "Seek", fn: upnpSeek,
+				in: []upnpArg{upnpInstanceArg,
+					{"Unit", "A_ARG_TYPE_SeekMode"},
+					{"Target", "A_ARG_TYPE_SeekTarget"}}},
+			{name: "GetPositionInfo", fn: upnpGetPositionInfo,
+				in: []upnpArg{upnpInstanceArg},
+				out: []upnpArg{
+					{"Track", "CurrentTrack"},
+					{"TrackDuration", "CurrentTrackDuration"},
+					{"TrackMetaData", "CurrentTrackMetaData"},
+					{"TrackURI", "CurrentTrackURI"},
+					{"RelTime", "RelativeTimePosition"},
+					{"AbsTime", "AbsoluteTimePosition"},
+					{"RelCount", "RelativeCounterPosition"},
+					{"AbsCount", "AbsoluteCounterPosition"}}},
+			{name: "GetTransportInfo", fn: upnpGetTransportInfo,
+				in: []upnpArg{upnpInstanceArg},
+				out: []upnpArg{
+					{"CurrentTransportState", "TransportState"},
+					{"CurrentTransportStatus", "TransportStatus"},
+					{"CurrentSpeed", "TransportPlaySpeed"}}},
+			{name: "GetMediaInfo", fn: upnpGetMediaInfo,
+				in: []upnpArg{upnpInstanceArg},
+				out: []upnpArg{
+					{"NrTracks", "NumberOfTracks"},
+					{"MediaDuration", "CurrentMediaDuration"},
+					{"CurrentURI", "AVTransportURI"},
+					{"CurrentURIMetaData", "AVTransportURIMetaData"},
+					{"NextURI", "NextAVTransportURI"},
+					{"NextURIMetaData", "NextAVTransportURIMetaData"},
+					{"PlayMedium", "PlaybackStorageMedium"},
+					{"RecordMedium", "RecordStorageMedium"},
+					{"WriteStatus", "RecordMediumWriteStatus"}}},
+			{name: "GetTransportSettings", fn: upnpGetTransportSettings,
+				in: []upnpArg{upnpInstanceArg},
+				out: []upnpArg{
+					{"PlayMode", "CurrentPlayMode"},
+					{"RecQualityMode", "CurrentRecordQualityMode"}}},
+			{name: "GetDeviceCapabilities", fn: upnpGetDeviceCapabilities,
+				in: []upnpArg{upnpInstanceArg},
+				out: []upnpArg{
+					{"PlayMedia", "PossiblePlaybackStorageMedia"},
+					{"RecMedia", "PossibleRecordStorageMedia"},
+					{"RecQualityModes", "PossibleRecordQualityModes"}}},
+			{name: "GetCurrentTransportActions", fn: upnpGetCurrentTransportActions,
+				in:  []upnpArg{upnpInstanceArg},
+				out: []upnpArg{{"Actions", "CurrentTransportActions"}}},
+		},
+		stateVars: []upnpStateVar{
+			{"TransportState", "string", false, []string{"STOPPED", "PLAYING",
+				"PAUSED_PLAYBACK", "TRANSITIONING", "NO_MEDIA_PRESENT"}},
+			{"TransportStatus", "string", false, []string{"OK", "ERROR_OCCURRED"}},
+			{"TransportPlaySpeed", "string", false, []string{"1"}},
+			{"PlaybackStorageMedium", "string", false, []string{"NETWORK", "NONE"}},
+			{"RecordStorageMedium", "string", false, []string{"NOT_IMPLEMENTED"}},
+			{"PossiblePlaybackStorageMedia", "string", false, nil},
+			{"PossibleRecordStorageMedia", "string", false, nil},
+			{"CurrentPlayMode", "string", false, []string{"NORMAL", "SHUFFLE",
+				"REPEAT_ONE", "REPEAT_ALL"}},
+			{"CurrentRecordQualityMode", "string", false, []string{"NOT_IMPLEMENTED"}},
+			{"PossibleRecordQualityModes", "string", false, nil},
+			{"RecordMediumWriteStatus", "string", false, []string{"NOT_IMPLEMENTED"}},
+			{"NumberOfTracks", "ui4", false, nil},
+			{"CurrentTrack", "ui4", false, nil},
+			{"CurrentTrackDuration", "string", false, nil},
+			{"CurrentMediaDuration", "string", false, nil},
+			{"CurrentTrackMetaData", "string", false, nil},
+			{"CurrentTrackURI", "string", false, nil},
+			{"AVTransportURI", "string", false, nil},
+			{"AVTransportURIMetaData", "string", false, nil},
+			{"NextAVTransportURI", "string", false, nil},
+			{"NextAVTransportURIMetaData", "string", false, nil},
+			{"RelativeTimePosition", "string", false, nil},
+			{"AbsoluteTimePosition", "string", false, nil},
+			{"RelativeCounterPosition", "i4", false, nil},
+			{"AbsoluteCounterPosition", "i4", false, nil},
+			{"CurrentTransportActions", "string", false, nil},
+			{"LastChange", "string", true, nil},
+			{"A_ARG_TYPE_SeekMode", "string", false, []string{"REL_TIME",
+				"ABS_TIME", "TRACK_NR"}},
+			{"A_ARG_TYPE_SeekTarget", "string", false, nil},
+			{"A_ARG_TYPE_InstanceID", "ui4", false, nil},
+		},
+	}
+
+	upnpRenderingControl = &upnpService{
+		name:       "RenderingControl",
+		lastChange: "urn:schemas-upnp-org:metadata-1-0/RCS/",
+		actions: []upnpAction{
+			{name: "GetVolume", fn: upnpGetVolume,
+				in:  []upnpArg{upnpInstanceArg, {"Channel", "A_ARG_TYPE_Channel"}},
+				out: []upnpArg{{"CurrentVolume", "Volume"}}},
+			{name: "SetVolume", fn: upnpSetVolume,
+				in: []upnpArg{upnpInstanceArg, {"Channel", "A_ARG_TYPE_Channel"},
+					{"DesiredVolume", "Volume"}}},
+			{name: "GetMute", fn: upnpGetMute,
+				in:  []upnpArg{upnpInstanceArg, {"Channel", "A_ARG_TYPE_Channel"}},
+				out: []upnpArg{{"CurrentMute", "Mute"}}},
+			{name: "SetMute", fn: upnpSetMute,
+				in: []upnpArg{upnpInstanceArg, {"Channel", "A_ARG_TYPE_Channel"},
+					{"DesiredMute", "Mute"}}},
+			{name: "ListPresets", fn: upnpListPresets,
+				in:  []upnpArg{upnpInstanceArg},
+				out: []upnpArg{{"CurrentPresetNameList", "PresetNameList"}}},
+			{name: "SelectPreset", fn: upnpSelectPreset,
+				in: []upnpArg{upnpInstanceArg, {"PresetName", "A_ARG_TYPE_PresetName"}}},
+		},
+		stateVars: []upnpStateVar{
+			{"Volume", "ui2", false, nil},
+			{"Mute", "boolean", false, nil},
+			{"PresetNameList", "string", false, nil},
+			{"LastChange", "string", true, nil},
+			{"A_ARG_TYPE_Channel", "string", false, []string{"Master"}},
+			{"A_ARG_TYPE_PresetName", "string", false, []string{"FactoryDefaults"}},
+			{"A_ARG_TYPE_InstanceID", "ui4", false, nil},
+		},
+	}
+
+	upnpConnectionManager = &upnpService{
+		name: "ConnectionManager",
+		actions: []upnpAction{
+			{name: "GetProtocolInfo", fn: upnpGetProtocolInfo,
+				out: []upnpArg{{"Source", "SourceProtocolInfo"},
+					{"Sink", "SinkProtocolInfo"}}},
+			{name: "GetCurrentConnectionIDs", fn: upnpGetCurrentConnectionIDs,
+				out: []upnpArg{{"ConnectionIDs", "CurrentConnectionIDs"}}},
+			{name: "GetCurrentConnectionInfo", fn: upnpGetCurrentConnectionInfo,
+				in: []upnpArg{{"ConnectionID", "A_ARG_TYPE_ConnectionID"}},
+				out: []upnpArg{
+					{"RcsID", "A_ARG_TYPE_RcsID"},
+					{"AVTransportID", "A_ARG_TYPE_AVTransportID"},
+					{"ProtocolInfo", "A_ARG_TYPE_ProtocolInfo"},
+					{"PeerConnectionManager", "A_ARG_TYPE_ConnectionManager"},
+					{"PeerConnectionID", "A_ARG_TYPE_ConnectionID"},
+					{"Direction", "A_ARG_TYPE_Direction"},
+					{"Status", "A_ARG_TYPE_ConnectionStatus"}}},
+		},
+		stateVars: []upnpStateVar{
+			{"SourceProtocolInfo", "string", true, nil},
+			{"SinkProtocolInfo", "string", true, nil},
+			{"CurrentConnectionIDs", "string", true, nil},
+			{"A_ARG_TYPE_ConnectionStatus", "string", false, []string{"OK",
+				"ContentFormatMismatch", "InsufficientBandwidth",
+				"UnreliableChannel", "Unknown"}},
+			{"A_ARG_TYPE_ConnectionManager", "string", false, nil},
+			{"A_ARG_TYPE_Direction", "string", false, []string{"Input", "Output"}},
+			{"A_ARG_TYPE_ProtocolInfo", "string", false, nil},
+			{"A_ARG_TYPE_ConnectionID", "i4", false, nil},
+			{"A_ARG_TYPE_AVTransportID", "i4", false, nil},
+			{"A_ARG_TYPE_RcsID", "i4", false, nil},
+		},
+	}
+
+	upnpServices = []*upnpService{
+		upnpAVTransport, upnpRenderingControl, upnpConnectionManager}
+)
+
+// Eventing (GENA)
+
+// upnpSub is an event subscription.
+type upnpSub struct {
+	service  *upnpService
+	callback string
+	seq      int
+	expires  time.Time
+}
+
+const upnpSubTimeout = 1800 * time.Second
+
+// upnpEvent handles SUBSCRIBE and UNSUBSCRIBE requests.
+func upnpEvent(commandChan chan<- interface{}, s *upnpService, w http.ResponseWriter, r *http.Request) {
+	sid := r.Header.Get("SID")
+	switch r.Method {
+	case "SUBSCRIBE":
+		upnpMu.Lock()
+		if sid != "" {
+			// renewal
+			sub, ok := upnpSubs[sid]
+			if !ok {
+				upnpMu.Unlock()
+				http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+				return
+			}
+			sub.expires = time.Now().Add(upnpSubTimeout)
+			upnpMu.Unlock()
+		} else {
+			upnpMu.Unlock()
+			callback := strings.Trim(strings.SplitN(r.Header.Get("CALLBACK"), ">", 2)[0], "< ")
+			if r.Header.Get("NT") != "upnp:event" || !strings.HasPrefix(callback, "http://") {
+				http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+				return
+			}
+			sid = "uuid:" + upnpNewSID()
+			sub := &upnpSub{service: s, callback: callback,
+				expires: time.Now().Add(upnpSubTimeout)}
+			upnpMu.Lock()
+			upnpSubs[sid] = sub
+			upnpMu.Unlock()
+			// the initial event must follow the response
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				upnpNotify(sid, sub, upnpEventBody(s, upnpGetTransport(commandChan)))
+			}()
+		}
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", fmt.Sprintf("Second-%d", int(upnpSubTimeout/time.Second)))
+		w.Header().Set("SERVER", upnpServerHeader())
+	case "UNSUBSCRIBE":
+		upnpMu.Lock()
+		_, ok := upnpSubs[sid]
+		delete(upnpSubs, sid)
+		upnpMu.Unlock()
+		if !ok {
+			http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		}
+	default:
+		w.Header().Set("Allow", "SUBSCRIBE, UNSUBSCRIBE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// upnpNewSID returns a random UUID for a subscription.
+func upnpNewSID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// upnpVersion returns the version reported to control points.
+func upnpVersion() string {
+	if version == "" {
+		return "unknown"
+	}
+	return version
+}
+
+func upnpServerHeader() string {
+	return runtime.GOOS + "/1.0 UPnP/1.0 MPlayer-RC/" + upnpVersion()
+}
+
+// upnpEventBody returns the property set describing the state of
+// service s.
+func upnpEventBody(s *upnpService, t upnpTransport) string {
+	props := new(bytes.Buffer)
+	if s.lastChange != "" {
+		change := new(bytes.Buffer)
+		fmt.Fprintf(change, `<Event xmlns="%s"><InstanceID val="0">`, s.lastChange)
+		val := func(name, value string) {
+			fmt.Fprintf(change, `<%s val="%s"/>`, name, upnpEscape(value))
+		}
+		switch s {
+		case upnpAVTransport:
+			val("TransportState", t.state)
+			val("TransportStatus", "OK")
+			val("CurrentPlayMode", upnpPlayMode(&t.player))
+			val("NumberOfTracks", strconv.Itoa(t.tracks))
+			val("AVTransportURI", t.uri)
+			val("AVTransportURIMetaData", t.metaData)
+			val("CurrentTrackURI", t.uri)
+			val("CurrentTrackMetaData", t.metaData)
+			val("CurrentTrackDuration", upnpTime(t.player.Duration))
+			val("CurrentMediaDuration", upnpTime(t.player.Duration))
+			val("CurrentTransportActions", upnpTransportActions)
+		case upnpRenderingControl:
+			fmt.Fprintf(change, `<Volume channel="Master" val="%d"/>`, t.player.Volume)
+			change.WriteString(`<Mute channel="Master" val="0"/>`)
+		}
+		change.WriteString("</InstanceID></Event>")
+		fmt.Fprintf(props, "<e:property><LastChange>%s</LastChange></e:property>",
+			upnpEscape(change.String()))
+	} else {
+		fmt.Fprintf(props, "<e:property><SourceProtocolInfo></SourceProtocolInfo></e:property>"+
+			"<e:property><SinkProtocolInfo>%s</SinkProtocolInfo></e:property>"+
+			"<e:property><CurrentConnectionIDs>0</CurrentConnectionIDs></e:property>",
+			upnpSinkProtocolInfo)
+	}
+	return `<?xml version="1.0" encoding="utf-8"?>` + "\n" +
+		`<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0">` +
+		props.String() + "</e:propertyset>\n"
+}
+
+var upnpClient = &http.Client{Timeout: 5 * time.Second}
+
+// upnpNotify sends an event to subscription sub, dropping the
+// subscription if the subscriber cannot be reached.
+func upnpNotify(sid string, sub *upnpSub, body string) {
+	upnpMu.Lock()
+	seq := sub.seq
+	sub.seq++
+	upnpMu.Unlock()
+	req, err := http.NewRequest("NOTIFY", sub.callback, strings.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("NT", "upnp:event")
+	req.Header.Set("NTS", "upnp:propchange")
+	req.Header.Set("SID", sid)
+	req.Header.Set("SEQ", strconv.Itoa(seq))
+	resp, err := upnpClient.Do(req)
+	if err != nil {
+		logDebug("dropping upnp subscription", "sid", sid, "err", err)
+		upnpMu.Lock()
+		delete(upnpSubs, sid)
+		upnpMu.Unlock()
+		return
+	}
+	resp.Body.Close()
+}
+
+// upnpWatch sends events to the subscribers when the player state
+// changes, and expires stale subscriptions.
+func upnpWatch(commandChan chan<- interface{}, ch chan []byte) {
+	for event := range ch {
+		// coalesce the events queued
+		changed := false
+		for more := true; more; {
+			changed = changed || bytes.HasPrefix(event, []byte("event: playlist\n"))
+			select {
+			case event, more = <-ch:
+			default:
+				more = false
+			}
+		}
+		if changed {
+			upnpPrune(commandChan)
+		}
+		upnpMu.Lock()
+		if len(upnpSubs) == 0 {
+			upnpMu.Unlock()
+			continue
+		}
+		subs := map[string]*upnpSub{}
+		now := time.Now()
+		for sid, sub := range upnpSubs {
+			if now.After(sub.expires) {
+				delete(upnpSubs, sid)
+			} else if sub.service != upnpConnectionManager {
+				subs[sid] = sub
+			}
+		}
+		upnpMu.Unlock()
+		t := upnpGetTransport(commandChan)
+		for sid, sub := range subs {
+			upnpNotify(sid, sub, upnpEventBody(sub.service, t))
+		}
+	}
+}
+
+// upnpPrune forgets the metadata (and the pending and last tracks) of
+// tracks no longer in the playlist.
+func upnpPrune(commandChan chan<- interface{}) {
+	upnpMu.Lock()
+	none := len(upnpMetaData) == 0 && upnpPending < 0 && upnpLast < 0
+	sets := upnpSets
+	upnpMu.Unlock()
+	if none {
+		return
+	}
+	ids := map[int]bool{}
+	for _, t := range getAPIState(commandChan, false).playlist.Tracks {
+		ids[t.ID] = true
+	}
+	upnpMu.Lock()
+	defer upnpMu.Unlock()
+	if upnpSets != sets {
+		// a track was added meanwhile; its playlist event will bring
+		// us back here
+		return
+	}
+	for id := range upnpMetaData {
+		if !ids[id] {
+			delete(upnpMetaData, id)
+		}
+	}
+	if !ids[upnpPending] {
+		upnpPending = -1
+	}
+	if !ids[upnpLast] {
+		upnpLast = -1
+	}
+}
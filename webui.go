@@ -0,0 +1,372 @@
+/*
+   Copyright 2015 The MPlayer-RC Authors. See the AUTHORS file at the
+   top-level directory of this distribution and at
+   <https://xi2.org/x/mplayer-rc/m/AUTHORS>.
+
+   This file is part of MPlayer-RC.
+
+   MPlayer-RC is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published
+   by the Free Software Foundation, either version 3 of the License,
+   or (at your option) any later version.
+
+   MPlayer-RC is distributed in the hope that it will be useful, but
+   WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with MPlayer-RC.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// startWebUI registers the built-in web remote at /. It is a single
+// page which drives the same status, playlist, browse and events
+// endpoints as other clients, so it needs the same passwords.
+func startWebUI() {
+	http.HandleFunc(
+		"/",
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			if authorized(w, r, roleReadOnly) == nil {
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("X-Frame-Options", "DENY")
+			io.WriteString(w, webUITxt)
+		})
+}
+
+// webUITxt is the web remote. Note that it must not contain
+// backquotes.
+const webUITxt = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>MPlayer-RC</title>
+<style>
+* { box-sizing: border-box; }
+body { margin: 0; font-family: system-ui, sans-serif; background: #1d1f21; color: #e0e0e0; }
+header { padding: .75em 1em; background: #282a2e; display: flex; gap: 1em; align-items: center; }
+header h1 { font-size: 1.1em; margin: 0; flex: 1; }
+nav button { background: none; border: none; color: #aaa; font-size: 1em; padding: .3em .6em; cursor: pointer; }
+nav button.active { color: #fff; border-bottom: 2px solid #81a2be; }
+main { max-width: 40em; margin: 0 auto; padding: 1em; }
+#now { display: flex; gap: 1em; align-items: center; }
+#art { width: 6em; height: 6em; object-fit: cover; border-radius: .3em; background: #373b41; }
+#title { font-size: 1.2em; font-weight: bold; overflow-wrap: anywhere; }
+#artist, #station { color: #aaa; }
+.controls { display: flex; justify-content: center; gap: .5em; margin: 1em 0; flex-wrap: wrap; }
+.controls button { font-size: 1.4em; min-width: 2.5em; padding: .3em; border: none; border-radius: .3em; background: #373b41; color: #e0e0e0; cursor: pointer; }
+.controls button.on { background: #81a2be; color: #1d1f21; }
+.row { display: flex; align-items: center; gap: .5em; margin: .5em 0; }
+.row input[type=range] { flex: 1; }
+.time { font-variant-numeric: tabular-nums; min-width: 3.5em; text-align: center; }
+ul { list-style: none; margin: 0; padding: 0; }
+li { padding: .6em .5em; border-bottom: 1px solid #373b41; cursor: pointer; display: flex; gap: .5em; align-items: center; }
+li span { flex: 1; overflow-wrap: anywhere; }
+li.current { color: #b5bd68; font-weight: bold; }
+li.dragover { border-top: 2px solid #81a2be; }
+li .add { background: #373b41; border: none; color: #e0e0e0; border-radius: .3em; padding: .2em .6em; cursor: pointer; }
+#path { color: #aaa; overflow-wrap: anywhere; margin-bottom: .5em; }
+#error { color: #cc6666; min-height: 1.2em; }
+.hidden { display: none; }
+</style>
+</head>
+<body>
+<header>
+<h1>MPlayer-RC</h1>
+<nav>
+<button data-view="player" class="active">Player</button>
+<button data-view="playlist">Playlist</button>
+<button data-view="browse">Browse</button>
+</nav>
+</header>
+<main>
+<div id="error"></div>
+<section id="player">
+<div id="now">
+<img id="art" alt="">
+<div>
+<div id="title">&nbsp;</div>
+<div id="artist"></div>
+<div id="station"></div>
+</div>
+</div>
+<div class="row">
+<span class="time" id="pos">0:00</span>
+<input type="range" id="seek" min="0" max="0" value="0">
+<span class="time" id="len">0:00</span>
+</div>
+<div class="controls">
+<button data-cmd="pl_previous" title="Previous">&#x23EE;</button>
+<button data-cmd="pl_pause" id="pause" title="Play/Pause">&#x25B6;</button>
+<button data-cmd="pl_stop" title="Stop">&#x23F9;</button>
+<button data-cmd="pl_next" title="Next">&#x23ED;</button>
+</div>
+<div class="controls">
+<button data-cmd="pl_random" id="random" title="Shuffle">&#x1F500;</button>
+<button data-cmd="pl_loop" id="loop" title="Loop playlist">&#x1F501;</button>
+<button data-cmd="pl_repeat" id="repeat" title="Repeat track">&#x1F502;</button>
+</div>
+<div class="row">
+<span>&#x1F50A;</span>
+<input type="range" id="volume" min="0" max="320" value="0">
+</div>
+</section>
+<section id="playlist" class="hidden">
+<ul id="tracks"></ul>
+</section>
+<section id="browse" class="hidden">
+<div id="path"></div>
+<ul id="files"></ul>
+</section>
+</main>
+<script>
+"use strict";
+var state = {}, seeking = false, changingVolume = false;
+
+function $(id) { return document.getElementById(id); }
+
+function showError(msg) {
+	$("error").textContent = msg || "";
+}
+
+function request(path, params) {
+	var q = new URLSearchParams(params || {}).toString();
+	return fetch(path + (q ? "?" + q : ""), {credentials: "same-origin"}).then(function (r) {
+		if (!r.ok) {
+			throw new Error(r.status == 403 ? "Not allowed" : r.statusText);
+		}
+		showError();
+		return r.json();
+	}).catch(function (e) {
+		showError(e.message);
+		throw e;
+	});
+}
+
+function command(cmd, params) {
+	params = params || {};
+	params.command = cmd;
+	return request("/requests/status.json", params).then(fromStatus).then(update);
+}
+
+// fromStatus converts status.json to the form of an /events state.
+function fromStatus(s) {
+	var meta = (((s.information || {}).category || {}).meta) || {};
+	return {
+		state: s.state, currentplid: s.currentplid, time: s.time,
+		length: s.length, volume: s.volume, loop: s.loop,
+		repeat: s.repeat, random: s.random, filename: meta.filename,
+		title: meta.title, artist: meta.artist,
+		now_playing: meta.now_playing, station: meta.station,
+		artwork_url: meta.artwork_url
+	};
+}
+
+function fmtTime(t) {
+	t = Math.max(0, t | 0);
+	var s = t % 60;
+	return Math.floor(t / 60) + ":" + (s < 10 ? "0" : "") + s;
+}
+
+function update(s) {
+	var trackChanged = s.currentplid != state.currentplid;
+	state = Object.assign(state, s);
+	$("title").textContent = state.now_playing || state.title || state.filename || " ";
+	$("artist").textContent = state.now_playing ? state.title : (state.artist || "");
+	$("station").textContent = state.station || "";
+	var url = state.artwork_url || "";
+	$("art").style.visibility = url ? "visible" : "hidden";
+	if (url && $("art").getAttribute("src") != url) {
+		$("art").src = url;
+	}
+	$("pause").innerHTML = state.state == "playing" ? "&#x23F8;" : "&#x25B6;";
+	if (!seeking) {
+		$("seek").max = state.length || 0;
+		$("seek").value = state.time || 0;
+	}
+	$("pos").textContent = fmtTime(state.time);
+	$("len").textContent = fmtTime(state.length);
+	if (!changingVolume) {
+		$("volume").value = state.volume || 0;
+	}
+	["random", "loop", "repeat"].forEach(function (k) {
+		$(k).classList.toggle("on", !!state[k]);
+	});
+	if (trackChanged) {
+		loadPlaylist();
+	}
+}
+
+function loadPlaylist() {
+	request("/requests/playlist.json").then(function (pl) {
+		var ul = $("tracks"), dragged = null;
+		ul.textContent = "";
+		pl.children[0].children.forEach(function (t) {
+			var li = document.createElement("li");
+			var span = document.createElement("span");
+			span.textContent = t.name;
+			li.appendChild(span);
+			li.draggable = true;
+			li.dataset.id = t.id;
+			if (t.current) {
+				li.className = "current";
+			}
+			li.onclick = function () { command("pl_play", {id: t.id}); };
+			li.ondragstart = function (e) {
+				dragged = t.id;
+				e.dataTransfer.effectAllowed = "move";
+				e.dataTransfer.setData("text/plain", t.id);
+			};
+			li.ondragover = function (e) {
+				e.preventDefault();
+				li.classList.add("dragover");
+			};
+			li.ondragleave = function () { li.classList.remove("dragover"); };
+			li.ondrop = function (e) {
+				e.preventDefault();
+				li.classList.remove("dragover");
+				if (dragged !== null && dragged != t.id) {
+					command("pl_move", {psid: dragged, id: t.id}).then(loadPlaylist);
+				}
+				dragged = null;
+			};
+			ul.appendChild(li);
+		});
+	});
+}
+
+// browse lists directory dir. Each path component is escaped, as
+// file names may contain #, ? and %.
+function browse(dir) {
+	var uri = "file://" + dir.split("/").map(encodeURIComponent).join("/");
+	request("/requests/browse.json", {uri: uri}).then(function (b) {
+		var ul = $("files");
+		localStorage.setItem("mplayer-rc-dir", dir);
+		$("path").textContent = dir;
+		ul.textContent = "";
+		b.element.sort(function (x, y) {
+			if (x.type != y.type) {
+				return x.type == "dir" ? -1 : 1;
+			}
+			return x.name.localeCompare(y.name);
+		}).forEach(function (f) {
+			var li = document.createElement("li");
+			var span = document.createElement("span");
+			span.textContent = (f.type == "dir" ? "\u{1F4C1} " : "") + f.name;
+			li.appendChild(span);
+			if (f.type == "dir") {
+				li.onclick = function () { browse(normalise(f.path)); };
+			} else {
+				var add = document.createElement("button");
+				add.className = "add";
+				add.textContent = "+";
+				add.title = "Add to playlist";
+				add.onclick = function (e) {
+					e.stopPropagation();
+					command("in_enqueue", {input: f.path}).then(loadPlaylist);
+				};
+				li.appendChild(add);
+				li.onclick = function () { command("in_play", {input: f.path}).then(loadPlaylist); };
+			}
+			ul.appendChild(li);
+		});
+	});
+}
+
+// normalise resolves ".." in a path.
+function normalise(p) {
+	var out = [];
+	p.split("/").forEach(function (c) {
+		if (c == "..") {
+			out.pop();
+		} else if (c && c != ".") {
+			out.push(c);
+		}
+	});
+	return "/" + out.join("/");
+}
+
+document.querySelectorAll("nav button").forEach(function (b) {
+	b.onclick = function () {
+		document.querySelectorAll("nav button").forEach(function (x) {
+			x.classList.toggle("active", x == b);
+			$(x.dataset.view).classList.toggle("hidden", x != b);
+		});
+		if (b.dataset.view == "playlist") {
+			loadPlaylist();
+		} else if (b.dataset.view == "browse" && !$("files").firstChild) {
+			browse(localStorage.getItem("mplayer-rc-dir") || "/");
+		}
+	};
+});
+document.querySelectorAll("[data-cmd]").forEach(function (b) {
+	b.onclick = function () { command(b.dataset.cmd); };
+});
+$("seek").oninput = function () {
+	seeking = true;
+	$("pos").textContent = fmtTime(this.value);
+};
+$("seek").onchange = function () {
+	seeking = false;
+	command("seek", {val: this.value});
+};
+$("volume").oninput = function () { changingVolume = true; };
+$("volume").onchange = function () {
+	changingVolume = false;
+	command("volume", {val: this.value});
+};
+
+// follow the player state using /events, falling back to polling
+var polling = null;
+function poll() {
+	if (polling === null) {
+		polling = setInterval(function () {
+			request("/requests/status.json").then(fromStatus).then(update);
+		}, 2000);
+	}
+}
+request("/requests/status.json").then(fromStatus).then(update);
+if (window.EventSource) {
+	var events = new EventSource("/events");
+	["status", "track", "state", "volume", "seek", "metadata", "options", "playlist"].forEach(function (name) {
+		events.addEventListener(name, function (e) {
+			update(JSON.parse(e.data));
+			if (name == "playlist") {
+				loadPlaylist();
+			}
+		});
+	});
+	events.onerror = function () {
+		if (events.readyState == EventSource.CLOSED) {
+			poll();
+		}
+	};
+} else {
+	poll();
+}
+// advance the position between events while playing
+setInterval(function () {
+	if (state.state == "playing" && !seeking && state.time < state.length) {
+		state.time++;
+		$("seek").value = state.time;
+		$("pos").textContent = fmtTime(state.time);
+	}
+}, 1000);
+</script>
+</body>
+</html>
+`